@@ -0,0 +1,125 @@
+package triflestats
+
+import (
+	"fmt"
+	"time"
+)
+
+// Alignment selects where buckets of multi-unit granularities like 7h or 10d
+// start.
+type Alignment int
+
+const (
+	// AlignCalendar restarts buckets at the enclosing calendar period: seconds
+	// every minute, minutes every hour, hours every day and longer units every
+	// year, so the last bucket of a period may be short.
+	AlignCalendar Alignment = iota
+	// AlignEpoch tiles time from AlignmentAnchor without restarting. Sub-day
+	// buckets last a fixed duration, and longer ones a fixed number of local
+	// days, months, quarters or years. Weeks start on BeginningOfWeek, or on
+	// the weekday of AlignmentAnchor when set, and ignore WeekMode.
+	AlignEpoch
+)
+
+func (c *Config) alignment() Alignment {
+	if c == nil {
+		return AlignCalendar
+	}
+	return c.Alignment
+}
+
+// alignmentAnchor returns the instant epoch-aligned buckets count from, the
+// start of 1970-01-01 in the configured time zone unless AlignmentAnchor is set.
+func (n *Nocturnal) alignmentAnchor(loc *time.Location) time.Time {
+	if n.Config != nil && !n.Config.AlignmentAnchor.IsZero() {
+		return n.Config.AlignmentAnchor.In(loc)
+	}
+	return startOfDay(1970, time.January, 1, n.configDayStartOffset(), loc)
+}
+
+// floorEpoch floors t, which falls on the given day, to an epoch-aligned
+// bucket.
+func (n *Nocturnal) floorEpoch(t time.Time, year int, month time.Month, day int, offset int, unit Unit) time.Time {
+	loc := t.Location()
+	dayOffset := n.configDayStartOffset()
+	anchor := n.alignmentAnchor(loc)
+	anchorYear, anchorMonth, anchorDay := n.dayOf(anchor)
+
+	switch unit {
+	case UnitSecond, UnitMinute, UnitHour:
+		size := unitDuration(offset, unit)
+		elapsed := t.Sub(anchor)
+		floored := elapsed - elapsed%size
+		if floored > elapsed {
+			floored -= size
+		}
+		return anchor.Add(floored)
+	case UnitDay, UnitWeek:
+		size := offset
+		if unit == UnitWeek {
+			size *= 7
+			if n.Config == nil || n.Config.AlignmentAnchor.IsZero() {
+				weekday := time.Date(anchorYear, anchorMonth, anchorDay, 0, 0, 0, 0, time.UTC).Weekday()
+				anchorDay -= mod(int(weekday)-daysIntoWeek(n.configBeginningOfWeek()), 7)
+			}
+		}
+		from := time.Date(anchorYear, anchorMonth, anchorDay, 0, 0, 0, 0, time.UTC)
+		days := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Sub(from) / (24 * time.Hour))
+		return startOfDay(anchorYear, anchorMonth, anchorDay+floorDiv(days, size)*size, dayOffset, loc)
+	case UnitMonth, UnitQuarter:
+		size := offset
+		if unit == UnitQuarter {
+			size *= 3
+		}
+		months := (year-anchorYear)*12 + int(month) - int(anchorMonth)
+		return startOfDay(anchorYear, anchorMonth+time.Month(floorDiv(months, size)*size), 1, dayOffset, loc)
+	case UnitYear:
+		return startOfDay(anchorYear+floorDiv(year-anchorYear, offset)*offset, time.January, 1, dayOffset, loc)
+	case UnitFiscalQuarter:
+		anchorFiscalYear, anchorQuarter := n.fiscalQuarterOf(anchorYear, anchorMonth, anchorDay)
+		fiscalYear, quarter := n.fiscalQuarterOf(year, month, day)
+		quarters := (fiscalYear-anchorFiscalYear)*4 + quarter - anchorQuarter
+		y, m, d := n.fiscalQuarterStart(anchorFiscalYear, anchorQuarter+floorDiv(quarters, offset)*offset).Date()
+		return startOfDay(y, m, d, dayOffset, loc)
+	case UnitFiscalYear:
+		anchorFiscalYear, _ := n.fiscalQuarterOf(anchorYear, anchorMonth, anchorDay)
+		fiscalYear, _ := n.fiscalQuarterOf(year, month, day)
+		y, m, d := n.fiscalQuarterStart(anchorFiscalYear+floorDiv(fiscalYear-anchorFiscalYear, offset)*offset, 0).Date()
+		return startOfDay(y, m, d, dayOffset, loc)
+	default:
+		panic(fmt.Sprintf("invalid unit: %v", unit))
+	}
+}
+
+// dayStartsOnGrid reports whether every day start falls on the epoch-aligned
+// grid of sub-day buckets of the given size. Zones that change their offset
+// move day starts by multiples of 15 minutes.
+func (c *Config) dayStartsOnGrid(size time.Duration) bool {
+	loc := c.Location()
+	n := NewNocturnal(time.Time{}, c)
+	anchor := n.alignmentAnchor(loc)
+	year, month, day := n.dayOf(anchor)
+	phase := anchor.Sub(startOfDay(year, month, day, n.configDayStartOffset(), loc))
+
+	step := 15 * time.Minute
+	if start, end := anchor.ZoneBounds(); start.IsZero() && end.IsZero() {
+		step = 24 * time.Hour
+	}
+	return phase%size == 0 && step%size == 0
+}
+
+// unitDuration returns the length of a sub-day granularity.
+func unitDuration(offset int, unit Unit) time.Duration {
+	switch unit {
+	case UnitSecond:
+		return time.Duration(offset) * time.Second
+	case UnitMinute:
+		return time.Duration(offset) * time.Minute
+	default:
+		return time.Duration(offset) * time.Hour
+	}
+}
+
+func floorDiv(a, b int) int {
+	return (a - mod(a, b)) / b
+}
@@ -0,0 +1,167 @@
+package triflestats
+
+import (
+	"testing"
+	"time"
+)
+
+func newEpochConfig(zone string) *Config {
+	cfg := DefaultConfig()
+	cfg.TimeZone = zone
+	cfg.Alignment = AlignEpoch
+	return cfg
+}
+
+func TestNocturnalEpochAlignedSubDay(t *testing.T) {
+	cfg := newEpochConfig("UTC")
+	size := int64(7 * 60 * 60)
+
+	timeline := Timeline(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 4, 0, 0, 0, 0, time.UTC), 7, UnitHour, cfg)
+	for idx, start := range timeline {
+		if start.Unix()%size != 0 {
+			t.Fatalf("bucket %v is not aligned to the epoch", start)
+		}
+		if idx > 0 && start.Sub(timeline[idx-1]) != 7*time.Hour {
+			t.Fatalf("bucket %v does not last 7h", timeline[idx-1])
+		}
+	}
+
+	before := time.Date(1969, 12, 31, 20, 0, 0, 0, time.UTC)
+	if got := NewNocturnal(before, cfg).Floor(7, UnitHour); !got.Equal(time.Date(1969, 12, 31, 17, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected floor before the anchor: %v", got)
+	}
+}
+
+func TestNocturnalEpochAlignedDaysAcrossNewYear(t *testing.T) {
+	cfg := newEpochConfig("UTC")
+	timeline := Timeline(time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), 10, UnitDay, cfg)
+	for idx, start := range timeline {
+		if days := start.Unix() / 86400; days%10 != 0 {
+			t.Fatalf("bucket %v is not aligned to the epoch", start)
+		}
+		if idx > 0 && start.Sub(timeline[idx-1]) != 10*24*time.Hour {
+			t.Fatalf("bucket %v does not last 10 days", timeline[idx-1])
+		}
+	}
+
+	months := Timeline(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), 5, UnitMonth, cfg)
+	for _, start := range months {
+		if count := (start.Year()-1970)*12 + int(start.Month()) - 1; count%5 != 0 || start.Day() != 1 {
+			t.Fatalf("month bucket %v is not aligned to the epoch", start)
+		}
+	}
+}
+
+func TestNocturnalEpochAlignedWeeks(t *testing.T) {
+	cfg := newEpochConfig("UTC")
+	at := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	if got := NewNocturnal(at, cfg).Floor(1, UnitWeek); !got.Equal(time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected week to start on Monday, got %v", got)
+	}
+
+	cfg.AlignmentAnchor = time.Date(2025, 1, 1, 6, 0, 0, 0, time.UTC)
+	if got := NewNocturnal(at, cfg).Floor(1, UnitWeek); !got.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected week to start on the anchor's Wednesday, got %v", got)
+	}
+	if got := NewNocturnal(time.Date(2025, 3, 1, 5, 0, 0, 0, time.UTC), cfg).Floor(6, UnitHour); !got.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected 6h buckets aligned to the anchor, got %v", got)
+	}
+}
+
+func TestNocturnalEpochAlignedAcrossDST(t *testing.T) {
+	cfg := newEpochConfig("America/New_York")
+	loc := cfg.Location()
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, loc)
+	to := time.Date(2026, 1, 1, 0, 0, 0, 0, loc)
+
+	for _, granularity := range []string{"7h", "10d", "3w", "5mo", "2q", "3y", "1fq"} {
+		parser := NewParser(granularity)
+		timeline := Timeline(from, to, parser.Offset, parser.Unit, cfg)
+		for idx := 1; idx < len(timeline); idx++ {
+			previous, start := timeline[idx-1], timeline[idx]
+			if got := NewNocturnal(start.Add(-time.Nanosecond), cfg).Floor(parser.Offset, parser.Unit); !got.Equal(previous) {
+				t.Fatalf("%s: instant before %v floors to %v", granularity, start, got)
+			}
+			switch parser.Unit {
+			case UnitHour:
+				if start.Sub(previous) != 7*time.Hour {
+					t.Fatalf("%s: bucket %v lasts %v", granularity, previous, start.Sub(previous))
+				}
+			case UnitDay, UnitWeek:
+				days := 10
+				if parser.Unit == UnitWeek {
+					days = 21
+				}
+				if local := start.In(loc); local.Hour() != 0 || !previous.In(loc).AddDate(0, 0, days).Equal(local) {
+					t.Fatalf("%s: bucket %v does not last %d local days", granularity, previous, days)
+				}
+			}
+		}
+	}
+}
+
+func TestGranularityNestsEpochAligned(t *testing.T) {
+	cfg := newEpochConfig("UTC")
+	cases := []struct {
+		source, target string
+		nests          bool
+	}{
+		{"15m", "1h", true},
+		{"7m", "1h", false},
+		{"1h", "7h", true},
+		{"1h", "1d", true},
+		{"7h", "1d", false},
+		{"1d", "10d", true},
+		{"1d", "1mo", true},
+		{"2d", "1w", false},
+		{"1w", "1y", false},
+		{"1mo", "5mo", true},
+		{"1mo", "1y", true},
+		{"1q", "1y", false},
+		{"1fq", "1fy", true},
+	}
+	for _, tc := range cases {
+		if got := granularityNests(cfg, NewParser(tc.source), NewParser(tc.target)); got != tc.nests {
+			t.Fatalf("granularityNests(%s, %s) = %v, want %v", tc.source, tc.target, got, tc.nests)
+		}
+	}
+
+	// Day starts in zones with DST only keep to a 15 minute grid.
+	cfg.TimeZone = "America/New_York"
+	if granularityNests(cfg, NewParser("1h"), NewParser("1d")) || !granularityNests(cfg, NewParser("5m"), NewParser("1d")) {
+		t.Fatalf("expected only sub-quarter-hour sources to nest in days with DST")
+	}
+	cfg.AlignmentAnchor = time.Date(2025, 1, 1, 0, 7, 0, 0, time.UTC)
+	if granularityNests(cfg, NewParser("5m"), NewParser("1d")) {
+		t.Fatalf("expected an off-grid anchor to prevent nesting in days")
+	}
+}
+
+func TestValuesRollupEpochAligned(t *testing.T) {
+	cfg := newRollupConfig("1h")
+	cfg.Alignment = AlignEpoch
+	start := time.Date(2025, 1, 15, 0, 30, 0, 0, time.UTC)
+	for hour := 0; hour < 24; hour++ {
+		if err := Track(cfg, "orders", start.Add(time.Duration(hour)*time.Hour), map[string]any{"count": 1}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+	}
+
+	from := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 15, 23, 0, 0, 0, time.UTC)
+	result, err := Values(cfg, "orders", from, to, "7h", false, Rollup(RollupSum))
+	if err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	// Epoch-aligned 7h buckets on 2025-01-15 start at 03:00, 10:00, 17:00 and
+	// the previous day's 20:00.
+	expected := []float64{3, 7, 7, 7}
+	if len(result.Values) != len(expected) || !result.At[0].Equal(time.Date(2025, 1, 14, 20, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected rollup timeline: %+v", result.At)
+	}
+	for idx, count := range expected {
+		if result.Values[idx]["count"] != count {
+			t.Fatalf("bucket %v: expected %v, got %+v", result.At[idx], count, result.Values[idx])
+		}
+	}
+}
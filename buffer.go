@@ -1,11 +1,18 @@
 package triflestats
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"hash/maphash"
 	"reflect"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,12 +20,86 @@ const (
 	defaultBufferSize = 256
 )
 
+// ErrBufferFull is returned when OverflowBlock gives up waiting for space.
+var ErrBufferFull = errors.New("buffer is full")
+
+// DiscardedError reports an action a flush dropped, either because
+// BufferOptions.Retryable rejected its error or because it failed MaxAttempts
+// flushes.
+type DiscardedError struct {
+	Operation string
+	Keys      []Key
+	// Count is the number of operations the action stood for.
+	Count    int64
+	Attempts int
+	Err      error
+}
+
+func (e *DiscardedError) Error() string {
+	return fmt.Sprintf("discarded %s of %d operations after %d attempts: %v", e.Operation, e.Count, e.Attempts, e.Err)
+}
+
+func (e *DiscardedError) Unwrap() error {
+	return e.Err
+}
+
+// OverflowPolicy selects how a buffer at MaxPending handles new operations.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for a flush to make room, up to BlockTimeout.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the incoming operation.
+	OverflowDropNewest
+	// OverflowDropOldest evicts the oldest queued action to make room. With
+	// a journal, evicted actions are not replayed after a crash.
+	OverflowDropOldest
+	// OverflowSpill appends the operation to a journal under SpillDir, written
+	// to the driver after the in-memory queue on every flush.
+	OverflowSpill
+)
+
 // BufferOptions configures buffered write behavior.
 type BufferOptions struct {
 	Duration  time.Duration
 	Size      int
 	Aggregate bool
 	Async     bool
+	// JournalDir enables a write-ahead journal of enqueued operations in this
+	// directory. Operations left by a crashed process are replayed by
+	// NewBuffer. Each buffer needs a directory of its own.
+	JournalDir string
+	// OnError is called when a flush fails, with the number of actions kept
+	// for the next flush. Failed actions are retried instead of dropped
+	// unless Retryable or MaxAttempts discard them, in which case err holds
+	// a *DiscardedError for each.
+	OnError func(err error, actions int)
+	// Retryable opts into discarding actions whose write failed with an error
+	// it returns false for, such as IsRetryable. Nil retries every error.
+	Retryable func(err error) bool
+	// MaxAttempts caps the flushes an action may fail before it is dropped,
+	// so it cannot hold back later actions forever. Zero retries without
+	// limit.
+	MaxAttempts int
+	// MaxPending caps queued actions, counting an aggregated action once no
+	// matter how many operations it merges. Zero leaves the queue unbounded.
+	MaxPending int
+	// Overflow selects what happens to operations arriving at a full queue.
+	Overflow OverflowPolicy
+	// BlockTimeout bounds how long OverflowBlock waits. Zero waits until a
+	// flush makes room.
+	BlockTimeout time.Duration
+	// SpillDir holds operations spilled by OverflowSpill and those
+	// ShutdownContext could not write in time. They are written after the
+	// in-memory queue on every flush, including after a restart.
+	SpillDir string
+	// Shards splits the queue by action signature so concurrent writers do
+	// not contend on one lock. Zero uses GOMAXPROCS.
+	Shards int
+	// FlushConcurrency dispatches a flush across this many workers. Actions
+	// for the same metric always share a worker, so they keep their order.
+	// Zero or one writes sequentially.
+	FlushConcurrency int
 }
 
 type bufferedAction struct {
@@ -26,26 +107,95 @@ type bufferedAction struct {
 	keys      []Key
 	values    map[string]any
 	count     int64
+	seq       uint64
+	attempts  int
+}
+
+// bufferShard queues the actions whose signatures hash to it, oldest first.
+// byKeys lists the aggregated signatures on the same data keys.
+type bufferShard struct {
+	mu     sync.Mutex
+	bySig  map[string]*bufferedAction
+	byKeys map[string][]string
+	order  []string
+	linear []bufferedAction
+}
+
+func (s *bufferShard) resetLocked() {
+	s.bySig = map[string]*bufferedAction{}
+	s.byKeys = map[string][]string{}
+	s.order = nil
+	s.linear = nil
+}
+
+func (s *bufferShard) addLocked(sig string, action *bufferedAction) {
+	s.bySig[sig] = action
+	s.order = append(s.order, sig)
+	keys := keysOfSignature(sig)
+	s.byKeys[keys] = append(s.byKeys[keys], sig)
+}
+
+func (s *bufferShard) removeLocked(sig string) {
+	delete(s.bySig, sig)
+	s.order = slices.DeleteFunc(s.order, func(queued string) bool {
+		return queued == sig
+	})
+	keys := keysOfSignature(sig)
+	if related := slices.DeleteFunc(s.byKeys[keys], func(queued string) bool {
+		return queued == sig
+	}); len(related) > 0 {
+		s.byKeys[keys] = related
+	} else {
+		delete(s.byKeys, keys)
+	}
 }
 
 // Buffer batches write operations and flushes them by size and/or time.
 type Buffer struct {
 	driver      WriteStorage
 	countDriver CountDriver
+	batchDriver BatchDriver
+
+	duration   time.Duration
+	size       int
+	aggregate  bool
+	async      bool
+	background bool
 
-	duration  time.Duration
-	size      int
-	aggregate bool
-	async     bool
+	journalDir  string
+	journal     *bufferJournal
+	journalErr  error
+	onError     func(err error, actions int)
+	retryableFn func(err error) bool
 
-	mu             sync.Mutex
-	actionsBySig   map[string]*bufferedAction
-	actionsLinear  []bufferedAction
-	operationCount int
-	closed         bool
+	flushConcurrency int
+	maxAttempts      int
 
-	stopCh chan struct{}
-	wg     sync.WaitGroup
+	maxPending   int
+	overflow     OverflowPolicy
+	blockTimeout time.Duration
+	spillDir     string
+	spill        *bufferJournal
+	spillErr     error
+	dropped      atomic.Int64
+	spilled      atomic.Int64
+	stats        bufferStats
+
+	shards         []*bufferShard
+	seed           maphash.Seed
+	seq            atomic.Uint64
+	operationCount atomic.Int64
+	actionCount    atomic.Int64
+	closed         atomic.Bool
+
+	spaceMu sync.Mutex
+	space   chan struct{}
+
+	mu           sync.Mutex
+	stopCh       chan struct{}
+	cancelWorker context.CancelFunc
+	flushCh      chan struct{}
+	wg           sync.WaitGroup
 }
 
 // NewBuffer creates a write buffer for a driver.
@@ -54,22 +204,64 @@ func NewBuffer(driver WriteStorage, opts BufferOptions) *Buffer {
 	size := normalizeBufferSize(opts.Size)
 	countDriver, countAware := driver.(CountDriver)
 	aggregate := opts.Aggregate && countAware
+	batchDriver, _ := driver.(BatchDriver)
 
 	b := &Buffer{
 		driver:      driver,
 		countDriver: countDriver,
+		batchDriver: batchDriver,
 		duration:    duration,
 		size:        size,
 		aggregate:   aggregate,
 		async:       opts.Async,
+		background:  opts.Async && duration > 0,
+		journalDir:  opts.JournalDir,
+		onError:     opts.OnError,
+		retryableFn: opts.Retryable,
+
+		flushConcurrency: normalizeFlushConcurrency(opts.FlushConcurrency),
+		maxAttempts:      normalizeMaxAttempts(opts.MaxAttempts),
+		maxPending:       normalizeMaxPending(opts.MaxPending),
+		overflow:         opts.Overflow,
+		blockTimeout:     opts.BlockTimeout,
+		spillDir:         opts.SpillDir,
+		shards:           newBufferShards(normalizeBufferShards(opts.Shards)),
+		seed:             maphash.MakeSeed(),
+		space:            make(chan struct{}),
 	}
-	b.resetQueueLocked()
-	if b.async && b.duration > 0 {
+	if b.journalDir != "" {
+		journal, records, err := openBufferJournal(b.journalDir)
+		b.journal, b.journalErr = journal, err
+		for _, record := range records {
+			if record.Evicted {
+				b.forgetAction(record)
+				continue
+			}
+			b.restoreAction(record)
+		}
+	}
+	if b.spillDir != "" {
+		// Operations spilled before a restart stay in the spill journal and
+		// reach the driver with the next flush.
+		b.spill, _, b.spillErr = openBufferJournal(b.spillDir)
+	} else if b.maxPending > 0 && b.overflow == OverflowSpill {
+		b.spillErr = fmt.Errorf("buffer spill directory required")
+	}
+	if b.background {
 		b.startWorker()
 	}
 	return b
 }
 
+func newBufferShards(count int) []*bufferShard {
+	shards := make([]*bufferShard, count)
+	for idx := range shards {
+		shards[idx] = &bufferShard{}
+		shards[idx].resetLocked()
+	}
+	return shards
+}
+
 // Inc enqueues an increment operation.
 func (b *Buffer) Inc(keys []Key, values map[string]any) error {
 	return b.enqueue("inc", keys, values)
@@ -80,132 +272,858 @@ func (b *Buffer) Set(keys []Key, values map[string]any) error {
 	return b.enqueue("set", keys, values)
 }
 
-// Flush drains queued operations and writes them to the driver.
+// Dropped returns the number of operations discarded because the buffer was
+// full, including OverflowBlock timeouts.
+func (b *Buffer) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Spilled returns the number of operations written to the spill journal.
+func (b *Buffer) Spilled() int64 {
+	return b.spilled.Load()
+}
+
+// Flush drains queued operations and writes them to the driver, followed by
+// any spilled operations. With a journal, operations are only removed from
+// disk once all of them are written or discarded.
 func (b *Buffer) Flush() error {
-	actions := b.drainActions()
-	if len(actions) == 0 {
-		return nil
+	return b.FlushContext(context.Background())
+}
+
+// FlushContext is Flush with a context. Once ctx is done, actions not yet
+// written stay queued and the context error is returned.
+func (b *Buffer) FlushContext(ctx context.Context) error {
+	ctx = ensureContext(ctx)
+	start := time.Now()
+	attempted, err := b.flush(ctx)
+	if attempted > 0 || err != nil {
+		b.stats.recordFlush(time.Since(start), err)
 	}
-	for _, action := range actions {
-		if err := b.dispatchAction(action); err != nil {
-			return err
+	return err
+}
+
+func (b *Buffer) flush(ctx context.Context) (int, error) {
+	actions, segments, err := b.drainActions()
+	if err != nil {
+		return 0, err
+	}
+	remaining, err := b.dispatchActions(ctx, actions)
+	if err != nil && b.onError != nil {
+		b.onError(err, len(remaining))
+	}
+	if len(remaining) > 0 {
+		b.retainActions(remaining, segments)
+		return len(actions), err
+	}
+	// Every action was written or discarded, so none is left to replay.
+	if b.journal != nil {
+		if releaseErr := b.journal.release(segments); releaseErr != nil {
+			return len(actions), errors.Join(err, releaseErr)
 		}
 	}
-	return nil
+	if b.spill != nil {
+		spilled, spillErr := b.flushSpill(ctx)
+		return len(actions) + spilled, errors.Join(err, spillErr)
+	}
+	return len(actions), err
 }
 
 // Shutdown stops the worker and flushes outstanding operations.
 func (b *Buffer) Shutdown() error {
+	_, err := b.ShutdownContext(context.Background())
+	return err
+}
+
+func (b *Buffer) enqueue(operation string, keys []Key, values map[string]any) error {
 	if b == nil {
+		return fmt.Errorf("buffer is nil")
+	}
+	if len(keys) == 0 || len(values) == 0 {
 		return nil
 	}
+	if b.journalErr != nil {
+		return b.journalErr
+	}
+	if b.aggregate {
+		values = packedValues(values)
+	}
+	if operation == "inc" {
+		// Drivers reject these on every flush, so they would never be written.
+		if err := requireNumeric(values); err != nil {
+			return err
+		}
+	}
 
-	b.mu.Lock()
-	if b.closed {
-		b.mu.Unlock()
-		return nil
+	sig := signatureFor(operation, keys)
+	shard := b.shardFor(sig)
+	var deadline <-chan time.Time
+	var creates bool
+	for {
+		shard.mu.Lock()
+		if b.closed.Load() {
+			shard.mu.Unlock()
+			return fmt.Errorf("buffer is closed")
+		}
+		creates = b.createsActionLocked(shard, sig, operation, values)
+		if b.admitLocked(creates) {
+			break
+		}
+		shard.mu.Unlock()
+
+		switch b.overflow {
+		case OverflowDropNewest:
+			b.dropped.Add(1)
+			return nil
+		case OverflowDropOldest:
+			if err := b.evictOldest(); err != nil {
+				return err
+			}
+		case OverflowSpill:
+			return b.spillOperation(operation, keys, values)
+		default:
+			if deadline == nil && b.blockTimeout > 0 {
+				timer := time.NewTimer(b.blockTimeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+			if err := b.waitForRoom(deadline); err != nil {
+				if errors.Is(err, ErrBufferFull) {
+					b.dropped.Add(1)
+				}
+				return err
+			}
+		}
+	}
+
+	if b.journal != nil {
+		if err := b.journal.append(operation, keys, values, 1); err != nil {
+			if creates {
+				b.actionCount.Add(-1)
+			}
+			shard.mu.Unlock()
+			return err
+		}
 	}
-	b.closed = true
-	stopCh := b.stopCh
-	b.stopCh = nil
-	b.mu.Unlock()
+	b.storeActionLocked(shard, sig, operation, keys, values, 1)
+	shard.mu.Unlock()
+	b.stats.recordEnqueue()
 
-	if stopCh != nil {
-		close(stopCh)
-		b.wg.Wait()
+	if b.operationCount.Load() < int64(b.size) {
+		return nil
+	}
+	// Hand full batches to the worker so callers never wait on the driver.
+	if b.background {
+		b.signalFlush()
+		return nil
 	}
 	return b.Flush()
 }
 
-func (b *Buffer) enqueue(operation string, keys []Key, values map[string]any) error {
-	if b == nil {
-		return fmt.Errorf("buffer is nil")
+// shardFor picks a shard from the data keys of sig, so sets and incs on the
+// same keys always share a shard whatever their tracking keys.
+func (b *Buffer) shardFor(sig string) *bufferShard {
+	if len(b.shards) == 1 {
+		return b.shards[0]
 	}
-	if len(keys) == 0 || len(values) == 0 {
-		return nil
+	return b.shards[maphash.String(b.seed, keysOfSignature(sig))%uint64(len(b.shards))]
+}
+
+func (b *Buffer) lockShards() {
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+	}
+}
+
+func (b *Buffer) unlockShards() {
+	for _, shard := range b.shards {
+		shard.mu.Unlock()
 	}
+}
 
-	shouldFlush := false
-	b.mu.Lock()
-	if b.closed {
-		b.mu.Unlock()
-		return fmt.Errorf("buffer is closed")
+// admitLocked reserves room for a new action, respecting MaxPending.
+func (b *Buffer) admitLocked(creates bool) bool {
+	if !creates {
+		return true
+	}
+	for {
+		current := b.actionCount.Load()
+		if b.maxPending > 0 && current >= int64(b.maxPending) {
+			return false
+		}
+		if b.actionCount.CompareAndSwap(current, current+1) {
+			return true
+		}
 	}
-	b.storeActionLocked(operation, keys, values)
-	shouldFlush = b.operationCount >= b.size
-	b.mu.Unlock()
+}
 
-	if shouldFlush {
+// createsActionLocked reports whether storing the operation adds an action
+// rather than merging into queued ones.
+func (b *Buffer) createsActionLocked(shard *bufferShard, sig, operation string, values map[string]any) bool {
+	if !b.aggregate {
+		return true
+	}
+	if _, ok := shard.bySig[sig]; ok {
+		return false
+	}
+	if operation != "inc" {
+		return true
+	}
+	set, _ := shard.counterpartLocked(sig, operation)
+	if set == nil {
+		return true
+	}
+	for field, value := range values {
+		if !foldsInto(set, field, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreAction queues a journaled action without overflow checks.
+func (b *Buffer) restoreAction(record journalRecord) {
+	values := record.Values
+	if b.aggregate {
+		values = packedValues(values)
+	}
+	sig := signatureFor(record.Operation, record.keys())
+	shard := b.shardFor(sig)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if b.createsActionLocked(shard, sig, record.Operation, values) {
+		b.actionCount.Add(1)
+	}
+	b.storeActionLocked(shard, sig, record.Operation, record.keys(), values, record.count())
+	b.carryAttemptsLocked(shard, sig, record.Attempts)
+}
+
+// carryAttemptsLocked keeps the failed attempts of a retained action on the
+// queued action it was stored into.
+func (b *Buffer) carryAttemptsLocked(shard *bufferShard, sig string, attempts int) {
+	if attempts == 0 {
+		return
+	}
+	if !b.aggregate {
+		last := &shard.linear[len(shard.linear)-1]
+		last.attempts = max(last.attempts, attempts)
+		return
+	}
+	if action, ok := shard.bySig[sig]; ok {
+		action.attempts = max(action.attempts, attempts)
+	}
+}
+
+func (b *Buffer) spillOperation(operation string, keys []Key, values map[string]any) error {
+	if b.spillErr != nil {
+		return b.spillErr
+	}
+	if err := b.spill.append(operation, keys, values, 1); err != nil {
+		return err
+	}
+	b.spilled.Add(1)
+	b.stats.recordEnqueue()
+	return nil
+}
+
+// waitForRoom blocks until a flush frees space. Without a worker the caller
+// flushes itself.
+func (b *Buffer) waitForRoom(deadline <-chan time.Time) error {
+	if !b.background {
 		return b.Flush()
 	}
+
+	b.spaceMu.Lock()
+	space := b.space
+	b.spaceMu.Unlock()
+	if b.actionCount.Load() < int64(b.maxPending) {
+		return nil
+	}
+	b.signalFlush()
+	select {
+	case <-space:
+		return nil
+	case <-deadline:
+		return ErrBufferFull
+	}
+}
+
+func (b *Buffer) signalSpace() {
+	b.spaceMu.Lock()
+	close(b.space)
+	b.space = make(chan struct{})
+	b.spaceMu.Unlock()
+}
+
+// evictOldest drops the action enqueued first across all shards. With a
+// journal the eviction is recorded first, so a replay after a crash does not
+// bring the action back.
+func (b *Buffer) evictOldest() error {
+	var oldest *bufferShard
+	var oldestSeq uint64
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		seq, ok := b.headLocked(shard)
+		shard.mu.Unlock()
+		if ok && (oldest == nil || seq < oldestSeq) {
+			oldest, oldestSeq = shard, seq
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+
+	oldest.mu.Lock()
+	defer oldest.mu.Unlock()
+	if seq, ok := b.headLocked(oldest); !ok || seq != oldestSeq {
+		return nil
+	}
+	var evicted bufferedAction
+	if b.aggregate {
+		evicted = *oldest.bySig[oldest.order[0]]
+	} else {
+		evicted = oldest.linear[0]
+	}
+	if b.journal != nil {
+		if err := b.journal.evict(evicted.operation, evicted.keys, evicted.count); err != nil {
+			return err
+		}
+	}
+	if b.aggregate {
+		oldest.removeLocked(oldest.order[0])
+	} else {
+		oldest.linear = oldest.linear[1:]
+	}
+	b.operationCount.Add(-evicted.count)
+	b.actionCount.Add(-1)
+	b.dropped.Add(evicted.count)
 	return nil
 }
 
-func (b *Buffer) storeActionLocked(operation string, keys []Key, values map[string]any) {
+// forgetAction removes the replayed action a journaled eviction dropped, the
+// oldest one with its signature.
+func (b *Buffer) forgetAction(record journalRecord) {
+	sig := signatureFor(record.Operation, record.keys())
+	shard := b.shardFor(sig)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var count int64
 	if b.aggregate {
-		sig := signatureFor(operation, keys)
-		if existing, ok := b.actionsBySig[sig]; ok {
-			switch operation {
-			case "inc":
-				existing.values = mergeIncrement(existing.values, values)
-			case "set":
-				existing.values = cloneMap(values)
-			}
-			existing.count++
-			b.operationCount++
+		action, ok := shard.bySig[sig]
+		if !ok {
+			return
+		}
+		count = action.count
+		shard.removeLocked(sig)
+	} else {
+		idx := slices.IndexFunc(shard.linear, func(action bufferedAction) bool {
+			return signatureFor(action.operation, action.keys) == sig
+		})
+		if idx < 0 {
 			return
 		}
+		count = shard.linear[idx].count
+		shard.linear = slices.Delete(shard.linear, idx, idx+1)
+	}
+	b.operationCount.Add(-count)
+	b.actionCount.Add(-1)
+}
 
-		b.actionsBySig[sig] = &bufferedAction{
+func (b *Buffer) headLocked(shard *bufferShard) (uint64, bool) {
+	if b.aggregate {
+		if len(shard.order) == 0 {
+			return 0, false
+		}
+		return shard.bySig[shard.order[0]].seq, true
+	}
+	if len(shard.linear) == 0 {
+		return 0, false
+	}
+	return shard.linear[0].seq, true
+}
+
+// storeActionLocked queues count operations. Aggregated values are packed,
+// and queued sets and incs on the same data keys can be written in any order
+// with the result of the unbuffered operations: a set removes the fields it
+// overwrites from incs and copies them into other sets, and an inc adds to
+// fields sets already hold. Actions under another tracking key keep their
+// fields, zeroed in incs, so each tracking key keeps its own count.
+func (b *Buffer) storeActionLocked(shard *bufferShard, sig, operation string, keys []Key, values map[string]any, count int64) {
+	b.operationCount.Add(count)
+	if !b.aggregate {
+		shard.linear = append(shard.linear, bufferedAction{
 			operation: operation,
 			keys:      cloneKeys(keys),
 			values:    cloneMap(values),
-			count:     1,
+			count:     count,
+			seq:       b.seq.Add(1),
+		})
+		return
+	}
+
+	switch operation {
+	case "set":
+		count += b.overrideIncrementLocked(shard, sig, values)
+	case "inc":
+		if values = b.foldIncrementLocked(shard, sig, values, count); len(values) == 0 {
+			return
+		}
+	}
+	if existing, ok := shard.bySig[sig]; ok {
+		switch operation {
+		case "inc":
+			existing.values = mergeIncrement(existing.values, values)
+		case "set":
+			for field, value := range values {
+				existing.values[field] = cloneValue(value)
+			}
 		}
-		b.operationCount++
+		existing.count += count
 		return
 	}
 
-	b.actionsLinear = append(b.actionsLinear, bufferedAction{
+	shard.addLocked(sig, &bufferedAction{
 		operation: operation,
 		keys:      cloneKeys(keys),
 		values:    cloneMap(values),
-		count:     1,
+		count:     count,
+		seq:       b.seq.Add(1),
 	})
-	b.operationCount++
 }
 
-func (b *Buffer) drainActions() []bufferedAction {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	if b.operationCount == 0 {
-		return nil
+// overrideIncrementLocked applies a set to the queued actions on the same data
+// keys. The inc under the same tracking key loses the overwritten fields, and
+// when left empty it is removed and its count returned for the set to carry.
+func (b *Buffer) overrideIncrementLocked(shard *bufferShard, sig string, values map[string]any) int64 {
+	for _, inc := range shard.relatedLocked(sig, "inc") {
+		for field := range values {
+			if _, ok := inc.values[field]; ok {
+				inc.values[field] = 0
+			}
+		}
+	}
+	for _, set := range shard.relatedLocked(sig, "set") {
+		for field, value := range values {
+			if _, ok := set.values[field]; ok {
+				set.values[field] = cloneValue(value)
+			}
+		}
 	}
 
-	var actions []bufferedAction
-	if b.aggregate {
-		actions = make([]bufferedAction, 0, len(b.actionsBySig))
-		for _, action := range b.actionsBySig {
-			actions = append(actions, *action)
+	inc, incSig := shard.counterpartLocked(sig, "set")
+	if inc == nil {
+		return 0
+	}
+	for field := range values {
+		delete(inc.values, field)
+	}
+	if len(inc.values) > 0 {
+		return 0
+	}
+	shard.removeLocked(incSig)
+	b.actionCount.Add(-1)
+	return inc.count
+}
+
+// foldIncrementLocked adds increments to fields held by queued sets on the
+// same data keys and returns the fields left for the inc. Fields held only by
+// sets under another tracking key stay in it as zeros. When nothing remains
+// the set under the same tracking key carries the count.
+func (b *Buffer) foldIncrementLocked(shard *bufferShard, sig string, values map[string]any, count int64) map[string]any {
+	set, _ := shard.counterpartLocked(sig, "inc")
+	related := shard.relatedLocked(sig, "set")
+	if set == nil && len(related) == 0 {
+		return values
+	}
+	rest := map[string]any{}
+	for field, value := range values {
+		folded := false
+		for _, other := range related {
+			if foldsInto(other, field, value) {
+				addToField(other, field, value)
+				folded = true
+			}
+		}
+		switch {
+		case set != nil && foldsInto(set, field, value):
+			addToField(set, field, value)
+		case folded:
+			rest[field] = 0
+		default:
+			rest[field] = value
 		}
-	} else {
-		actions = append([]bufferedAction(nil), b.actionsLinear...)
 	}
-	b.resetQueueLocked()
+	if len(rest) == 0 && set != nil {
+		set.count += count
+	}
+	return rest
+}
+
+func addToField(set *bufferedAction, field string, value any) {
+	delta, _ := toFloat(value)
+	base, _ := toFloat(set.values[field])
+	set.values[field] = base + delta
+}
+
+// counterpartLocked returns the queued action of the other operation on the
+// keys and tracking keys of sig, along with its signature.
+func (s *bufferShard) counterpartLocked(sig, operation string) (*bufferedAction, string) {
+	other := "set"
+	if operation == "set" {
+		other = "inc"
+	}
+	var scratch [256]byte
+	lookup := append(append(scratch[:0], other...), sig[len(operation):]...)
+	action, ok := s.bySig[string(lookup)]
+	if !ok {
+		return nil, ""
+	}
+	return action, other + sig[len(operation):]
+}
+
+// relatedLocked returns the queued actions of operation on the data keys of
+// sig under other tracking keys.
+func (s *bufferShard) relatedLocked(sig, operation string) []*bufferedAction {
+	var related []*bufferedAction
+	tracking := trackingOfSignature(sig)
+	for _, queued := range s.byKeys[keysOfSignature(sig)] {
+		if !strings.HasPrefix(queued, operation+"\x1e") || trackingOfSignature(queued) == tracking {
+			continue
+		}
+		related = append(related, s.bySig[queued])
+	}
+	return related
+}
+
+// foldsInto reports whether an increment of field can be applied to set.
+func foldsInto(set *bufferedAction, field string, value any) bool {
+	if _, ok := set.values[field]; !ok {
+		return false
+	}
+	_, ok := toFloat(value)
+	return ok
+}
+
+func (b *Buffer) drainActions() ([]bufferedAction, []string, error) {
+	b.lockShards()
+	defer b.unlockShards()
+	if b.operationCount.Load() == 0 {
+		return nil, nil, nil
+	}
+
+	var segments []string
+	if b.journal != nil {
+		rotated, err := b.journal.rotate()
+		if err != nil {
+			return nil, nil, err
+		}
+		segments = rotated
+	}
+
+	actions := b.queuedActionsLocked()
+	for _, shard := range b.shards {
+		shard.resetLocked()
+	}
+	b.operationCount.Store(0)
+	b.actionCount.Store(0)
+	b.signalSpace()
+	return actions, segments, nil
+}
+
+// queuedActionsLocked merges the shards back into enqueue order.
+func (b *Buffer) queuedActionsLocked() []bufferedAction {
+	actions := make([]bufferedAction, 0, b.actionCount.Load())
+	for _, shard := range b.shards {
+		if !b.aggregate {
+			actions = append(actions, shard.linear...)
+			continue
+		}
+		for _, sig := range shard.order {
+			actions = append(actions, *shard.bySig[sig])
+		}
+	}
+	if len(b.shards) > 1 {
+		slices.SortFunc(actions, func(a, c bufferedAction) int {
+			return cmp.Compare(a.seq, c.seq)
+		})
+	}
 	return actions
 }
 
-func (b *Buffer) resetQueueLocked() {
-	b.actionsBySig = map[string]*bufferedAction{}
-	b.actionsLinear = []bufferedAction{}
-	b.operationCount = 0
+// retainActions puts actions that failed to flush back ahead of operations
+// enqueued since the drain. Their journal segments stay on disk until a later
+// flush succeeds, so a crash may replay actions that were already written or
+// discarded.
+func (b *Buffer) retainActions(actions []bufferedAction, segments []string) {
+	b.lockShards()
+	defer b.unlockShards()
+	if b.journal != nil {
+		b.journal.retain(segments)
+	}
+
+	if b.aggregate {
+		// Replay retained actions ahead of the newer ones so merging follows
+		// the order the operations were enqueued in.
+		newer := b.queuedActionsLocked()
+		for _, shard := range b.shards {
+			shard.resetLocked()
+		}
+		b.operationCount.Store(0)
+		b.actionCount.Store(0)
+		for _, action := range slices.Concat(actions, newer) {
+			sig := signatureFor(action.operation, action.keys)
+			shard := b.shardFor(sig)
+			if b.createsActionLocked(shard, sig, action.operation, action.values) {
+				b.actionCount.Add(1)
+			}
+			b.storeActionLocked(shard, sig, action.operation, action.keys, action.values, action.count)
+			b.carryAttemptsLocked(shard, sig, action.attempts)
+		}
+		return
+	}
+
+	linear := map[*bufferShard][]bufferedAction{}
+	for _, action := range actions {
+		shard := b.shardFor(signatureFor(action.operation, action.keys))
+		linear[shard] = append(linear[shard], action)
+		b.operationCount.Add(action.count)
+		b.actionCount.Add(1)
+	}
+	for shard, retained := range linear {
+		shard.linear = append(retained, shard.linear...)
+	}
+}
+
+// flushSpill writes spilled operations to the driver. Actions left unwritten
+// are journaled again with their attempts before the flushed segments are
+// removed.
+func (b *Buffer) flushSpill(ctx context.Context) (int, error) {
+	segments, err := b.spill.rotate()
+	if err != nil || len(segments) == 0 {
+		return 0, err
+	}
+
+	spilled := &Buffer{aggregate: b.aggregate, shards: newBufferShards(1)}
+	for _, segment := range segments {
+		records, err := readJournalSegment(segment)
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			spilled.restoreAction(record)
+		}
+	}
+	actions := spilled.queuedActionsLocked()
+
+	remaining, err := b.dispatchActions(ctx, actions)
+	if err != nil && b.onError != nil {
+		b.onError(err, len(remaining))
+	}
+	if requeueErr := b.spill.requeue(remaining); requeueErr != nil {
+		b.spill.retain(segments)
+		return len(actions), errors.Join(err, requeueErr)
+	}
+	return len(actions), errors.Join(err, b.spill.release(segments))
 }
 
-func (b *Buffer) dispatchAction(action bufferedAction) error {
+// dispatchActions writes actions to the driver and returns the ones left
+// unwritten by a failure, in their original order. With FlushConcurrency,
+// actions are partitioned by metric and each partition is written by its own
+// worker, which stops at its first error.
+func (b *Buffer) dispatchActions(ctx context.Context, actions []bufferedAction) ([]bufferedAction, error) {
+	if b.flushConcurrency <= 1 || len(actions) <= 1 {
+		return b.dispatchPartition(ctx, actions)
+	}
+
+	partitions := make([][]bufferedAction, b.flushConcurrency)
+	for _, action := range actions {
+		idx := b.partitionFor(action)
+		partitions[idx] = append(partitions[idx], action)
+	}
+
+	remaining := make([][]bufferedAction, len(partitions))
+	errs := make([]error, len(partitions))
+	var wg sync.WaitGroup
+	for idx, partition := range partitions {
+		if len(partition) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remaining[idx], errs[idx] = b.dispatchPartition(ctx, partition)
+		}()
+	}
+	wg.Wait()
+
+	err := errors.Join(errs...)
+	if err == nil {
+		return nil, nil
+	}
+	unwritten := []bufferedAction{}
+	for _, partition := range remaining {
+		unwritten = append(unwritten, partition...)
+	}
+	slices.SortStableFunc(unwritten, func(a, c bufferedAction) int {
+		return cmp.Compare(a.seq, c.seq)
+	})
+	return unwritten, err
+}
+
+// dispatchPartition writes actions in order, as a single batch when the driver
+// implements BatchDriver. A failed batch leaves all of its actions unwritten
+// unless the driver reports which ones it wrote with a BatchError. A batch
+// rejected with a permanent error is retried action by action to find the
+// actions to discard.
+func (b *Buffer) dispatchPartition(ctx context.Context, actions []bufferedAction) ([]bufferedAction, error) {
+	if b.batchDriver == nil {
+		return b.dispatchSequential(ctx, actions)
+	}
+	if err := ctx.Err(); err != nil {
+		return actions, err
+	}
+	operations := make([]BatchOperation, len(actions))
+	for idx, action := range actions {
+		operations[idx] = BatchOperation{
+			Operation: action.operation,
+			Keys:      action.keys,
+			Values:    b.driverValues(action),
+			Count:     max(action.count, 1),
+		}
+	}
+	err := b.batchDriver.WriteBatch(ctx, operations)
+	if err == nil {
+		for _, action := range actions {
+			b.stats.recordDispatch(action)
+		}
+		return nil, nil
+	}
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Errs) == len(actions) {
+		unwritten := []bufferedAction{}
+		var retryErr error
+		var discarded []error
+		for idx, action := range actions {
+			opErr := batchErr.Errs[idx]
+			switch {
+			case opErr == nil:
+				b.stats.recordDispatch(action)
+			case errors.Is(opErr, ErrBatchAborted):
+				unwritten = append(unwritten, action)
+			default:
+				failed, keep, failErr := b.failAction(ctx, action, opErr)
+				if !keep {
+					discarded = append(discarded, failErr)
+					continue
+				}
+				unwritten = append(unwritten, failed)
+				if retryErr == nil {
+					retryErr = failErr
+				}
+			}
+		}
+		return unwritten, errors.Join(append(discarded, retryErr)...)
+	}
+	if !b.retryable(ctx, err) {
+		// The batch wrote nothing, so each action can be written on its own.
+		return b.dispatchSequential(ctx, actions)
+	}
+
+	unwritten := []bufferedAction{}
+	var discarded []error
+	for _, action := range actions {
+		failed, keep, failErr := b.failAction(ctx, action, err)
+		if !keep {
+			discarded = append(discarded, failErr)
+			continue
+		}
+		unwritten = append(unwritten, failed)
+	}
+	return unwritten, errors.Join(append(discarded, err)...)
+}
+
+// dispatchSequential writes actions one at a time and stops at the first one
+// kept for a retry, leaving it and the rest unwritten.
+func (b *Buffer) dispatchSequential(ctx context.Context, actions []bufferedAction) ([]bufferedAction, error) {
+	var discarded []error
+	for idx, action := range actions {
+		err := b.dispatchAction(ctx, action)
+		if err == nil {
+			b.stats.recordDispatch(action)
+			continue
+		}
+		failed, keep, failErr := b.failAction(ctx, action, err)
+		if !keep {
+			discarded = append(discarded, failErr)
+			continue
+		}
+		unwritten := append([]bufferedAction{failed}, actions[idx+1:]...)
+		return unwritten, errors.Join(append(discarded, failErr)...)
+	}
+	return nil, errors.Join(discarded...)
+}
+
+// failAction counts a failed write of action and reports whether to keep it
+// for the next flush. Discarded actions come back with a *DiscardedError.
+// Writes cut short by ctx or an open circuit are not counted as attempts.
+func (b *Buffer) failAction(ctx context.Context, action bufferedAction, err error) (bufferedAction, bool, error) {
+	if ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return action, true, err
+	}
+	action.attempts++
+	if b.retryable(ctx, err) && (b.maxAttempts == 0 || action.attempts < b.maxAttempts) {
+		return action, true, err
+	}
+	b.stats.recordDiscard(action)
+	return action, false, &DiscardedError{
+		Operation: action.operation,
+		Keys:      cloneKeys(action.keys),
+		Count:     max(action.count, 1),
+		Attempts:  action.attempts,
+		Err:       err,
+	}
+}
+
+// retryable reports whether a failed write may succeed on a later flush.
+func (b *Buffer) retryable(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) || b.retryableFn == nil || b.retryableFn(err)
+}
+
+// partitionFor picks the flush worker for an action from its first key, so
+// every granularity of a metric is written by the same worker.
+func (b *Buffer) partitionFor(action bufferedAction) int {
+	if len(action.keys) == 0 {
+		return 0
+	}
+	key := action.keys[0]
+	var hash maphash.Hash
+	hash.SetSeed(b.seed)
+	_, _ = hash.WriteString(key.Prefix)
+	_ = hash.WriteByte(0x1f)
+	_, _ = hash.WriteString(key.Key)
+	return int(hash.Sum64() % uint64(b.flushConcurrency))
+}
+
+func (b *Buffer) dispatchAction(ctx context.Context, action bufferedAction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if action.count <= 0 {
 		action.count = 1
 	}
+	action.values = b.driverValues(action)
 
+	if counter, ok := b.driver.(ContextCountDriver); ok && b.countDriver != nil {
+		switch action.operation {
+		case "inc":
+			return counter.IncCountContext(ctx, action.keys, action.values, action.count)
+		case "set":
+			return counter.SetCountContext(ctx, action.keys, action.values, action.count)
+		default:
+			return fmt.Errorf("invalid operation: %s", action.operation)
+		}
+	}
 	if b.countDriver != nil {
 		switch action.operation {
 		case "inc":
@@ -217,38 +1135,47 @@ func (b *Buffer) dispatchAction(action bufferedAction) error {
 		}
 	}
 
+	if action.operation != "inc" && action.operation != "set" {
+		return fmt.Errorf("invalid operation: %s", action.operation)
+	}
 	repetitions := int(action.count)
 	for i := 0; i < repetitions; i++ {
-		switch action.operation {
-		case "inc":
-			if err := b.driver.Inc(action.keys, action.values); err != nil {
-				return err
-			}
-		case "set":
-			if err := b.driver.Set(action.keys, action.values); err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("invalid operation: %s", action.operation)
+		if err := writeWithContext(ctx, b.driver, action.operation, action.keys, action.values); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// driverValues expands the packed values of aggregated actions back into the
+// nested form callers enqueued.
+func (b *Buffer) driverValues(action bufferedAction) map[string]any {
+	if !b.aggregate {
+		return action.values
+	}
+	return Unpack(action.values)
+}
+
 func (b *Buffer) startWorker() {
 	stopCh := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
 	b.stopCh = stopCh
+	b.cancelWorker = cancel
+	b.flushCh = make(chan struct{}, 1)
 	b.wg.Add(1)
 
 	go func(stop <-chan struct{}) {
 		defer b.wg.Done()
+		defer cancel()
 		ticker := time.NewTicker(b.duration)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				_ = b.Flush()
+				_ = b.FlushContext(ctx)
+			case <-b.flushCh:
+				_ = b.FlushContext(ctx)
 			case <-stop:
 				return
 			}
@@ -256,22 +1183,37 @@ func (b *Buffer) startWorker() {
 	}(stopCh)
 }
 
-func (b *Buffer) matches(driver WriteStorage, duration time.Duration, size int, aggregate, async bool) bool {
+func (b *Buffer) signalFlush() {
+	select {
+	case b.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Buffer) matches(driver WriteStorage, opts BufferOptions) bool {
 	if b == nil {
 		return false
 	}
 
-	normalizedDuration := normalizeBufferDuration(duration)
-	normalizedSize := normalizeBufferSize(size)
-	normalizedAggregate := aggregate && supportsCountDriver(driver)
+	normalizedDuration := normalizeBufferDuration(opts.Duration)
+	normalizedSize := normalizeBufferSize(opts.Size)
+	normalizedAggregate := opts.Aggregate && supportsCountDriver(driver)
 
-	b.mu.Lock()
-	defer b.mu.Unlock()
 	return sameDriver(b.driver, driver) &&
 		b.duration == normalizedDuration &&
 		b.size == normalizedSize &&
 		b.aggregate == normalizedAggregate &&
-		b.async == async
+		b.async == opts.Async &&
+		b.journalDir == opts.JournalDir &&
+		sameFunc(b.onError, opts.OnError) &&
+		sameFunc(b.retryableFn, opts.Retryable) &&
+		b.maxPending == normalizeMaxPending(opts.MaxPending) &&
+		b.overflow == opts.Overflow &&
+		b.blockTimeout == opts.BlockTimeout &&
+		b.spillDir == opts.SpillDir &&
+		len(b.shards) == normalizeBufferShards(opts.Shards) &&
+		b.flushConcurrency == normalizeFlushConcurrency(opts.FlushConcurrency) &&
+		b.maxAttempts == normalizeMaxAttempts(opts.MaxAttempts)
 }
 
 func normalizeBufferDuration(value time.Duration) time.Duration {
@@ -288,6 +1230,34 @@ func normalizeBufferSize(value int) int {
 	return value
 }
 
+func normalizeMaxPending(value int) int {
+	if value <= 0 {
+		return 0
+	}
+	return value
+}
+
+func normalizeBufferShards(value int) int {
+	if value <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return value
+}
+
+func normalizeMaxAttempts(value int) int {
+	if value <= 0 {
+		return 0
+	}
+	return value
+}
+
+func normalizeFlushConcurrency(value int) int {
+	if value <= 1 {
+		return 1
+	}
+	return value
+}
+
 func supportsCountDriver(driver WriteStorage) bool {
 	_, ok := driver.(CountDriver)
 	return ok
@@ -309,23 +1279,62 @@ func sameDriver(a, b WriteStorage) bool {
 	return reflect.DeepEqual(a, b)
 }
 
+func sameFunc[F func(error, int) | func(error) bool](a, b F) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.IsNil() || vb.IsNil() {
+		return va.IsNil() && vb.IsNil()
+	}
+	return va.Pointer() == vb.Pointer()
+}
+
+// signatureFor identifies the action an operation aggregates into: the
+// operation, its data keys, and after a 0x1d separator their tracking keys.
 func signatureFor(operation string, keys []Key) string {
-	parts := make([]string, 0, len(keys)+1)
-	parts = append(parts, operation)
+	size := len(operation) + 1
+	for _, key := range keys {
+		size += len(key.Prefix) + len(key.Key) + len(key.Granularity) + len(key.SystemTrackingKey()) + 25
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, operation...)
 	for _, key := range keys {
-		at := ""
+		buf = append(buf, 0x1e)
+		buf = append(buf, key.Prefix...)
+		buf = append(buf, 0x1f)
+		buf = append(buf, key.Key...)
+		buf = append(buf, 0x1f)
+		buf = append(buf, key.Granularity...)
+		buf = append(buf, 0x1f)
 		if key.At != nil {
-			at = strconv.FormatInt(key.At.Unix(), 10)
+			buf = strconv.AppendInt(buf, key.At.Unix(), 10)
 		}
-		parts = append(parts, strings.Join([]string{
-			key.Prefix,
-			key.Key,
-			key.Granularity,
-			at,
-			key.SystemTrackingKey(),
-		}, ":"))
 	}
-	return strings.Join(parts, "|")
+	buf = append(buf, 0x1d)
+	for idx, key := range keys {
+		if idx > 0 {
+			buf = append(buf, 0x1f)
+		}
+		buf = append(buf, key.SystemTrackingKey()...)
+	}
+	return string(buf)
+}
+
+// keysOfSignature returns the data keys part of sig.
+func keysOfSignature(sig string) string {
+	start := strings.IndexByte(sig, 0x1e)
+	end := strings.IndexByte(sig, 0x1d)
+	if start < 0 || end < start {
+		return ""
+	}
+	return sig[start:end]
+}
+
+// trackingOfSignature returns the tracking keys part of sig.
+func trackingOfSignature(sig string) string {
+	if idx := strings.IndexByte(sig, 0x1d); idx >= 0 {
+		return sig[idx:]
+	}
+	return ""
 }
 
 func cloneKeys(keys []Key) []Key {
@@ -367,6 +1376,27 @@ func cloneValue(value any) any {
 	}
 }
 
+// requireNumeric rejects increments drivers cannot apply.
+func requireNumeric(values map[string]any) error {
+	for field, value := range Pack(values) {
+		if _, ok := toFloat(value); !ok {
+			return fmt.Errorf("increment requires numeric value for key %q", field)
+		}
+	}
+	return nil
+}
+
+// packedValues returns values in packed form, skipping the copy when they
+// hold no nested maps.
+func packedValues(values map[string]any) map[string]any {
+	for _, value := range values {
+		if _, ok := value.(map[string]any); ok {
+			return Pack(values)
+		}
+	}
+	return values
+}
+
 func mergeIncrement(current, incoming map[string]any) map[string]any {
 	out := cloneMap(current)
 	for key, value := range incoming {
@@ -0,0 +1,293 @@
+package triflestats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const journalSuffix = ".journal"
+
+// bufferJournal is an append-only log of buffered operations split into
+// numbered segments. Draining the buffer rotates the active segment, and the
+// drained segments are removed once their actions reach the driver. Records
+// are written straight to the OS, so they survive a process crash.
+type bufferJournal struct {
+	mu      sync.Mutex
+	dir     string
+	seq     int64
+	file    *os.File
+	records int
+	pending []string
+}
+
+type journalRecord struct {
+	Operation string         `json:"op"`
+	Keys      []journalKey   `json:"keys"`
+	Values    map[string]any `json:"values"`
+	// Count is the number of operations an aggregated record stands for,
+	// omitted for single operations.
+	Count int64 `json:"count,omitempty"`
+	// Attempts counts failed flushes of a spilled action written back.
+	Attempts int `json:"attempts,omitempty"`
+	// Evicted marks the OverflowDropOldest eviction of the queued action with
+	// this operation and keys, so a replay does not bring it back.
+	Evicted bool `json:"evicted,omitempty"`
+}
+
+type journalKey struct {
+	Prefix      string     `json:"prefix,omitempty"`
+	Key         string     `json:"key"`
+	TrackingKey string     `json:"tracking_key,omitempty"`
+	Granularity string     `json:"granularity,omitempty"`
+	At          *time.Time `json:"at,omitempty"`
+}
+
+// openBufferJournal replays segments left in dir and compacts them into a fresh
+// active segment.
+func openBufferJournal(dir string) (*bufferJournal, []journalRecord, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("buffer journal: %w", err)
+	}
+
+	segments, lastSeq, err := journalSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := []journalRecord{}
+	for _, segment := range segments {
+		replayed, err := readJournalSegment(segment)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, replayed...)
+	}
+
+	j := &bufferJournal{dir: dir, seq: lastSeq}
+	if err := j.openNext(); err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		if err := j.write(record); err != nil {
+			_ = j.file.Close()
+			return nil, nil, err
+		}
+	}
+	if err := j.file.Sync(); err != nil {
+		_ = j.file.Close()
+		return nil, nil, fmt.Errorf("buffer journal: %w", err)
+	}
+	for _, segment := range segments {
+		if err := os.Remove(segment); err != nil {
+			_ = j.file.Close()
+			return nil, nil, fmt.Errorf("buffer journal: %w", err)
+		}
+	}
+	return j, records, nil
+}
+
+func (j *bufferJournal) append(operation string, keys []Key, values map[string]any, count int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.write(newJournalRecord(operation, keys, values, count))
+}
+
+// requeue appends actions a flush left unwritten, keeping their attempts.
+func (j *bufferJournal) requeue(actions []bufferedAction) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, action := range actions {
+		record := newJournalRecord(action.operation, action.keys, action.values, action.count)
+		record.Attempts = action.attempts
+		if err := j.write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict records the eviction of a queued action.
+func (j *bufferJournal) evict(operation string, keys []Key, count int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	record := newJournalRecord(operation, keys, nil, count)
+	record.Evicted = true
+	return j.write(record)
+}
+
+func newJournalRecord(operation string, keys []Key, values map[string]any, count int64) journalRecord {
+	record := journalRecord{
+		Operation: operation,
+		Keys:      make([]journalKey, 0, len(keys)),
+		Values:    values,
+	}
+	if count > 1 {
+		record.Count = count
+	}
+	for _, key := range keys {
+		record.Keys = append(record.Keys, journalKey{
+			Prefix:      key.Prefix,
+			Key:         key.Key,
+			TrackingKey: key.TrackingKey,
+			Granularity: key.Granularity,
+			At:          key.At,
+		})
+	}
+	return record
+}
+
+func (j *bufferJournal) write(record journalRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("buffer journal: %w", err)
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("buffer journal: %w", err)
+	}
+	j.records++
+	return nil
+}
+
+// rotate seals the active segment and returns every segment awaiting a flush.
+func (j *bufferJournal) rotate() ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.records > 0 {
+		if err := j.file.Close(); err != nil {
+			return nil, fmt.Errorf("buffer journal: %w", err)
+		}
+		j.pending = append(j.pending, j.file.Name())
+		if err := j.openNext(); err != nil {
+			return nil, err
+		}
+	}
+	segments := j.pending
+	j.pending = nil
+	return segments, nil
+}
+
+// retain returns segments to the pending list after a failed flush.
+func (j *bufferJournal) retain(segments []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pending = append(append([]string(nil), segments...), j.pending...)
+}
+
+// release removes segments whose actions reached the driver.
+func (j *bufferJournal) release(segments []string) error {
+	for _, segment := range segments {
+		if err := os.Remove(segment); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("buffer journal: %w", err)
+		}
+	}
+	return nil
+}
+
+func (j *bufferJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	name := j.file.Name()
+	if err := j.file.Close(); err != nil {
+		return fmt.Errorf("buffer journal: %w", err)
+	}
+	if j.records == 0 {
+		return j.release([]string{name})
+	}
+	return nil
+}
+
+func (j *bufferJournal) openNext() error {
+	j.seq++
+	path := filepath.Join(j.dir, fmt.Sprintf("%020d%s", j.seq, journalSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("buffer journal: %w", err)
+	}
+	j.file = file
+	j.records = 0
+	return nil
+}
+
+func journalSegments(dir string) ([]string, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("buffer journal: %w", err)
+	}
+
+	type segment struct {
+		path string
+		seq  int64
+	}
+	segments := []segment{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, journalSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, journalSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(dir, name), seq: seq})
+	}
+	sort.Slice(segments, func(i, k int) bool { return segments[i].seq < segments[k].seq })
+
+	paths := make([]string, 0, len(segments))
+	var lastSeq int64
+	for _, segment := range segments {
+		paths = append(paths, segment.path)
+		lastSeq = segment.seq
+	}
+	return paths, lastSeq, nil
+}
+
+// readJournalSegment decodes records until the first unreadable line, which is
+// a write torn by the crash being recovered from.
+func readJournalSegment(path string) ([]journalRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("buffer journal: %w", err)
+	}
+	defer file.Close()
+
+	records := []journalRecord{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var record journalRecord
+			if json.Unmarshal(line, &record) != nil {
+				return records, nil
+			}
+			records = append(records, record)
+		}
+		if err != nil {
+			return records, nil
+		}
+	}
+}
+
+func (r journalRecord) count() int64 {
+	return max(r.Count, 1)
+}
+
+func (r journalRecord) keys() []Key {
+	keys := make([]Key, 0, len(r.Keys))
+	for _, key := range r.Keys {
+		keys = append(keys, Key{
+			Prefix:      key.Prefix,
+			Key:         key.Key,
+			TrackingKey: key.TrackingKey,
+			Granularity: key.Granularity,
+			At:          key.At,
+		})
+	}
+	return keys
+}
@@ -0,0 +1,174 @@
+package triflestats
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func journalFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+journalSuffix))
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	return files
+}
+
+func TestBufferJournal_ReplaysOperationsAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "metric", Granularity: "1h", At: &now}
+
+	crashed := NewBuffer(newBufferTestDriver(), BufferOptions{Size: 100, Aggregate: true, JournalDir: dir})
+	for i := 1; i <= 3; i++ {
+		if err := crashed.Inc([]Key{key}, map[string]any{"count": i}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if err := crashed.Set([]Key{key}, map[string]any{"state": "up"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	driver := newBufferTestDriver()
+	recovered := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, JournalDir: dir})
+	if err := recovered.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	writes := driver.snapshot()
+	if len(writes) != 2 {
+		t.Fatalf("expected 2 replayed writes, got %+v", writes)
+	}
+	for _, write := range writes {
+		if !write.keys[0].At.Equal(now) {
+			t.Fatalf("unexpected replayed key: %+v", write.keys[0])
+		}
+		switch write.operation {
+		case "inc":
+			if write.count != 3 || write.values["count"] != float64(6) {
+				t.Fatalf("unexpected replayed increment: %+v", write)
+			}
+		case "set":
+			if write.count != 1 || write.values["state"] != "up" {
+				t.Fatalf("unexpected replayed set: %+v", write)
+			}
+		}
+	}
+	if files := journalFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected journal to be empty after shutdown, got %v", files)
+	}
+}
+
+func TestBufferJournal_DoesNotReplayEvictedActions(t *testing.T) {
+	for _, aggregate := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := BufferOptions{Size: 100, Aggregate: aggregate, JournalDir: dir, MaxPending: 2, Overflow: OverflowDropOldest}
+		keys := bufferKeys("a", "b", "c")
+
+		crashed := NewBuffer(newBufferTestDriver(), opts)
+		for _, key := range keys {
+			if err := crashed.Inc(key, map[string]any{"count": 1}); err != nil {
+				t.Fatalf("enqueue failed: %v", err)
+			}
+		}
+		if crashed.Dropped() != 1 {
+			t.Fatalf("expected 1 evicted operation, got %d", crashed.Dropped())
+		}
+
+		driver := newBufferTestDriver()
+		recovered := NewBuffer(driver, opts)
+		if err := recovered.Shutdown(); err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+		writes := driver.snapshot()
+		if len(writes) != 2 || writes[0].keys[0].Key != "b" || writes[1].keys[0].Key != "c" {
+			t.Fatalf("expected only the queued actions replayed with aggregate=%v, got %+v", aggregate, writes)
+		}
+	}
+}
+
+func TestBufferJournal_FlushTruncatesJournal(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "metric", Granularity: "1h", At: &now}
+
+	buffer := NewBuffer(newBufferTestDriver(), BufferOptions{Size: 100, JournalDir: dir})
+	if err := buffer.Inc([]Key{key}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	driver := newBufferTestDriver()
+	restarted := NewBuffer(driver, BufferOptions{Size: 100, JournalDir: dir})
+	if err := restarted.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != 0 {
+		t.Fatalf("expected flushed operations not to be replayed, got %+v", writes)
+	}
+}
+
+func TestBufferJournal_KeepsOperationsWhenFlushFails(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "metric", Granularity: "1h", At: &now}
+
+	failing := &failingBufferDriver{}
+	failing.fail(errors.New("connection refused"))
+	buffer := NewBuffer(failing, BufferOptions{Size: 100, JournalDir: dir})
+	if err := buffer.Inc([]Key{key}, map[string]any{"count": 2}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Shutdown(); err == nil {
+		t.Fatalf("expected shutdown to report flush error")
+	}
+
+	driver := newBufferTestDriver()
+	restarted := NewBuffer(driver, BufferOptions{Size: 100, JournalDir: dir})
+	if err := restarted.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	writes := driver.snapshot()
+	if len(writes) != 1 || writes[0].values["count"] != float64(2) {
+		t.Fatalf("expected failed operation to be replayed, got %+v", writes)
+	}
+	_ = restarted.Shutdown()
+}
+
+func TestBufferJournal_IgnoresTornTrailingRecord(t *testing.T) {
+	dir := t.TempDir()
+	segment := `{"op":"inc","keys":[{"key":"metric","granularity":"1h","at":"2025-02-01T10:00:00Z"}],"values":{"count":1}}` + "\n" +
+		`{"op":"inc","keys":[{"key":"met`
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000007"+journalSuffix), []byte(segment), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, JournalDir: dir})
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	writes := driver.snapshot()
+	if len(writes) != 1 || writes[0].values["count"] != float64(1) {
+		t.Fatalf("expected only the complete record to be replayed, got %+v", writes)
+	}
+}
+
+func TestBufferJournal_UnusableDirectoryRejectsEnqueue(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	buffer := NewBuffer(newBufferTestDriver(), BufferOptions{Size: 100, JournalDir: file})
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	if err := buffer.Inc([]Key{{Key: "metric", Granularity: "1h", At: &now}}, map[string]any{"count": 1}); err == nil {
+		t.Fatalf("expected enqueue error when journal cannot be opened")
+	}
+	_ = buffer.Shutdown()
+}
@@ -0,0 +1,143 @@
+package triflestats
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownReport describes the operations a shutdown did not write to the
+// driver. Operations already in the spill journal are not counted.
+type ShutdownReport struct {
+	Actions    int
+	Operations int64
+	// Persisted reports whether the unwritten operations were kept on disk,
+	// in the journal or the spill directory, for the next buffer to write.
+	Persisted bool
+}
+
+// ShutdownContext stops the worker and flushes outstanding operations until
+// ctx is done. Operations left unwritten are reported, and kept on disk when
+// the buffer has a journal or a spill directory. Writes in progress are
+// cancelled through context-aware drivers; others finish their current call.
+func (b *Buffer) ShutdownContext(ctx context.Context) (ShutdownReport, error) {
+	if b == nil {
+		return ShutdownReport{}, nil
+	}
+	ctx = ensureContext(ctx)
+
+	b.mu.Lock()
+	if b.closed.Load() {
+		b.mu.Unlock()
+		return ShutdownReport{}, nil
+	}
+	b.lockShards()
+	b.closed.Store(true)
+	b.unlockShards()
+	stopCh, cancelWorker := b.stopCh, b.cancelWorker
+	b.stopCh, b.cancelWorker = nil, nil
+	b.mu.Unlock()
+
+	if stopCh != nil {
+		close(stopCh)
+		stop := context.AfterFunc(ctx, cancelWorker)
+		b.wg.Wait()
+		stop()
+	}
+	b.signalSpace()
+	err := b.FlushContext(ctx)
+
+	report := ShutdownReport{
+		Actions:    int(b.actionCount.Load()),
+		Operations: b.operationCount.Load(),
+	}
+	if report.Operations > 0 {
+		persisted, persistErr := b.persistRemaining()
+		report.Persisted = persisted
+		if err == nil {
+			err = persistErr
+		}
+	}
+	for _, journal := range []*bufferJournal{b.journal, b.spill} {
+		if journal == nil {
+			continue
+		}
+		if closeErr := journal.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return report, err
+}
+
+// persistRemaining keeps unwritten actions on disk. The journal holds them
+// already; otherwise they are moved to the spill journal.
+func (b *Buffer) persistRemaining() (bool, error) {
+	if b.journal != nil {
+		return true, nil
+	}
+	if b.spill == nil {
+		return false, nil
+	}
+
+	actions, _, err := b.drainActions()
+	if err != nil {
+		return false, err
+	}
+	for idx, action := range actions {
+		if err := b.spill.append(action.operation, action.keys, action.values, action.count); err != nil {
+			b.retainActions(actions[idx:], nil)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ShutdownBufferOnSignal shuts the buffer down when the process receives one
+// of signals, SIGINT and SIGTERM by default, giving the flush up to timeout.
+// done receives the outcome, after which callers usually exit. Further
+// signals get their default behavior. The returned function stops listening.
+func (c *Config) ShutdownBufferOnSignal(timeout time.Duration, done func(ShutdownReport, error), signals ...os.Signal) func() {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	stop := c.shutdownBufferOn(received, timeout, done)
+	return func() {
+		signal.Stop(received)
+		stop()
+	}
+}
+
+func (c *Config) shutdownBufferOn(received chan os.Signal, timeout time.Duration, done func(ShutdownReport, error)) func() {
+	quit := make(chan struct{})
+	go func() {
+		select {
+		case <-received:
+			signal.Stop(received)
+		case <-quit:
+			return
+		}
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		report, err := c.ShutdownBufferContext(ctx)
+		if done != nil {
+			done(report, err)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package triflestats
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stalledBufferDriver blocks context-aware writes until their context is done.
+type stalledBufferDriver struct {
+	bufferTestDriver
+	entered chan struct{}
+}
+
+func newStalledBufferDriver() *stalledBufferDriver {
+	return &stalledBufferDriver{
+		bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}},
+		entered:          make(chan struct{}, 16),
+	}
+}
+
+func (d *stalledBufferDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	d.entered <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (d *stalledBufferDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(ctx, keys, values, count)
+}
+
+func TestBuffer_ShutdownContextReportsUnwrittenOperations(t *testing.T) {
+	driver := newStalledBufferDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true})
+
+	keys := bufferKeys("a", "b", "c")
+	for _, idx := range []int{0, 0, 1, 2} {
+		if err := buffer.Inc(keys[idx], map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	report, err := buffer.ShutdownContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if report.Actions != 3 || report.Operations != 4 || report.Persisted {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if err := buffer.Inc(keys[0], map[string]any{"count": 1}); err == nil {
+		t.Fatalf("expected closed buffer to reject enqueue")
+	}
+}
+
+func TestBuffer_ShutdownContextCancelsWorkerFlush(t *testing.T) {
+	driver := newStalledBufferDriver()
+	buffer := NewBuffer(driver, BufferOptions{Duration: time.Millisecond, Size: 100, Aggregate: true, Async: true})
+
+	if err := buffer.Inc(bufferKeys("a")[0], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	select {
+	case <-driver.entered:
+	case <-time.After(time.Second):
+		t.Fatalf("expected worker flush to start")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	report, err := buffer.ShutdownContext(ctx)
+	if err == nil || report.Operations != 1 {
+		t.Fatalf("expected unwritten operation, got %+v, %v", report, err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("shutdown overran its deadline: %v", elapsed)
+	}
+}
+
+func TestBuffer_ShutdownContextPersistsRemainderToSpill(t *testing.T) {
+	dir := t.TempDir()
+	buffer := NewBuffer(newStalledBufferDriver(), BufferOptions{Size: 100, Aggregate: true, SpillDir: dir})
+
+	keys := bufferKeys("a", "b")
+	for _, idx := range []int{0, 0, 0, 1} {
+		if err := buffer.Inc(keys[idx], map[string]any{"count": 2}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := buffer.ShutdownContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+	if report.Actions != 2 || report.Operations != 4 || !report.Persisted {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	driver := newBufferTestDriver()
+	restarted := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, SpillDir: dir})
+	if err := restarted.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	writes := driver.snapshot()
+	if len(writes) != 2 {
+		t.Fatalf("expected 2 writes, got %+v", writes)
+	}
+	if writes[0].count != 3 || writes[0].values["count"] != float64(6) || writes[1].count != 1 {
+		t.Fatalf("expected aggregated counts to survive, got %+v", writes)
+	}
+	if files := journalFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill to be cleared, got %v", files)
+	}
+}
+
+func TestBuffer_ShutdownContextKeepsJournal(t *testing.T) {
+	dir := t.TempDir()
+	buffer := NewBuffer(newStalledBufferDriver(), BufferOptions{Size: 100, Aggregate: true, JournalDir: dir})
+	if err := buffer.Inc(bufferKeys("a")[0], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := buffer.ShutdownContext(ctx)
+	if err == nil || !report.Persisted {
+		t.Fatalf("expected persisted remainder, got %+v, %v", report, err)
+	}
+
+	driver := newBufferTestDriver()
+	restarted := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, JournalDir: dir})
+	if err := restarted.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != 1 {
+		t.Fatalf("expected replayed write, got %+v", writes)
+	}
+}
+
+func TestConfig_ShutdownBufferOnSignal(t *testing.T) {
+	cfg := DefaultConfig()
+	driver := newBufferTestDriver()
+	cfg.Driver = driver
+	cfg.BufferAsync = false
+
+	at := time.Date(2025, 2, 1, 10, 30, 0, 0, time.UTC)
+	if err := Track(cfg, "events", at, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("track failed: %v", err)
+	}
+
+	received := make(chan os.Signal, 1)
+	results := make(chan error, 1)
+	stop := cfg.shutdownBufferOn(received, time.Second, func(report ShutdownReport, err error) {
+		if err == nil && report.Operations != 0 {
+			err = errors.New("expected everything written")
+		}
+		results <- err
+	})
+	defer stop()
+
+	received <- syscall.SIGTERM
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected shutdown on signal")
+	}
+	if len(driver.snapshot()) == 0 {
+		t.Fatalf("expected buffered writes to be flushed")
+	}
+	if stats := cfg.BufferStats(); stats.Enqueued != 0 {
+		t.Fatalf("expected buffer to be released, got %+v", stats)
+	}
+}
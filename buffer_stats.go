@@ -0,0 +1,136 @@
+package triflestats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flushDurationBounds are the upper bounds of the flush duration histogram
+// buckets. Slower flushes land in a final overflow bucket.
+var flushDurationBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// BufferStats is a point-in-time view of a Buffer.
+type BufferStats struct {
+	// Pending is the number of queued operations, and Actions the number of
+	// driver writes they collapse into.
+	Pending int
+	Actions int
+	// Enqueued counts operations accepted by Inc and Set, including spilled ones.
+	Enqueued int64
+	// Flushed counts operations written to the driver by Dispatched actions.
+	Flushed    int64
+	Dispatched int64
+	Flushes    int64
+	Failures   int64
+	Dropped    int64
+	Spilled    int64
+	// Discarded counts operations dropped by flushes, see DiscardedError.
+	Discarded int64
+	// FlushDurations counts flushes by duration: FlushDurations[i] holds
+	// flushes up to FlushDurationBounds[i], and the last entry slower ones.
+	FlushDurations      []int64
+	FlushDurationBounds []time.Duration
+	LastError           error
+	LastErrorAt         time.Time
+}
+
+// AggregationRatio returns flushed operations per dispatched action, or zero
+// before the first dispatch.
+func (s BufferStats) AggregationRatio() float64 {
+	if s.Dispatched == 0 {
+		return 0
+	}
+	return float64(s.Flushed) / float64(s.Dispatched)
+}
+
+type bufferStats struct {
+	enqueued atomic.Int64
+
+	mu          sync.Mutex
+	flushed     int64
+	dispatched  int64
+	flushes     int64
+	failures    int64
+	discarded   int64
+	durations   []int64
+	lastError   error
+	lastErrorAt time.Time
+}
+
+func (s *bufferStats) recordEnqueue() {
+	s.enqueued.Add(1)
+}
+
+func (s *bufferStats) recordDispatch(action bufferedAction) {
+	s.mu.Lock()
+	s.dispatched++
+	s.flushed += max(action.count, 1)
+	s.mu.Unlock()
+}
+
+func (s *bufferStats) recordDiscard(action bufferedAction) {
+	s.mu.Lock()
+	s.discarded += max(action.count, 1)
+	s.mu.Unlock()
+}
+
+func (s *bufferStats) recordFlush(duration time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.durations == nil {
+		s.durations = make([]int64, len(flushDurationBounds)+1)
+	}
+	bucket := len(flushDurationBounds)
+	for idx, bound := range flushDurationBounds {
+		if duration <= bound {
+			bucket = idx
+			break
+		}
+	}
+	s.durations[bucket]++
+	s.flushes++
+	if err != nil {
+		s.failures++
+		s.lastError = err
+		s.lastErrorAt = time.Now()
+	}
+}
+
+// Stats reports queue depth and flush activity. It is safe to call while the
+// worker flushes.
+func (b *Buffer) Stats() BufferStats {
+	if b == nil {
+		return BufferStats{}
+	}
+
+	b.stats.mu.Lock()
+	defer b.stats.mu.Unlock()
+	durations := make([]int64, len(flushDurationBounds)+1)
+	copy(durations, b.stats.durations)
+	return BufferStats{
+		Pending:             int(b.operationCount.Load()),
+		Actions:             int(b.actionCount.Load()),
+		Enqueued:            b.stats.enqueued.Load(),
+		Flushed:             b.stats.flushed,
+		Dispatched:          b.stats.dispatched,
+		Flushes:             b.stats.flushes,
+		Failures:            b.stats.failures,
+		Dropped:             b.dropped.Load(),
+		Spilled:             b.spilled.Load(),
+		Discarded:           b.stats.discarded,
+		FlushDurations:      durations,
+		FlushDurationBounds: append([]time.Duration(nil), flushDurationBounds...),
+		LastError:           b.stats.lastError,
+		LastErrorAt:         b.stats.lastErrorAt,
+	}
+}
@@ -0,0 +1,139 @@
+package triflestats
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBufferStats_TracksQueueAndFlushes(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+
+	keys := bufferKeys("a", "b")
+	for _, idx := range []int{0, 0, 0, 0, 0, 1} {
+		if err := buffer.Inc(keys[idx], map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+
+	stats := buffer.Stats()
+	if stats.Pending != 6 || stats.Actions != 2 || stats.Enqueued != 6 {
+		t.Fatalf("unexpected queue stats: %+v", stats)
+	}
+	if stats.AggregationRatio() != 0 {
+		t.Fatalf("expected zero ratio before flushing, got %v", stats.AggregationRatio())
+	}
+
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	stats = buffer.Stats()
+	if stats.Pending != 0 || stats.Actions != 0 {
+		t.Fatalf("expected empty queue after flush, got %+v", stats)
+	}
+	if stats.Dispatched != 2 || stats.Flushed != 6 || stats.Flushes != 1 || stats.Failures != 0 {
+		t.Fatalf("unexpected flush stats: %+v", stats)
+	}
+	if stats.AggregationRatio() != 3 {
+		t.Fatalf("expected aggregation ratio 3, got %v", stats.AggregationRatio())
+	}
+	if len(stats.FlushDurations) != len(stats.FlushDurationBounds)+1 {
+		t.Fatalf("expected an overflow bucket, got %d buckets for %d bounds", len(stats.FlushDurations), len(stats.FlushDurationBounds))
+	}
+	var observed int64
+	for _, count := range stats.FlushDurations {
+		observed += count
+	}
+	if observed != 1 {
+		t.Fatalf("expected 1 flush in histogram, got %d", observed)
+	}
+
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("empty flush failed: %v", err)
+	}
+	if buffer.Stats().Flushes != 1 {
+		t.Fatalf("expected empty flushes not to be recorded")
+	}
+}
+
+func TestBufferStats_RecordsLastError(t *testing.T) {
+	driver := &failingBufferDriver{bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}}}
+	driver.fail(errors.New("connection refused"))
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true})
+
+	keys := bufferKeys("a")
+	if err := buffer.Inc(keys[0], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Flush(); err == nil {
+		t.Fatalf("expected flush error")
+	}
+
+	stats := buffer.Stats()
+	if stats.Failures != 1 || stats.LastError == nil || stats.LastErrorAt.IsZero() {
+		t.Fatalf("expected recorded failure, got %+v", stats)
+	}
+	if stats.Pending != 1 || stats.Dispatched != 0 {
+		t.Fatalf("expected failed action to stay pending, got %+v", stats)
+	}
+
+	driver.fail(nil)
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if stats := buffer.Stats(); stats.Dispatched != 1 || stats.LastError == nil {
+		t.Fatalf("expected last error to be kept after recovery, got %+v", stats)
+	}
+}
+
+func TestBufferStats_SafeDuringAsyncFlushes(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Duration: time.Millisecond, Size: 10, Aggregate: true, Async: true})
+
+	keys := bufferKeys("a", "b", "c")
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_ = buffer.Inc(keys[(worker+i)%len(keys)], map[string]any{"count": 1})
+				_ = buffer.Stats()
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	stats := buffer.Stats()
+	if stats.Enqueued != 800 || stats.Flushed != 800 || stats.Pending != 0 {
+		t.Fatalf("unexpected totals: %+v", stats)
+	}
+}
+
+func TestConfig_BufferStats(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Driver = newBufferTestDriver()
+	cfg.BufferAsync = false
+	if stats := cfg.BufferStats(); stats.Enqueued != 0 {
+		t.Fatalf("expected zero stats before buffering, got %+v", stats)
+	}
+
+	at := time.Date(2025, 2, 1, 10, 30, 0, 0, time.UTC)
+	if err := Track(cfg, "events", at, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("track failed: %v", err)
+	}
+	if stats := cfg.BufferStats(); stats.Enqueued != 1 || stats.Pending != 1 {
+		t.Fatalf("unexpected config stats: %+v", stats)
+	}
+	if err := cfg.ShutdownBuffer(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package triflestats
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"sync"
 	"testing"
 	"time"
@@ -85,6 +89,38 @@ func (d *bufferTestDriver) Description() string {
 	return "buffer-test-driver"
 }
 
+type failingBufferDriver struct {
+	bufferTestDriver
+	failMu sync.Mutex
+	err    error
+}
+
+func (d *failingBufferDriver) fail(err error) {
+	d.failMu.Lock()
+	d.err = err
+	d.failMu.Unlock()
+}
+
+func (d *failingBufferDriver) failure() error {
+	d.failMu.Lock()
+	defer d.failMu.Unlock()
+	return d.err
+}
+
+func (d *failingBufferDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	if err := d.failure(); err != nil {
+		return err
+	}
+	return d.bufferTestDriver.IncCount(keys, values, count)
+}
+
+func (d *failingBufferDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	if err := d.failure(); err != nil {
+		return err
+	}
+	return d.bufferTestDriver.SetCount(keys, values, count)
+}
+
 func (d *bufferTestDriver) snapshot() []recordedWrite {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -298,3 +334,914 @@ func TestBuffer_ClosedBufferRejectsEnqueue(t *testing.T) {
 		t.Fatalf("expected enqueue error after shutdown")
 	}
 }
+
+func TestBuffer_ReportsAndRetriesFailedAsyncFlush(t *testing.T) {
+	driver := &failingBufferDriver{bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}}}
+	driver.fail(errors.New("connection refused"))
+
+	reported := make(chan int, 16)
+	buffer := NewBuffer(driver, BufferOptions{
+		Duration:  10 * time.Millisecond,
+		Size:      100,
+		Aggregate: true,
+		Async:     true,
+		OnError: func(err error, actions int) {
+			reported <- actions
+		},
+	})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "metric", Granularity: "1h", At: &now}
+	if err := buffer.Inc([]Key{key}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	select {
+	case actions := <-reported:
+		if actions != 1 {
+			t.Fatalf("expected 1 retained action, got %d", actions)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected flush error to be reported")
+	}
+
+	driver.fail(nil)
+	deadline := time.After(time.Second)
+	for len(driver.snapshot()) == 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected retained action to be retried")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	writes := driver.snapshot()
+	if len(writes) != 1 || writes[0].values["count"] != 1 {
+		t.Fatalf("unexpected retried writes: %+v", writes)
+	}
+}
+
+func TestBuffer_MergesRetainedActionsWithNewerOperations(t *testing.T) {
+	driver := &failingBufferDriver{bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}}}
+	buffer := NewBuffer(driver, BufferOptions{
+		Duration:  0,
+		Size:      100,
+		Aggregate: true,
+		Async:     false,
+	})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "metric", Granularity: "1h", At: &now}
+	if err := buffer.Inc([]Key{key}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Set([]Key{key}, map[string]any{"state": "old"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	driver.fail(errors.New("connection refused"))
+	if err := buffer.Flush(); err == nil {
+		t.Fatalf("expected flush error")
+	}
+	driver.fail(nil)
+
+	if err := buffer.Inc([]Key{key}, map[string]any{"count": 2}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Set([]Key{key}, map[string]any{"state": "new"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	writes := driver.snapshot()
+	if len(writes) != 2 {
+		t.Fatalf("expected 2 writes, got %+v", writes)
+	}
+	for _, write := range writes {
+		switch write.operation {
+		case "inc":
+			if write.count != 2 || write.values["count"] != float64(3) {
+				t.Fatalf("unexpected merged increment: %+v", write)
+			}
+		case "set":
+			if write.count != 2 || write.values["state"] != "new" {
+				t.Fatalf("unexpected merged set: %+v", write)
+			}
+		}
+	}
+}
+
+type gatedBufferDriver struct {
+	bufferTestDriver
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func newGatedBufferDriver() *gatedBufferDriver {
+	return &gatedBufferDriver{
+		bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}},
+		entered:          make(chan struct{}, 16),
+		gate:             make(chan struct{}),
+	}
+}
+
+func (d *gatedBufferDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	d.entered <- struct{}{}
+	<-d.gate
+	return d.bufferTestDriver.IncCount(keys, values, count)
+}
+
+var (
+	errUnavailable = errors.New("connection refused")
+	errRejected    = errors.New("value out of range")
+)
+
+// retryUnavailable is a Retryable classifier that only retries errUnavailable.
+func retryUnavailable(err error) bool {
+	return errors.Is(err, errUnavailable)
+}
+
+// keyFailingBufferDriver fails writes to the keys in errs.
+type keyFailingBufferDriver struct {
+	bufferTestDriver
+	errs map[string]error
+}
+
+func (d *keyFailingBufferDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	if err := d.errs[keys[0].Key]; err != nil {
+		return err
+	}
+	return d.bufferTestDriver.IncCount(keys, values, count)
+}
+
+func TestBuffer_RejectsNonNumericIncrements(t *testing.T) {
+	driver := NewMemoryDriver(JoinedFull)
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true})
+	keys := bufferKeys("metric")
+
+	if err := buffer.Inc(keys[0], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	if err := buffer.Inc(keys[0], map[string]any{"status": "ok"}); err == nil {
+		t.Fatalf("expected non-numeric increment to be rejected")
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if stats := buffer.Stats(); stats.Pending != 0 {
+		t.Fatalf("expected nothing pending, got %+v", stats)
+	}
+	values, _ := driver.Get(keys[0])
+	if count, _ := toFloat(values[0]["count"]); count != 1 {
+		t.Fatalf("expected valid increment written, got %v", values[0])
+	}
+}
+
+func TestBuffer_RetainsFailedActionsWithoutLimitByDefault(t *testing.T) {
+	driver := &keyFailingBufferDriver{
+		bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}},
+		errs:             map[string]error{"bad": errRejected},
+	}
+	buffer := NewBuffer(driver, BufferOptions{Size: 100})
+	keys := bufferKeys("bad")
+	_ = buffer.Inc(keys[0], map[string]any{"count": 1})
+
+	for attempt := 0; attempt < 25; attempt++ {
+		if err := buffer.Flush(); !errors.Is(err, errRejected) {
+			t.Fatalf("expected flush %d to fail, got %v", attempt, err)
+		}
+	}
+	if stats := buffer.Stats(); stats.Pending != 1 || stats.Discarded != 0 {
+		t.Fatalf("expected failed action kept, got %+v", stats)
+	}
+}
+
+func TestBuffer_DiscardsActionsRetryableRejects(t *testing.T) {
+	driver := &keyFailingBufferDriver{
+		bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}},
+		errs:             map[string]error{"bad": errRejected},
+	}
+	var reported error
+	reportedActions := -1
+	buffer := NewBuffer(driver, BufferOptions{
+		Size:      100,
+		Retryable: retryUnavailable,
+		OnError: func(err error, actions int) {
+			reported, reportedActions = err, actions
+		},
+	})
+	keys := bufferKeys("bad", "good")
+	_ = buffer.Inc(keys[0], map[string]any{"count": 1})
+	_ = buffer.Inc(keys[1], map[string]any{"count": 1})
+
+	err := buffer.Flush()
+	var discarded *DiscardedError
+	if !errors.As(err, &discarded) || discarded.Keys[0].Key != "bad" || discarded.Attempts != 1 {
+		t.Fatalf("expected bad action to be discarded, got %v", err)
+	}
+	if reported != err || reportedActions != 0 {
+		t.Fatalf("expected discard reported with nothing kept, got %v and %d", reported, reportedActions)
+	}
+	if writes := driver.snapshot(); len(writes) != 1 || writes[0].keys[0].Key != "good" {
+		t.Fatalf("expected later action written, got %+v", writes)
+	}
+	if stats := buffer.Stats(); stats.Pending != 0 || stats.Discarded != 1 {
+		t.Fatalf("expected discarded action gone, got %+v", stats)
+	}
+}
+
+func TestBuffer_DiscardsActionsAfterMaxAttempts(t *testing.T) {
+	driver := &keyFailingBufferDriver{
+		bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}},
+		errs:             map[string]error{"bad": errUnavailable},
+	}
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, Shards: 1, MaxAttempts: 3})
+	keys := bufferKeys("bad", "good")
+	_ = buffer.Inc(keys[0], map[string]any{"count": 1})
+	_ = buffer.Inc(keys[1], map[string]any{"count": 1})
+
+	for attempt := 1; attempt < 3; attempt++ {
+		if err := buffer.Flush(); !errors.Is(err, errUnavailable) {
+			t.Fatalf("expected retryable error on attempt %d, got %v", attempt, err)
+		}
+		if stats := buffer.Stats(); stats.Actions != 2 {
+			t.Fatalf("expected both actions kept after attempt %d, got %+v", attempt, stats)
+		}
+	}
+
+	var discarded *DiscardedError
+	if err := buffer.Flush(); !errors.As(err, &discarded) || discarded.Attempts != 3 {
+		t.Fatalf("expected action discarded after 3 attempts, got %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != 1 || writes[0].keys[0].Key != "good" {
+		t.Fatalf("expected later action written, got %+v", writes)
+	}
+	if stats := buffer.Stats(); stats.Pending != 0 || stats.Discarded != 1 {
+		t.Fatalf("expected queue drained, got %+v", stats)
+	}
+}
+
+func bufferKeys(names ...string) [][]Key {
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	out := make([][]Key, 0, len(names))
+	for _, name := range names {
+		out = append(out, []Key{{Key: name, Granularity: "1h", At: &now}})
+	}
+	return out
+}
+
+func TestBuffer_DropNewestWhenFull(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, MaxPending: 2, Overflow: OverflowDropNewest})
+
+	for _, keys := range bufferKeys("a", "b", "c") {
+		if err := buffer.Inc(keys, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	writes := driver.snapshot()
+	if len(writes) != 2 || writes[0].keys[0].Key != "a" || writes[1].keys[0].Key != "b" {
+		t.Fatalf("expected the two oldest writes, got %+v", writes)
+	}
+	if buffer.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped operation, got %d", buffer.Dropped())
+	}
+}
+
+func TestBuffer_DropOldestEvictsAggregatedAction(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, MaxPending: 2, Overflow: OverflowDropOldest})
+
+	keys := bufferKeys("a", "b", "c")
+	for _, idx := range []int{0, 0, 1, 1, 2} {
+		if err := buffer.Inc(keys[idx], map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	writes := driver.snapshot()
+	if len(writes) != 2 || writes[0].keys[0].Key != "b" || writes[1].keys[0].Key != "c" {
+		t.Fatalf("expected oldest action to be evicted, got %+v", writes)
+	}
+	if writes[0].count != 2 {
+		t.Fatalf("expected merged operations to stay aggregated, got %+v", writes[0])
+	}
+	if buffer.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped operations, got %d", buffer.Dropped())
+	}
+}
+
+func TestBuffer_BlockFlushesInlineWithoutWorker(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, MaxPending: 2})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+
+	for _, keys := range bufferKeys("a", "b", "c") {
+		if err := buffer.Inc(keys, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if writes := driver.snapshot(); len(writes) != 2 {
+		t.Fatalf("expected full queue to be flushed before enqueueing, got %+v", writes)
+	}
+	if buffer.Dropped() != 0 {
+		t.Fatalf("expected nothing dropped, got %d", buffer.Dropped())
+	}
+}
+
+func TestBuffer_BlockTimesOutWhileDriverIsStuck(t *testing.T) {
+	driver := newGatedBufferDriver()
+	buffer := NewBuffer(driver, BufferOptions{
+		Duration:     time.Hour,
+		Size:         100,
+		Aggregate:    true,
+		Async:        true,
+		MaxPending:   1,
+		BlockTimeout: 20 * time.Millisecond,
+	})
+
+	keys := bufferKeys("a", "b", "c")
+	if err := buffer.Inc(keys[0], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	// Waits for the worker to drain the queue, which frees space even though
+	// the driver has not returned yet.
+	if err := buffer.Inc(keys[1], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("expected enqueue to wait for the worker, got %v", err)
+	}
+	<-driver.entered
+
+	if err := buffer.Inc(keys[2], map[string]any{"count": 1}); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+	if buffer.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped operation, got %d", buffer.Dropped())
+	}
+
+	close(driver.gate)
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != 2 {
+		t.Fatalf("expected 2 writes, got %+v", writes)
+	}
+}
+
+func TestBuffer_AsyncSizeFlushDoesNotBlockCaller(t *testing.T) {
+	driver := newGatedBufferDriver()
+	buffer := NewBuffer(driver, BufferOptions{Duration: time.Hour, Size: 1, Aggregate: true, Async: true})
+
+	keys := bufferKeys("a")
+	done := make(chan error, 1)
+	go func() {
+		done <- buffer.Inc(keys[0], map[string]any{"count": 1})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected enqueue to return while the driver is busy")
+	}
+
+	<-driver.entered
+	close(driver.gate)
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != 1 {
+		t.Fatalf("expected worker to flush, got %+v", writes)
+	}
+}
+
+func TestBuffer_SpillWritesOverflowAfterQueue(t *testing.T) {
+	dir := t.TempDir()
+	crashed := NewBuffer(newBufferTestDriver(), BufferOptions{Size: 100, Aggregate: true, MaxPending: 1, Overflow: OverflowSpill, SpillDir: dir})
+	keys := bufferKeys("a", "b")
+	for _, idx := range []int{0, 1, 1} {
+		if err := crashed.Inc(keys[idx], map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if crashed.Spilled() != 2 || crashed.Dropped() != 0 {
+		t.Fatalf("expected 2 spilled and 0 dropped, got %d and %d", crashed.Spilled(), crashed.Dropped())
+	}
+
+	// Spilled operations survive a restart and are aggregated on the way out.
+	driver := newBufferTestDriver()
+	restarted := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, MaxPending: 1, Overflow: OverflowSpill, SpillDir: dir})
+	if err := restarted.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	writes := driver.snapshot()
+	if len(writes) != 1 || writes[0].keys[0].Key != "b" || writes[0].count != 2 || writes[0].values["count"] != float64(2) {
+		t.Fatalf("unexpected spilled writes: %+v", writes)
+	}
+	if files := journalFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill journal to be empty, got %v", files)
+	}
+}
+
+func TestBuffer_SpillKeepsAttemptsOfUnwrittenActions(t *testing.T) {
+	dir := t.TempDir()
+	driver := &keyFailingBufferDriver{
+		bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}},
+		errs:             map[string]error{"bad": errUnavailable},
+	}
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, MaxPending: 1, Overflow: OverflowSpill, SpillDir: dir, MaxAttempts: 2})
+	keys := bufferKeys("a", "bad", "good")
+	for _, key := range keys {
+		if err := buffer.Inc(key, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+
+	if err := buffer.Flush(); !errors.Is(err, errUnavailable) {
+		t.Fatalf("expected spilled action to fail, got %v", err)
+	}
+	var discarded *DiscardedError
+	if err := buffer.Flush(); !errors.As(err, &discarded) || discarded.Attempts != 2 {
+		t.Fatalf("expected spilled action discarded on its second attempt, got %v", err)
+	}
+
+	writes := driver.snapshot()
+	if len(writes) != 2 || writes[0].keys[0].Key != "a" || writes[1].keys[0].Key != "good" {
+		t.Fatalf("expected each writable action written once, got %+v", writes)
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if files := journalFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill journal to be empty, got %v", files)
+	}
+}
+
+func TestBuffer_SpillRequiresDirectory(t *testing.T) {
+	buffer := NewBuffer(newBufferTestDriver(), BufferOptions{Size: 100, MaxPending: 1, Overflow: OverflowSpill})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+
+	keys := bufferKeys("a", "b")
+	if err := buffer.Inc(keys[0], map[string]any{"count": 1}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	if err := buffer.Inc(keys[1], map[string]any{"count": 1}); err == nil {
+		t.Fatalf("expected error spilling without a directory")
+	}
+}
+
+func TestBuffer_ShardedAggregationUnderContention(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 1 << 20, Aggregate: true, Shards: 8, JournalDir: t.TempDir()})
+
+	names := make([]string, 10)
+	for idx := range names {
+		names[idx] = fmt.Sprintf("metric-%d", idx)
+	}
+	keys := bufferKeys(names...)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if err := buffer.Inc(keys[(worker+i)%len(keys)], map[string]any{"count": 1}); err != nil {
+					t.Errorf("enqueue failed: %v", err)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if stats := buffer.Stats(); stats.Pending != 8000 || stats.Actions != len(keys) {
+		t.Fatalf("unexpected queue stats: %+v", stats)
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	writes := driver.snapshot()
+	if len(writes) != len(keys) {
+		t.Fatalf("expected one write per key, got %d", len(writes))
+	}
+	for _, write := range writes {
+		if write.count != 800 || write.values["count"] != float64(800) {
+			t.Fatalf("unexpected aggregated write: %+v", write)
+		}
+	}
+}
+
+func TestBuffer_ShardsFlushInEnqueueOrder(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 1000, Aggregate: true, Shards: 4})
+
+	names := make([]string, 50)
+	for idx := range names {
+		names[idx] = fmt.Sprintf("metric-%d", idx)
+	}
+	for _, keys := range bufferKeys(names...) {
+		if err := buffer.Inc(keys, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	writes := driver.snapshot()
+	for idx, write := range writes {
+		if write.keys[0].Key != names[idx] {
+			t.Fatalf("write %d out of order: %s", idx, write.keys[0].Key)
+		}
+	}
+}
+
+func TestBuffer_FlushConcurrencyWritesInParallel(t *testing.T) {
+	driver := newGatedBufferDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 1000, Aggregate: true, FlushConcurrency: 4})
+
+	names := make([]string, 16)
+	for idx := range names {
+		names[idx] = fmt.Sprintf("metric-%d", idx)
+	}
+	for _, keys := range bufferKeys(names...) {
+		if err := buffer.Inc(keys, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- buffer.Flush()
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-driver.entered:
+		case <-time.After(time.Second):
+			t.Fatalf("expected concurrent writes, got %d", i)
+		}
+	}
+	close(driver.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != len(names) {
+		t.Fatalf("expected %d writes, got %d", len(names), len(writes))
+	}
+}
+
+func TestBuffer_FlushConcurrencyKeepsMetricOrder(t *testing.T) {
+	driver := newBufferTestDriver()
+	buffer := NewBuffer(driver, BufferOptions{Size: 1000, Aggregate: false, FlushConcurrency: 4})
+
+	keys := bufferKeys("a", "b", "c", "d")
+	for i := 0; i < 20; i++ {
+		for _, key := range keys {
+			if err := buffer.Set(key, map[string]any{"step": i}); err != nil {
+				t.Fatalf("enqueue failed: %v", err)
+			}
+		}
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	last := map[string]int{}
+	for _, write := range driver.snapshot() {
+		name := write.keys[0].Key
+		step := write.values["step"].(int)
+		if previous, ok := last[name]; ok && step != previous+1 {
+			t.Fatalf("%s written out of order: %d after %d", name, step, previous)
+		}
+		last[name] = step
+	}
+	if len(last) != len(keys) {
+		t.Fatalf("expected writes for every metric, got %v", last)
+	}
+}
+
+func TestBuffer_FlushConcurrencyRetainsFailedActions(t *testing.T) {
+	driver := &failingBufferDriver{bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}}}
+	retained := 0
+	buffer := NewBuffer(driver, BufferOptions{
+		Size:             1000,
+		Aggregate:        true,
+		FlushConcurrency: 3,
+		OnError: func(err error, actions int) {
+			retained = actions
+		},
+	})
+
+	for _, keys := range bufferKeys("a", "b", "c", "d", "e") {
+		if err := buffer.Inc(keys, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	driver.fail(errors.New("connection refused"))
+	if err := buffer.Flush(); err == nil {
+		t.Fatalf("expected flush error")
+	}
+	if retained != 5 || buffer.Stats().Actions != 5 {
+		t.Fatalf("expected all actions retained, got %d and %+v", retained, buffer.Stats())
+	}
+
+	driver.fail(nil)
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if writes := driver.snapshot(); len(writes) != 5 {
+		t.Fatalf("expected 5 writes after recovery, got %+v", writes)
+	}
+}
+
+type batchBufferDriver struct {
+	bufferTestDriver
+	batches [][]BatchOperation
+	err     error
+}
+
+func (d *batchBufferDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.batches = append(d.batches, operations)
+	return nil
+}
+
+func TestBuffer_IsolatesBatchRejectedByRetryable(t *testing.T) {
+	driver := &batchBufferDriver{bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}}}
+	buffer := NewBuffer(driver, BufferOptions{Size: 1000, Aggregate: true, Shards: 1, Retryable: retryUnavailable})
+
+	keys := bufferKeys("a", "b")
+	_ = buffer.Inc(keys[0], map[string]any{"count": 1})
+	_ = buffer.Inc(keys[1], map[string]any{"count": 1})
+
+	// The batch wrote nothing, so each action is written on its own.
+	driver.err = errRejected
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("expected actions written one by one, got %v", err)
+	}
+	if len(driver.batches) != 0 || len(driver.snapshot()) != 2 {
+		t.Fatalf("expected 2 single writes, got %d batches and %+v", len(driver.batches), driver.snapshot())
+	}
+}
+
+func TestBuffer_WritesWholeFlushToBatchDriver(t *testing.T) {
+	driver := &batchBufferDriver{bufferTestDriver: bufferTestDriver{payload: map[string]map[string]any{}}}
+	buffer := NewBuffer(driver, BufferOptions{Size: 1000, Aggregate: true, Shards: 1})
+
+	keys := bufferKeys("a", "b")
+	_ = buffer.Inc(keys[0], map[string]any{"count": 1})
+	_ = buffer.Set(keys[1], map[string]any{"state": "ok"})
+	_ = buffer.Inc(keys[0], map[string]any{"count": 2})
+
+	driver.err = errors.New("connection refused")
+	if err := buffer.Flush(); err == nil {
+		t.Fatalf("expected flush error")
+	}
+	if stats := buffer.Stats(); stats.Actions != 2 || stats.Dispatched != 0 {
+		t.Fatalf("expected failed batch to stay queued, got %+v", stats)
+	}
+
+	driver.err = nil
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if len(driver.batches) != 1 || len(driver.snapshot()) != 0 {
+		t.Fatalf("expected one batch and no single writes, got %d batches", len(driver.batches))
+	}
+	batch := driver.batches[0]
+	if len(batch) != 2 || batch[0].Operation != "inc" || batch[0].Count != 2 || batch[1].Operation != "set" {
+		t.Fatalf("unexpected batch: %+v", batch)
+	}
+	if batch[0].Values["count"] != float64(3) {
+		t.Fatalf("expected aggregated increment, got %+v", batch[0].Values)
+	}
+}
+
+func TestBuffer_AggregatedSetAndIncMatchUnbufferedWrites(t *testing.T) {
+	fields := []string{"a", "b", "c"}
+	keys := bufferKeys("metric")[0]
+	rng := rand.New(rand.NewPCG(7, 11))
+
+	for round := 0; round < 200; round++ {
+		direct := NewMemoryDriver(JoinedFull)
+		buffered := NewMemoryDriver(JoinedFull)
+		buffer := NewBuffer(buffered, BufferOptions{Size: 1000, Aggregate: true, Shards: 2})
+
+		steps := []string{}
+		for step := 0; step < 1+rng.IntN(8); step++ {
+			values := map[string]any{}
+			for _, field := range fields {
+				if rng.IntN(2) == 0 {
+					continue
+				}
+				if field == "c" {
+					values["nested"] = map[string]any{"c": rng.IntN(5)}
+					continue
+				}
+				values[field] = rng.IntN(5)
+			}
+			if len(values) == 0 {
+				continue
+			}
+			operation := "inc"
+			if rng.IntN(2) == 0 {
+				operation = "set"
+			}
+			steps = append(steps, fmt.Sprintf("%s %v", operation, values))
+			for _, storage := range []WriteStorage{direct, buffer} {
+				var err error
+				if operation == "set" {
+					err = storage.Set(keys, values)
+				} else {
+					err = storage.Inc(keys, values)
+				}
+				if err != nil {
+					t.Fatalf("%s failed: %v", operation, err)
+				}
+			}
+		}
+		if err := buffer.Shutdown(); err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+
+		system := []Key{{Key: systemKeyName, Granularity: keys[0].Granularity, At: keys[0].At}}
+		for _, lookup := range [][]Key{keys, system} {
+			want, _ := direct.Get(lookup)
+			got, _ := buffered.Get(lookup)
+			if !sameNumbers(Pack(want[0]), Pack(got[0])) {
+				t.Fatalf("buffered result differs for %v\nwant %v\ngot  %v", steps, want[0], got[0])
+			}
+		}
+	}
+}
+
+func TestBuffer_AssertThenTrackKeepsOrder(t *testing.T) {
+	at := time.Date(2025, 2, 1, 10, 30, 0, 0, time.UTC)
+	results := []any{}
+	for _, buffered := range []bool{false, true} {
+		driver := NewMemoryDriver(JoinedFull)
+		cfg := DefaultConfig()
+		cfg.Driver = driver
+		cfg.Granularities = []string{"1h"}
+		cfg.BufferEnabled = buffered
+		cfg.BufferAsync = false
+
+		if err := Track(cfg, "events", at, map[string]any{"count": 3}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+		if err := Assert(cfg, "events", at, map[string]any{"count": 10, "state": "ok"}); err != nil {
+			t.Fatalf("assert failed: %v", err)
+		}
+		if err := Track(cfg, "events", at, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+		if err := cfg.ShutdownBuffer(); err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+
+		values, err := Values(cfg, "events", at, at, "1h", false)
+		if err != nil {
+			t.Fatalf("values failed: %v", err)
+		}
+		count, _ := toFloat(values.Values[0]["count"])
+		results = append(results, count)
+	}
+	if results[0] != 11.0 || results[1] != 11.0 {
+		t.Fatalf("expected 11 with and without buffering, got %v", results)
+	}
+}
+
+func TestBuffer_UntrackedOperationsFoldWithTracked(t *testing.T) {
+	type step struct {
+		assert    bool
+		untracked bool
+		count     int
+	}
+	scenarios := map[string][]step{
+		"assert, track, assert":       {{true, true, 5}, {false, false, 1}, {true, true, 7}},
+		"track, assert, track":        {{false, false, 3}, {true, true, 5}, {false, false, 2}},
+		"assert across tracking keys": {{true, false, 1}, {true, true, 5}, {true, false, 7}},
+	}
+
+	at := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	for name, steps := range scenarios {
+		counts := []float64{}
+		systems := []map[string]any{}
+		for _, buffered := range []bool{false, true} {
+			driver := NewMemoryDriver(JoinedFull)
+			cfg := DefaultConfig()
+			cfg.Driver = driver
+			cfg.Granularities = []string{"1h"}
+			cfg.BufferEnabled = buffered
+			cfg.BufferAsync = false
+
+			for _, step := range steps {
+				opts := []TrackOption{}
+				if step.untracked {
+					opts = append(opts, Untracked())
+				}
+				write := Track
+				if step.assert {
+					write = Assert
+				}
+				if err := write(cfg, "x", at, map[string]any{"count": step.count}, opts...); err != nil {
+					t.Fatalf("%s: write failed: %v", name, err)
+				}
+			}
+			if err := cfg.ShutdownBuffer(); err != nil {
+				t.Fatalf("%s: shutdown failed: %v", name, err)
+			}
+
+			values, err := Values(cfg, "x", at, at, "1h", false)
+			if err != nil {
+				t.Fatalf("%s: values failed: %v", name, err)
+			}
+			count, _ := toFloat(values.Values[0]["count"])
+			counts = append(counts, count)
+			system, err := driver.Get([]Key{{Key: systemKeyName, Granularity: "1h", At: &at}})
+			if err != nil {
+				t.Fatalf("%s: get system values failed: %v", name, err)
+			}
+			systems = append(systems, Pack(system[0]))
+		}
+		if counts[0] != 7 || counts[1] != 7 {
+			t.Fatalf("%s: expected 7 with and without buffering, got %v", name, counts)
+		}
+		if !sameNumbers(systems[0], systems[1]) {
+			t.Fatalf("%s: expected system tracking %v, got %v", name, systems[0], systems[1])
+		}
+	}
+}
+
+func sameNumbers(want, got map[string]any) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for field, value := range want {
+		expected, _ := toFloat(value)
+		actual, ok := toFloat(got[field])
+		if !ok || expected != actual {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSignatureForSeparatesFields(t *testing.T) {
+	now := time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC)
+	a := Key{Prefix: "a:b", Key: "c", TrackingKey: "t", Granularity: "1h", At: &now}
+	b := Key{Prefix: "a", Key: "b:c", TrackingKey: "t", Granularity: "1h", At: &now}
+	if signatureFor("inc", []Key{a}) == signatureFor("inc", []Key{b}) {
+		t.Fatalf("expected distinct signatures for distinct keys")
+	}
+	if signatureFor("inc", []Key{a}) != signatureFor("inc", cloneKeys([]Key{a})) {
+		t.Fatalf("expected equal signatures for equal keys")
+	}
+}
+
+func BenchmarkBufferIncParallel(b *testing.B) {
+	buffer := NewBuffer(newBufferTestDriver(), BufferOptions{Size: 1 << 30, Aggregate: true})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+
+	names := make([]string, 64)
+	for idx := range names {
+		names[idx] = fmt.Sprintf("metric-%d", idx)
+	}
+	keys := bufferKeys(names...)
+	values := map[string]any{"count": 1}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_ = buffer.Inc(keys[i%len(keys)], values)
+			i++
+		}
+	})
+}
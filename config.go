@@ -1,6 +1,7 @@
 package triflestats
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -10,18 +11,43 @@ var DefaultGranularities = []string{"1m", "1h", "1d", "1w", "1mo", "1q", "1y"}
 
 // Config holds global configuration for Trifle Stats.
 type Config struct {
-	Driver            Driver
-	TimeZone          string
-	BeginningOfWeek   time.Weekday
-	Granularities     []string
-	Separator         string
-	JoinedIdentifier  JoinedIdentifier
-	BufferEnabled     bool
-	BufferDuration    time.Duration
-	BufferSize        int
-	BufferAggregate   bool
-	BufferAsync       bool
-	TimezoneLoadError error
+	Driver          Driver
+	TimeZone        string
+	BeginningOfWeek time.Weekday
+	// WeekMode switches week buckets to ISO-8601 weeks, which ignore
+	// BeginningOfWeek and always start on Monday.
+	WeekMode WeekMode
+	// DayStartOffset moves the start of every day, and so of weeks, months,
+	// quarters and years, from local midnight to this wall-clock time. Negative
+	// values start days on the previous date.
+	DayStartOffset time.Duration
+	// FiscalYearStartMonth is the month fiscal years start in for the fq and
+	// fy granularities, January when unset. FiscalCalendar picks their layout.
+	FiscalYearStartMonth time.Month
+	FiscalCalendar       FiscalCalendar
+	// Alignment set to AlignEpoch tiles multi-unit granularities from
+	// AlignmentAnchor, the start of 1970-01-01 in TimeZone when zero.
+	Alignment              Alignment
+	AlignmentAnchor        time.Time
+	Granularities          []string
+	Separator              string
+	JoinedIdentifier       JoinedIdentifier
+	BufferEnabled          bool
+	BufferDuration         time.Duration
+	BufferSize             int
+	BufferAggregate        bool
+	BufferAsync            bool
+	BufferJournalDir       string
+	BufferOnError          func(err error, actions int)
+	BufferMaxPending       int
+	BufferOverflow         OverflowPolicy
+	BufferBlockTimeout     time.Duration
+	BufferSpillDir         string
+	BufferShards           int
+	BufferFlushConcurrency int
+	BufferMaxAttempts      int
+	BufferRetryable        func(err error) bool
+	TimezoneLoadError      error
 
 	bufferMu sync.Mutex
 	storage  WriteStorage
@@ -105,17 +131,28 @@ func (c *Config) Storage() WriteStorage {
 		return nil
 	}
 
-	if c.buffer != nil && c.buffer.matches(c.Driver, c.BufferDuration, c.BufferSize, c.BufferAggregate, c.BufferAsync) {
+	opts := BufferOptions{
+		Duration:         c.BufferDuration,
+		Size:             c.BufferSize,
+		Aggregate:        c.BufferAggregate,
+		Async:            c.BufferAsync,
+		JournalDir:       c.BufferJournalDir,
+		OnError:          c.BufferOnError,
+		MaxPending:       c.BufferMaxPending,
+		Overflow:         c.BufferOverflow,
+		BlockTimeout:     c.BufferBlockTimeout,
+		SpillDir:         c.BufferSpillDir,
+		Shards:           c.BufferShards,
+		FlushConcurrency: c.BufferFlushConcurrency,
+		MaxAttempts:      c.BufferMaxAttempts,
+		Retryable:        c.BufferRetryable,
+	}
+	if c.buffer != nil && c.buffer.matches(c.Driver, opts) {
 		return c.storage
 	}
 
 	c.shutdownBufferLocked()
-	c.buffer = NewBuffer(c.Driver, BufferOptions{
-		Duration:  c.BufferDuration,
-		Size:      c.BufferSize,
-		Aggregate: c.BufferAggregate,
-		Async:     c.BufferAsync,
-	})
+	c.buffer = NewBuffer(c.Driver, opts)
 	c.storage = c.buffer
 	return c.storage
 }
@@ -135,6 +172,18 @@ func (c *Config) FlushBuffer() error {
 	return buffer.Flush()
 }
 
+// BufferStats reports the active buffer, or zero stats when buffering is off.
+func (c *Config) BufferStats() BufferStats {
+	if c == nil {
+		return BufferStats{}
+	}
+
+	c.bufferMu.Lock()
+	buffer := c.buffer
+	c.bufferMu.Unlock()
+	return buffer.Stats()
+}
+
 // ShutdownBuffer flushes and stops the buffer worker.
 func (c *Config) ShutdownBuffer() error {
 	if c == nil {
@@ -152,6 +201,24 @@ func (c *Config) ShutdownBuffer() error {
 	return buffer.Shutdown()
 }
 
+// ShutdownBufferContext flushes and stops the buffer worker, giving up once
+// ctx is done. See Buffer.ShutdownContext for what happens to the remainder.
+func (c *Config) ShutdownBufferContext(ctx context.Context) (ShutdownReport, error) {
+	if c == nil {
+		return ShutdownReport{}, nil
+	}
+
+	c.bufferMu.Lock()
+	buffer := c.buffer
+	c.buffer = nil
+	c.storage = nil
+	c.bufferMu.Unlock()
+	if buffer == nil {
+		return ShutdownReport{}, nil
+	}
+	return buffer.ShutdownContext(ctx)
+}
+
 func (c *Config) shutdownBufferLocked() {
 	if c.buffer == nil {
 		c.storage = nil
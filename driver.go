@@ -1,5 +1,12 @@
 package triflestats
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
 // JoinedIdentifier represents identifier mode.
 type JoinedIdentifier int
 
@@ -43,3 +50,88 @@ type CountDriver interface {
 	IncCount(keys []Key, values map[string]any, count int64) error
 	SetCount(keys []Key, values map[string]any, count int64) error
 }
+
+// ContextDriver extends drivers with context-aware reads and writes so request
+// deadlines and cancellations reach the storage backend.
+type ContextDriver interface {
+	IncContext(ctx context.Context, keys []Key, values map[string]any) error
+	SetContext(ctx context.Context, keys []Key, values map[string]any) error
+	GetContext(ctx context.Context, keys []Key) ([]map[string]any, error)
+}
+
+// ContextCountDriver is the context-aware counterpart of CountDriver.
+type ContextCountDriver interface {
+	IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error
+	SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error
+}
+
+// BatchOperation is one write of a batch passed to BatchDriver. Count is the
+// number of operations it stands for in system tracking.
+type BatchOperation struct {
+	Operation string
+	Keys      []Key
+	Values    map[string]any
+	Count     int64
+}
+
+// BatchDriver extends drivers with writing many operations in one round trip,
+// used by Buffer to flush a drained queue at once. Operations apply in order.
+// A batch that may be written in part fails with a *BatchError. Any other
+// error means no operation was written.
+type BatchDriver interface {
+	WriteBatch(ctx context.Context, operations []BatchOperation) error
+}
+
+// ErrBatchAborted marks batch operations skipped after an earlier one failed.
+var ErrBatchAborted = errors.New("batch aborted before operation")
+
+// BatchError reports a batch written in part. Errs holds an entry per
+// operation: nil when it was written, otherwise why it was not.
+type BatchError struct {
+	Errs []error
+}
+
+// Error describes the first operation that failed on its own.
+func (e *BatchError) Error() string {
+	for idx, err := range e.Errs {
+		if err != nil && !errors.Is(err, ErrBatchAborted) {
+			return fmt.Sprintf("batch operation %d: %v", idx, err)
+		}
+	}
+	return ErrBatchAborted.Error()
+}
+
+// Unwrap returns the errors of the operations that were not written.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// singleBatchError returns the error of a one-operation batch as is, for
+// drivers whose single writes go through WriteBatch.
+func singleBatchError(err error) error {
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Errs) == 1 {
+		return batchErr.Errs[0]
+	}
+	return err
+}
+
+// PingDriver extends drivers with status snapshots used by Beam/Scan. Each key
+// keeps only its latest snapshot, stored apart from the time series.
+type PingDriver interface {
+	Ping(ctx context.Context, key string, at time.Time, values map[string]any) error
+	Scan(ctx context.Context, key string) (ValuesResult, error)
+}
+
+func ensureContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
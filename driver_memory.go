@@ -0,0 +1,426 @@
+package triflestats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryDriver implements the Driver interface in process memory. It keeps the
+// same identifier and system tracking semantics as the SQL drivers, which makes
+// it suitable for tests and short-lived tools. Snapshot and Restore persist its
+// contents as JSON.
+type MemoryDriver struct {
+	Separator        string
+	JoinedIdentifier JoinedIdentifier
+	SystemTracking   bool
+
+	mu    sync.RWMutex
+	rows  map[string]*memoryRow
+	pings map[string]*memoryPing
+}
+
+type memoryRow struct {
+	Key         string         `json:"key"`
+	Granularity string         `json:"granularity,omitempty"`
+	At          *time.Time     `json:"at,omitempty"`
+	Data        map[string]any `json:"data"`
+}
+
+type memoryPing struct {
+	Key  string         `json:"key"`
+	At   time.Time      `json:"at"`
+	Data map[string]any `json:"data"`
+}
+
+type memorySnapshot struct {
+	Rows  []*memoryRow  `json:"rows"`
+	Pings []*memoryPing `json:"pings"`
+}
+
+// NewMemoryDriver creates an empty in-memory driver.
+func NewMemoryDriver(joinedIdentifier JoinedIdentifier) *MemoryDriver {
+	return &MemoryDriver{
+		Separator:        "::",
+		JoinedIdentifier: joinedIdentifier,
+		SystemTracking:   true,
+		rows:             map[string]*memoryRow{},
+		pings:            map[string]*memoryPing{},
+	}
+}
+
+func (d *MemoryDriver) Description() string {
+	mode := "J"
+	if d.JoinedIdentifier == JoinedPartial {
+		mode = "P"
+	} else if d.JoinedIdentifier == JoinedSeparated {
+		mode = "S"
+	}
+	return fmt.Sprintf("MemoryDriver(%s)", mode)
+}
+
+// Inc increments numeric values in-place.
+func (d *MemoryDriver) Inc(keys []Key, values map[string]any) error {
+	return d.IncCount(keys, values, 1)
+}
+
+// IncContext increments numeric values in-place using ctx.
+func (d *MemoryDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.IncCountContext(ctx, keys, values, 1)
+}
+
+// IncCount increments values and records system tracking count.
+func (d *MemoryDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
+
+// IncCountContext increments values and records system tracking count using ctx.
+func (d *MemoryDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	if count <= 0 {
+		count = 1
+	}
+	return d.writeWithOperation(ctx, keys, values, "inc", count)
+}
+
+// Set sets provided values without deleting other keys.
+func (d *MemoryDriver) Set(keys []Key, values map[string]any) error {
+	return d.SetCount(keys, values, 1)
+}
+
+// SetContext sets provided values without deleting other keys using ctx.
+func (d *MemoryDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.SetCountContext(ctx, keys, values, 1)
+}
+
+// SetCount sets provided values and records system tracking count.
+func (d *MemoryDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext sets provided values and records system tracking count using ctx.
+func (d *MemoryDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	if count <= 0 {
+		count = 1
+	}
+	return d.writeWithOperation(ctx, keys, values, "set", count)
+}
+
+// Get fetches values for keys in order.
+func (d *MemoryDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values for keys in order using ctx.
+func (d *MemoryDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	ctx = ensureContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	results := make([]map[string]any, 0, len(keys))
+	for _, key := range keys {
+		row, err := d.rowFor(key)
+		if err != nil {
+			return nil, err
+		}
+		stored, ok := d.rows[memoryLookup(row)]
+		if !ok {
+			results = append(results, map[string]any{})
+			continue
+		}
+		results = append(results, Unpack(cloneMap(stored.Data)))
+	}
+	return results, nil
+}
+
+// Ping replaces the status snapshot of a key.
+func (d *MemoryDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	packed := Pack(values)
+	data := make(map[string]any, len(packed))
+	for field, value := range packed {
+		data[field] = memoryValue(value)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ensureStorage()
+	d.pings[key] = &memoryPing{Key: key, At: at.UTC(), Data: data}
+	return nil
+}
+
+// Scan reads the status snapshot of a key.
+func (d *MemoryDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return ValuesResult{}, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	ping, ok := d.pings[key]
+	if !ok {
+		return emptyScanResult(), nil
+	}
+	return scanResultFor(ping.At, Unpack(cloneMap(ping.Data))), nil
+}
+
+// Snapshot writes the stored buckets and status snapshots to w as JSON.
+func (d *MemoryDriver) Snapshot(w io.Writer) error {
+	d.mu.RLock()
+	snapshot := memorySnapshot{
+		Rows:  make([]*memoryRow, 0, len(d.rows)),
+		Pings: make([]*memoryPing, 0, len(d.pings)),
+	}
+	for _, lookup := range slices.Sorted(maps.Keys(d.rows)) {
+		snapshot.Rows = append(snapshot.Rows, d.rows[lookup])
+	}
+	for _, key := range slices.Sorted(maps.Keys(d.pings)) {
+		snapshot.Pings = append(snapshot.Pings, d.pings[key])
+	}
+	payload, err := json.Marshal(snapshot)
+	d.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(payload)
+	return err
+}
+
+// Restore replaces the driver contents with a snapshot read from r.
+func (d *MemoryDriver) Restore(r io.Reader) error {
+	var snapshot memorySnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("restore memory snapshot: %w", err)
+	}
+
+	rows := make(map[string]*memoryRow, len(snapshot.Rows))
+	for _, row := range snapshot.Rows {
+		if row == nil {
+			continue
+		}
+		if row.Data == nil {
+			row.Data = map[string]any{}
+		}
+		rows[memoryLookup(row)] = row
+	}
+	pings := make(map[string]*memoryPing, len(snapshot.Pings))
+	for _, ping := range snapshot.Pings {
+		if ping == nil {
+			continue
+		}
+		if ping.Data == nil {
+			ping.Data = map[string]any{}
+		}
+		pings[ping.Key] = ping
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rows = rows
+	d.pings = pings
+	return nil
+}
+
+func (d *MemoryDriver) writeWithOperation(ctx context.Context, keys []Key, values map[string]any, op string, count int64) error {
+	return d.WriteBatch(ctx, []BatchOperation{{Operation: op, Keys: keys, Values: values, Count: count}})
+}
+
+// memoryWrite is a validated operation ready to apply under the lock.
+type memoryWrite struct {
+	op         string
+	data       map[string]any
+	keys       []Key
+	rows       []*memoryRow
+	systemRows []*memoryRow
+	count      int64
+}
+
+// WriteBatch validates all operations, then applies them in order under a
+// single lock so readers never observe a partial batch.
+func (d *MemoryDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	ctx = ensureContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	writes := make([]memoryWrite, 0, len(operations))
+	for _, operation := range operations {
+		write, ok, err := d.prepareWrite(operation)
+		if err != nil {
+			return err
+		}
+		if ok {
+			writes = append(writes, write)
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ensureStorage()
+
+	for _, write := range writes {
+		for idx, row := range write.rows {
+			d.apply(row, write.data, write.op)
+			if d.SystemTracking {
+				systemData, _ := memoryData(systemDataFor(write.keys[idx].SystemTrackingKey(), write.count), "inc")
+				d.apply(write.systemRows[idx], systemData, "inc")
+			}
+		}
+	}
+	return nil
+}
+
+func (d *MemoryDriver) prepareWrite(operation BatchOperation) (memoryWrite, bool, error) {
+	if len(operation.Keys) == 0 {
+		return memoryWrite{}, false, nil
+	}
+
+	packed := Pack(operation.Values)
+	if len(packed) == 0 {
+		return memoryWrite{}, false, nil
+	}
+	data, err := memoryData(packed, operation.Operation)
+	if err != nil {
+		return memoryWrite{}, false, err
+	}
+
+	write := memoryWrite{
+		op:         operation.Operation,
+		data:       data,
+		keys:       operation.Keys,
+		rows:       make([]*memoryRow, 0, len(operation.Keys)),
+		systemRows: make([]*memoryRow, 0, len(operation.Keys)),
+		count:      max(operation.Count, 1),
+	}
+	for _, key := range operation.Keys {
+		row, err := d.rowFor(key)
+		if err != nil {
+			return memoryWrite{}, false, err
+		}
+		write.rows = append(write.rows, row)
+
+		if d.SystemTracking {
+			systemRow, err := d.rowFor(Key{
+				Key:         systemKeyName,
+				Granularity: key.Granularity,
+				At:          key.At,
+				TrackingKey: key.TrackingKey,
+			})
+			if err != nil {
+				return memoryWrite{}, false, err
+			}
+			write.systemRows = append(write.systemRows, systemRow)
+		}
+	}
+	return write, true, nil
+}
+
+func (d *MemoryDriver) apply(row *memoryRow, data map[string]any, op string) {
+	lookup := memoryLookup(row)
+	stored, ok := d.rows[lookup]
+	if !ok {
+		row.Data = map[string]any{}
+		d.rows[lookup] = row
+		stored = row
+	}
+
+	for field, value := range data {
+		if op == "inc" {
+			current, _ := toFloat(stored.Data[field])
+			stored.Data[field] = current + value.(float64)
+			continue
+		}
+		stored.Data[field] = value
+	}
+}
+
+func (d *MemoryDriver) ensureStorage() {
+	if d.rows == nil {
+		d.rows = map[string]*memoryRow{}
+	}
+	if d.pings == nil {
+		d.pings = map[string]*memoryPing{}
+	}
+}
+
+func (d *MemoryDriver) rowFor(k Key) (*memoryRow, error) {
+	switch d.JoinedIdentifier {
+	case JoinedPartial:
+		if k.At == nil {
+			return nil, fmt.Errorf("partial identifier requires At")
+		}
+		at := k.At.UTC()
+		return &memoryRow{Key: k.PartialJoin(d.Separator), At: &at}, nil
+	case JoinedSeparated:
+		if k.At == nil {
+			return nil, fmt.Errorf("separated identifier requires At")
+		}
+		at := k.At.UTC()
+		return &memoryRow{Key: k.Key, Granularity: k.Granularity, At: &at}, nil
+	default:
+		return &memoryRow{Key: k.Join(d.Separator)}, nil
+	}
+}
+
+func memoryLookup(row *memoryRow) string {
+	lookup := row.Key
+	if row.Granularity != "" {
+		lookup += "|" + row.Granularity
+	}
+	if row.At != nil {
+		lookup += "|" + formatAt(*row.At)
+	}
+	return lookup
+}
+
+// memoryData validates a packed payload up front so a rejected write leaves
+// the store untouched.
+func memoryData(packed map[string]any, op string) (map[string]any, error) {
+	data := make(map[string]any, len(packed))
+	for field, value := range packed {
+		switch op {
+		case "inc":
+			delta, ok := toFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("increment requires numeric value for key %q", field)
+			}
+			data[field] = delta
+		case "set":
+			data[field] = memoryValue(value)
+		default:
+			return nil, fmt.Errorf("invalid operation: %s", op)
+		}
+	}
+	return data, nil
+}
+
+// memoryValue stores numbers as float64, matching what JSON-backed drivers
+// return on read.
+func memoryValue(value any) any {
+	switch value.(type) {
+	case string, bool, nil:
+		return value
+	}
+	if f, ok := toFloat(value); ok {
+		return f
+	}
+	return value
+}
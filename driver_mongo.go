@@ -2,10 +2,12 @@ package triflestats
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -13,17 +15,24 @@ import (
 // MongoDriver implements the Driver interface using MongoDB documents.
 type MongoDriver struct {
 	Collection       *mongo.Collection
+	PingCollection   *mongo.Collection
 	Separator        string
 	JoinedIdentifier JoinedIdentifier
 	ExpireAfter      time.Duration
+	Retention        Retention
 	SystemTracking   bool
 	BulkWrite        bool
 }
 
 // NewMongoDriver creates a MongoDB driver.
 func NewMongoDriver(collection *mongo.Collection, joinedIdentifier JoinedIdentifier) *MongoDriver {
+	var pingCollection *mongo.Collection
+	if collection != nil {
+		pingCollection = collection.Database().Collection(collection.Name() + "_ping")
+	}
 	return &MongoDriver{
 		Collection:       collection,
+		PingCollection:   pingCollection,
 		Separator:        "::",
 		JoinedIdentifier: joinedIdentifier,
 		SystemTracking:   true,
@@ -64,14 +73,24 @@ func (d *MongoDriver) Setup(ctx context.Context) error {
 		})
 	}
 
-	if d.ExpireAfter > 0 {
+	if d.ExpireAfter > 0 || d.Retention.Enabled() {
 		indexes = append(indexes, mongo.IndexModel{
 			Keys:    bson.D{{Key: "expire_at", Value: 1}},
 			Options: options.Index().SetExpireAfterSeconds(0),
 		})
 	}
 
-	_, err := d.Collection.Indexes().CreateMany(ctx, indexes)
+	if _, err := d.Collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return err
+	}
+
+	if d.PingCollection == nil {
+		return nil
+	}
+	_, err := d.PingCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
 	return err
 }
 
@@ -90,12 +109,22 @@ func (d *MongoDriver) Inc(keys []Key, values map[string]any) error {
 	return d.IncCount(keys, values, 1)
 }
 
+// IncContext increments numeric values in-place using ctx.
+func (d *MongoDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.IncCountContext(ctx, keys, values, 1)
+}
+
 // IncCount increments values and records system tracking count.
 func (d *MongoDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
+
+// IncCountContext increments values and records system tracking count using ctx.
+func (d *MongoDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(context.Background(), keys, values, "inc", count)
+	return d.writeWithOperation(ctx, keys, values, "inc", count)
 }
 
 // Set writes values without deleting unspecified fields.
@@ -103,16 +132,33 @@ func (d *MongoDriver) Set(keys []Key, values map[string]any) error {
 	return d.SetCount(keys, values, 1)
 }
 
+// SetContext writes values without deleting unspecified fields using ctx.
+func (d *MongoDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.SetCountContext(ctx, keys, values, 1)
+}
+
 // SetCount writes values and records system tracking count.
 func (d *MongoDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext writes values and records system tracking count using ctx.
+func (d *MongoDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(context.Background(), keys, values, "set", count)
+	return d.writeWithOperation(ctx, keys, values, "set", count)
 }
 
 // Get fetches values for keys in order.
 func (d *MongoDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values for keys in order using ctx. Keys are looked up
+// with one Find per batch and matched back to their documents by identifier.
+func (d *MongoDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	ctx = ensureContext(ctx)
 	if len(keys) == 0 {
 		return []map[string]any{}, nil
 	}
@@ -120,59 +166,220 @@ func (d *MongoDriver) Get(keys []Key) ([]map[string]any, error) {
 		return nil, fmt.Errorf("mongo driver requires Collection")
 	}
 
-	ctx := context.Background()
-	results := make([]map[string]any, 0, len(keys))
+	filters := make([]bson.M, 0, len(keys))
+	identifiers := make([]string, 0, len(keys))
 	for _, key := range keys {
 		filter, err := d.identifierFilter(key)
 		if err != nil {
 			return nil, err
 		}
+		filters = append(filters, filter)
+		identifiers = append(identifiers, mongoIdentifier(filter))
+	}
 
-		var doc bson.M
-		err = d.Collection.FindOne(ctx, filter).Decode(&doc)
-		if err == mongo.ErrNoDocuments {
-			results = append(results, map[string]any{})
-			continue
-		}
-		if err != nil {
+	found := map[string]any{}
+	for start := 0; start < len(filters); start += getBatchSize {
+		end := min(start+getBatchSize, len(filters))
+		if err := d.findData(ctx, filters[start:end], found); err != nil {
 			return nil, err
 		}
+	}
 
-		data, ok := normalizeMongoValue(doc["data"]).(map[string]any)
+	results := make([]map[string]any, 0, len(keys))
+	for _, ident := range identifiers {
+		data, ok := normalizeMongoValue(found[ident]).(map[string]any)
 		if !ok || data == nil {
-			results = append(results, map[string]any{})
-			continue
+			data = map[string]any{}
 		}
 		results = append(results, data)
 	}
 	return results, nil
 }
 
+// findData loads the data of documents matching filters into found, keyed by
+// their identifier.
+func (d *MongoDriver) findData(ctx context.Context, filters []bson.M, found map[string]any) error {
+	var query bson.M
+	if d.JoinedIdentifier == JoinedPartial || d.JoinedIdentifier == JoinedSeparated {
+		query = bson.M{"$or": filters}
+	} else {
+		keys := make([]any, 0, len(filters))
+		for _, filter := range filters {
+			keys = append(keys, filter["key"])
+		}
+		query = bson.M{"key": bson.M{"$in": keys}}
+	}
+
+	projection := bson.M{"_id": 0, "key": 1, "granularity": 1, "at": 1, "data": 1}
+	cursor, err := d.Collection.Find(ctx, query, options.Find().SetProjection(projection))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		fields := bson.M{"key": doc["key"]}
+		for name := range filters[0] {
+			fields[name] = doc[name]
+		}
+		found[mongoIdentifier(fields)] = doc["data"]
+	}
+	return cursor.Err()
+}
+
+// mongoIdentifier joins the identifier fields of a filter or document. Times
+// compare at millisecond precision, as MongoDB stores them.
+func mongoIdentifier(fields bson.M) string {
+	ident := fmt.Sprint(fields["key"])
+	if granularity, ok := fields["granularity"]; ok {
+		ident += "\x1f" + fmt.Sprint(granularity)
+	}
+	switch at := fields["at"].(type) {
+	case time.Time:
+		ident += fmt.Sprintf("\x1f%d", at.UnixMilli())
+	case primitive.DateTime:
+		ident += fmt.Sprintf("\x1f%d", int64(at))
+	}
+	return ident
+}
+
+// Ping replaces the status snapshot document of a key in the ping collection.
+func (d *MongoDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
+	if d.PingCollection == nil {
+		return fmt.Errorf("mongo driver requires PingCollection")
+	}
+
+	document := bson.M{
+		"key":  key,
+		"at":   at.UTC(),
+		"data": Unpack(Pack(values)),
+	}
+	_, err := d.PingCollection.ReplaceOne(ctx, bson.M{"key": key}, document, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Scan reads the status snapshot document of a key from the ping collection.
+func (d *MongoDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	if d.PingCollection == nil {
+		return ValuesResult{}, fmt.Errorf("mongo driver requires PingCollection")
+	}
+
+	var doc struct {
+		At   time.Time `bson:"at"`
+		Data bson.M    `bson:"data"`
+	}
+	err := d.PingCollection.FindOne(ctx, bson.M{"key": key}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return emptyScanResult(), nil
+	}
+	if err != nil {
+		return ValuesResult{}, err
+	}
+
+	data, ok := normalizeMongoValue(doc.Data).(map[string]any)
+	if !ok || data == nil {
+		data = map[string]any{}
+	}
+	return scanResultFor(doc.At.UTC(), data), nil
+}
+
 func (d *MongoDriver) writeWithOperation(ctx context.Context, keys []Key, values map[string]any, op string, count int64) error {
-	if ctx == nil {
-		ctx = context.Background()
+	return singleBatchError(d.WriteBatch(ctx, []BatchOperation{{Operation: op, Keys: keys, Values: values, Count: count}}))
+}
+
+// WriteBatch writes operations in order, as a single ordered BulkWrite when
+// BulkWrite is enabled. An operation spans one document per key plus its
+// system tracking documents and MongoDB applies them without a transaction,
+// so a failure partway through an operation reports the whole operation as
+// failed even though its earlier documents were written. Retrying it applies
+// those documents again, double counting their increments.
+func (d *MongoDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	ctx = ensureContext(ctx)
+	pending := false
+	for _, operation := range operations {
+		if len(operation.Keys) > 0 {
+			pending = true
+			break
+		}
 	}
-	if len(keys) == 0 {
+	if !pending {
 		return nil
 	}
 	if d.Collection == nil {
 		return fmt.Errorf("mongo driver requires Collection")
 	}
 
-	packed := Pack(values)
-	if len(packed) == 0 {
+	models := []mongo.WriteModel{}
+	owners := []int{}
+	for idx, operation := range operations {
+		var err error
+		models, err = d.appendModels(models, operation.Keys, Pack(operation.Values), operation.Operation, max(operation.Count, 1))
+		if err != nil {
+			return err
+		}
+		for len(owners) < len(models) {
+			owners = append(owners, idx)
+		}
+	}
+
+	if len(models) == 0 {
 		return nil
 	}
+	if d.BulkWrite {
+		_, err := d.Collection.BulkWrite(ctx, models)
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 && bulkErr.WriteErrors[0].Index < len(owners) {
+			return partialBatchError(len(operations), owners, bulkErr.WriteErrors[0].Index, err)
+		}
+		return err
+	}
+	for idx, model := range models {
+		update, ok := model.(*mongo.UpdateOneModel)
+		if !ok {
+			continue
+		}
+		_, err := d.Collection.UpdateOne(ctx, update.Filter, update.Update, options.Update().SetUpsert(true))
+		if err != nil {
+			if idx == 0 {
+				return err
+			}
+			return partialBatchError(len(operations), owners, idx, err)
+		}
+	}
+	return nil
+}
+
+// partialBatchError reports an ordered write that stopped at model failed:
+// operations whose models all came before it were written, the operation
+// owning it failed with err, including any of its models already applied, and
+// later ones were never attempted.
+func partialBatchError(count int, owners []int, failed int, err error) error {
+	errs := make([]error, count)
+	for idx := owners[failed]; idx < count; idx++ {
+		errs[idx] = ErrBatchAborted
+	}
+	errs[owners[failed]] = err
+	return &BatchError{Errs: errs}
+}
 
-	models := make([]mongo.WriteModel, 0, len(keys)*2)
+func (d *MongoDriver) appendModels(models []mongo.WriteModel, keys []Key, packed map[string]any, op string, count int64) ([]mongo.WriteModel, error) {
+	if len(packed) == 0 {
+		return models, nil
+	}
 	for _, key := range keys {
 		filter, err := d.identifierFilter(key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		update, err := d.buildUpdateDocument(op, packed, key.At)
+		update, err := d.buildUpdateDocument(op, packed, key.Granularity, key.At)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
 
@@ -185,38 +392,21 @@ func (d *MongoDriver) writeWithOperation(ctx context.Context, keys []Key, values
 			}
 			systemFilter, err := d.identifierFilter(systemKey)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			systemPacked := systemDataFor(key.SystemTrackingKey(), count)
-			systemUpdate, err := d.buildUpdateDocument("inc", systemPacked, key.At)
+			systemUpdate, err := d.buildUpdateDocument("inc", systemPacked, key.Granularity, key.At)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			models = append(models, mongo.NewUpdateOneModel().SetFilter(systemFilter).SetUpdate(systemUpdate).SetUpsert(true))
 		}
 	}
 
-	if len(models) == 0 {
-		return nil
-	}
-	if d.BulkWrite {
-		_, err := d.Collection.BulkWrite(ctx, models)
-		return err
-	}
-	for _, model := range models {
-		update, ok := model.(*mongo.UpdateOneModel)
-		if !ok {
-			continue
-		}
-		_, err := d.Collection.UpdateOne(ctx, update.Filter, update.Update, options.Update().SetUpsert(true))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return models, nil
 }
 
-func (d *MongoDriver) buildUpdateDocument(op string, packed map[string]any, at *time.Time) (bson.M, error) {
+func (d *MongoDriver) buildUpdateDocument(op string, packed map[string]any, granularity string, at *time.Time) (bson.M, error) {
 	switch op {
 	case "inc":
 		inc := bson.M{}
@@ -228,7 +418,7 @@ func (d *MongoDriver) buildUpdateDocument(op string, packed map[string]any, at *
 			inc["data."+key] = delta
 		}
 		update := bson.M{"$inc": inc}
-		if expireAt := d.expireAtFor(at); expireAt != nil {
+		if expireAt := d.expireAtFor(granularity, at); expireAt != nil {
 			update["$set"] = bson.M{"expire_at": *expireAt}
 		}
 		return update, nil
@@ -237,7 +427,7 @@ func (d *MongoDriver) buildUpdateDocument(op string, packed map[string]any, at *
 		for key, value := range packed {
 			set["data."+key] = value
 		}
-		if expireAt := d.expireAtFor(at); expireAt != nil {
+		if expireAt := d.expireAtFor(granularity, at); expireAt != nil {
 			set["expire_at"] = *expireAt
 		}
 		return bson.M{"$set": set}, nil
@@ -246,12 +436,13 @@ func (d *MongoDriver) buildUpdateDocument(op string, packed map[string]any, at *
 	}
 }
 
-func (d *MongoDriver) expireAtFor(at *time.Time) *time.Time {
-	if d.ExpireAfter <= 0 || at == nil {
-		return nil
+// expireAtFor prefers the granularity's Retention entry and falls back to
+// ExpireAfter for granularities Retention does not mention.
+func (d *MongoDriver) expireAtFor(granularity string, at *time.Time) *time.Time {
+	if _, ok := d.Retention[granularity]; ok {
+		return d.Retention.ExpireAt(granularity, at)
 	}
-	expires := at.Add(d.ExpireAfter)
-	return &expires
+	return Retention{granularity: d.ExpireAfter}.ExpireAt(granularity, at)
 }
 
 func (d *MongoDriver) identifierFilter(k Key) (bson.M, error) {
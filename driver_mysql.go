@@ -1,23 +1,29 @@
 package triflestats
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 // MySQLDriver implements the Driver interface using MySQL JSON storage.
 type MySQLDriver struct {
 	DB               *sql.DB
 	TableName        string
+	PingTableName    string
 	Separator        string
 	JoinedIdentifier JoinedIdentifier
 	SystemTracking   bool
+	// Retention stamps expire_at on buckets for Purge to sweep. Setup adds the
+	// expire_at column to tables created before it existed.
+	Retention Retention
 }
 
 // NewMySQLDriver creates a new MySQL driver.
@@ -28,6 +34,7 @@ func NewMySQLDriver(db *sql.DB, tableName string, joinedIdentifier JoinedIdentif
 	return &MySQLDriver{
 		DB:               db,
 		TableName:        tableName,
+		PingTableName:    tableName + "_ping",
 		Separator:        "::",
 		JoinedIdentifier: joinedIdentifier,
 		SystemTracking:   true,
@@ -44,16 +51,32 @@ func (d *MySQLDriver) Setup() error {
 	table := quoteMySQLIdentifier(d.TableName)
 	switch d.JoinedIdentifier {
 	case JoinedFull:
-		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) PRIMARY KEY, `data` JSON NOT NULL);", table)
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) PRIMARY KEY, `data` JSON NOT NULL, `expire_at` DATETIME(6) NULL);", table)
 	case JoinedPartial:
-		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) NOT NULL, `at` DATETIME(6) NOT NULL, `data` JSON NOT NULL, PRIMARY KEY (`key`, `at`));", table)
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) NOT NULL, `at` DATETIME(6) NOT NULL, `data` JSON NOT NULL, `expire_at` DATETIME(6) NULL, PRIMARY KEY (`key`, `at`));", table)
 	case JoinedSeparated:
-		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) NOT NULL, `granularity` VARCHAR(255) NOT NULL, `at` DATETIME(6) NOT NULL, `data` JSON NOT NULL, PRIMARY KEY (`key`, `granularity`, `at`));", table)
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) NOT NULL, `granularity` VARCHAR(255) NOT NULL, `at` DATETIME(6) NOT NULL, `data` JSON NOT NULL, `expire_at` DATETIME(6) NULL, PRIMARY KEY (`key`, `granularity`, `at`));", table)
 	default:
-		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) PRIMARY KEY, `data` JSON NOT NULL);", table)
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) PRIMARY KEY, `data` JSON NOT NULL, `expire_at` DATETIME(6) NULL);", table)
 	}
 
-	_, err := d.DB.Exec(query)
+	if _, err := d.DB.Exec(query); err != nil {
+		return err
+	}
+	if d.Retention.Enabled() {
+		var mysqlErr *mysql.MySQLError
+		columnQuery := fmt.Sprintf("ALTER TABLE %s ADD COLUMN `expire_at` DATETIME(6) NULL;", table)
+		if _, err := d.DB.Exec(columnQuery); err != nil && !(errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateFieldName) {
+			return err
+		}
+		indexQuery := fmt.Sprintf("CREATE INDEX %s ON %s (`expire_at`);", quoteMySQLIdentifier(d.TableName+"_expire_at_idx"), table)
+		if _, err := d.DB.Exec(indexQuery); err != nil && !(errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateKeyName) {
+			return err
+		}
+	}
+
+	pingQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (`key` VARCHAR(255) PRIMARY KEY, `at` DATETIME(6) NOT NULL, `data` JSON NOT NULL);", quoteMySQLIdentifier(d.PingTableName))
+	_, err := d.DB.Exec(pingQuery)
 	return err
 }
 
@@ -72,12 +95,22 @@ func (d *MySQLDriver) Inc(keys []Key, values map[string]any) error {
 	return d.IncCount(keys, values, 1)
 }
 
+// IncContext increments numeric values in-place using ctx.
+func (d *MySQLDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.IncCountContext(ctx, keys, values, 1)
+}
+
 // IncCount increments values and records system tracking count.
 func (d *MySQLDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
+
+// IncCountContext increments values and records system tracking count using ctx.
+func (d *MySQLDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(keys, values, "inc", count)
+	return d.writeWithOperation(ctx, keys, values, "inc", count)
 }
 
 // Set sets provided values without deleting unspecified keys.
@@ -85,16 +118,32 @@ func (d *MySQLDriver) Set(keys []Key, values map[string]any) error {
 	return d.SetCount(keys, values, 1)
 }
 
+// SetContext sets provided values without deleting unspecified keys using ctx.
+func (d *MySQLDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.SetCountContext(ctx, keys, values, 1)
+}
+
 // SetCount sets values and records system tracking count.
 func (d *MySQLDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext sets values and records system tracking count using ctx.
+func (d *MySQLDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(keys, values, "set", count)
+	return d.writeWithOperation(ctx, keys, values, "set", count)
 }
 
 // Get fetches values for keys in order.
 func (d *MySQLDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values for keys in order using ctx.
+func (d *MySQLDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	ctx = ensureContext(ctx)
 	if len(keys) == 0 {
 		return []map[string]any{}, nil
 	}
@@ -111,18 +160,33 @@ func (d *MySQLDriver) Get(keys []Key) ([]map[string]any, error) {
 		identifiers = append(identifiers, ident)
 	}
 
+	resultMap := map[string]map[string]any{}
+	for start := 0; start < len(identifiers); start += getBatchSize {
+		end := min(start+getBatchSize, len(identifiers))
+		if err := d.fetchPacked(ctx, identifiers[start:end], resultMap); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]map[string]any, 0, len(keys))
+	for _, ident := range identifiers {
+		results = append(results, Unpack(resultMap[ident.lookupKey]))
+	}
+	return results, nil
+}
+
+func (d *MySQLDriver) fetchPacked(ctx context.Context, identifiers []identifier, resultMap map[string]map[string]any) error {
 	query, args := buildMySQLGetQuery(d.TableName, d.JoinedIdentifier, identifiers)
-	rows, err := d.DB.Query(query, args...)
+	rows, err := d.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	resultMap := map[string]map[string]any{}
 	for rows.Next() {
 		lookup, dataJSON, err := scanMySQLRow(d.JoinedIdentifier, rows)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		var packed map[string]any
@@ -133,35 +197,97 @@ func (d *MySQLDriver) Get(keys []Key) ([]map[string]any, error) {
 		}
 		resultMap[lookup] = packed
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return rows.Err()
+}
+
+// Ping replaces the status snapshot of a key in the ping table.
+func (d *MySQLDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return fmt.Errorf("mysql driver requires DB")
 	}
 
-	results := make([]map[string]any, 0, len(keys))
-	for _, key := range keys {
-		ident, err := d.identifierForKey(key)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, Unpack(resultMap[ident.lookupKey]))
+	dataJSON, err := json.Marshal(Pack(values))
+	if err != nil {
+		return err
 	}
-	return results, nil
+	query := fmt.Sprintf(
+		"INSERT INTO %s (`key`, `at`, `data`) VALUES (?, ?, CAST(? AS JSON)) ON DUPLICATE KEY UPDATE `at` = ?, `data` = CAST(? AS JSON);",
+		quoteMySQLIdentifier(d.PingTableName),
+	)
+	formattedAt := formatMySQLAt(at)
+	_, err = d.DB.ExecContext(ctx, query, key, formattedAt, string(dataJSON), formattedAt, string(dataJSON))
+	return err
 }
 
-func (d *MySQLDriver) writeWithOperation(keys []Key, values map[string]any, op string, count int64) error {
-	if len(keys) == 0 {
-		return nil
+// Scan reads the status snapshot of a key from the ping table.
+func (d *MySQLDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return ValuesResult{}, fmt.Errorf("mysql driver requires DB")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT `at`, CAST(`data` AS CHAR) AS data FROM %s WHERE `key` = ? LIMIT 1;",
+		quoteMySQLIdentifier(d.PingTableName),
+	)
+	var atRaw any
+	var dataJSON string
+	if err := d.DB.QueryRowContext(ctx, query, key).Scan(&atRaw, &dataJSON); err != nil {
+		if err == sql.ErrNoRows {
+			return emptyScanResult(), nil
+		}
+		return ValuesResult{}, err
+	}
+	at, err := parseMySQLAtValue(atRaw)
+	if err != nil {
+		return ValuesResult{}, err
+	}
+
+	var packed map[string]any
+	if err := json.Unmarshal([]byte(dataJSON), &packed); err != nil {
+		packed = map[string]any{}
 	}
+	return scanResultFor(at, Unpack(packed)), nil
+}
+
+// Purge deletes buckets whose retention has elapsed and returns how many rows
+// were removed.
+func (d *MySQLDriver) Purge(ctx context.Context) (int64, error) {
+	ctx = ensureContext(ctx)
 	if d.DB == nil {
-		return fmt.Errorf("mysql driver requires DB")
+		return 0, fmt.Errorf("mysql driver requires DB")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE `expire_at` <= ?;", quoteMySQLIdentifier(d.TableName))
+	result, err := d.DB.ExecContext(ctx, query, formatMySQLAt(time.Now()))
+	if err != nil {
+		return 0, err
 	}
+	return result.RowsAffected()
+}
+
+func (d *MySQLDriver) writeWithOperation(ctx context.Context, keys []Key, values map[string]any, op string, count int64) error {
+	return d.WriteBatch(ctx, []BatchOperation{{Operation: op, Keys: keys, Values: values, Count: count}})
+}
 
-	packed := Pack(values)
-	if len(packed) == 0 {
+// WriteBatch writes operations within a single transaction. Rows are written
+// in identifier order, with writes to the same row kept in operation order,
+// so concurrent batches do not deadlock.
+func (d *MySQLDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	ctx = ensureContext(ctx)
+	writes, err := orderedRowWrites(operations, d.Retention, d.SystemTracking, d.identifierForKey)
+	if err != nil {
+		return err
+	}
+	if len(writes) == 0 {
 		return nil
 	}
+	if d.DB == nil {
+		return fmt.Errorf("mysql driver requires DB")
+	}
 
-	tx, err := d.DB.Begin()
+	tx, err := d.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -169,45 +295,15 @@ func (d *MySQLDriver) writeWithOperation(keys []Key, values map[string]any, op s
 		_ = tx.Rollback()
 	}()
 
-	for _, key := range keys {
-		ident, err := d.identifierForKey(key)
-		if err != nil {
-			return err
-		}
-		query, args, err := buildMySQLWriteQuery(d.TableName, ident, packed, op)
+	for _, write := range writes {
+		query, args, err := buildMySQLWriteQuery(d.TableName, write.ident, write.packed, write.op, write.expireAt)
 		if err != nil {
 			return err
 		}
-		if _, err := tx.Exec(query, args...); err != nil {
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
 			return err
 		}
-
-		if d.SystemTracking {
-			systemKey := Key{
-				Key:         systemKeyName,
-				Granularity: key.Granularity,
-				At:          key.At,
-				TrackingKey: key.TrackingKey,
-			}
-			systemIdent, err := d.identifierForKey(systemKey)
-			if err != nil {
-				return err
-			}
-			systemQuery, systemArgs, err := buildMySQLWriteQuery(
-				d.TableName,
-				systemIdent,
-				systemDataFor(key.SystemTrackingKey(), count),
-				"inc",
-			)
-			if err != nil {
-				return err
-			}
-			if _, err := tx.Exec(systemQuery, systemArgs...); err != nil {
-				return err
-			}
-		}
 	}
-
 	return tx.Commit()
 }
 
@@ -251,13 +347,15 @@ func (d *MySQLDriver) identifierForKey(k Key) (identifier, error) {
 	}
 }
 
-func buildMySQLWriteQuery(table string, ident identifier, packed map[string]any, op string) (string, []any, error) {
-	columns := ident.columns
+func buildMySQLWriteQuery(table string, ident identifier, packed map[string]any, op string, expireAt *time.Time) (string, []any, error) {
+	columns := append(append([]string{}, ident.columns...), "data")
+	if expireAt != nil {
+		columns = append(columns, "expire_at")
+	}
 	quotedColumns := make([]string, 0, len(columns))
 	for _, column := range columns {
 		quotedColumns = append(quotedColumns, quoteMySQLIdentifier(column))
 	}
-	colList := strings.Join(quotedColumns, ", ")
 	placeholders := make([]string, 0, len(columns)+1)
 	args := make([]any, 0, len(columns)+1+len(packed))
 
@@ -272,23 +370,38 @@ func buildMySQLWriteQuery(table string, ident identifier, packed map[string]any,
 	}
 	placeholders = append(placeholders, "CAST(? AS JSON)")
 	args = append(args, string(batchJSON))
+	if expireAt != nil {
+		placeholders = append(placeholders, "?")
+		args = append(args, formatMySQLAt(*expireAt))
+	}
 
 	jsonExpr, exprArgs, err := buildMySQLJSONExpression(packed, op)
 	if err != nil {
 		return "", nil, err
 	}
 	args = append(args, exprArgs...)
+	update := "`data` = " + jsonExpr
+	if expireAt != nil {
+		update += ", `expire_at` = ?"
+		args = append(args, formatMySQLAt(*expireAt))
+	}
 
 	query := fmt.Sprintf(
-		"INSERT INTO %s (%s, `data`) VALUES (%s) ON DUPLICATE KEY UPDATE `data` = %s;",
+		"INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s;",
 		quoteMySQLIdentifier(table),
-		colList,
+		strings.Join(quotedColumns, ", "),
 		strings.Join(placeholders, ", "),
-		jsonExpr,
+		update,
 	)
 	return query, args, nil
 }
 
+// mysqlDuplicateKeyName is the error MySQL raises when an index already exists.
+const mysqlDuplicateKeyName = 1061
+
+// mysqlDuplicateFieldName is the error MySQL raises when a column already exists.
+const mysqlDuplicateFieldName = 1060
+
 func buildMySQLJSONExpression(packed map[string]any, op string) (string, []any, error) {
 	keys := make([]string, 0, len(packed))
 	for key := range packed {
@@ -1,10 +1,13 @@
 package triflestats
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
@@ -17,6 +20,9 @@ type PostgresDriver struct {
 	Separator        string
 	JoinedIdentifier JoinedIdentifier
 	SystemTracking   bool
+	// Retention stamps expire_at on buckets for Purge to sweep. Setup adds the
+	// expire_at column to tables created before it existed.
+	Retention Retention
 }
 
 // NewPostgresDriver creates a PostgreSQL driver.
@@ -43,16 +49,31 @@ func (d *PostgresDriver) Setup() error {
 	var query string
 	switch d.JoinedIdentifier {
 	case JoinedFull:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) PRIMARY KEY, data JSONB NOT NULL DEFAULT '{}'::jsonb);`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) PRIMARY KEY, data JSONB NOT NULL DEFAULT '{}'::jsonb, expire_at TIMESTAMPTZ);`, d.TableName)
 	case JoinedPartial:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) NOT NULL, at TIMESTAMPTZ NOT NULL, data JSONB NOT NULL DEFAULT '{}'::jsonb, PRIMARY KEY (key, at));`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) NOT NULL, at TIMESTAMPTZ NOT NULL, data JSONB NOT NULL DEFAULT '{}'::jsonb, expire_at TIMESTAMPTZ, PRIMARY KEY (key, at));`, d.TableName)
 	case JoinedSeparated:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) NOT NULL, granularity VARCHAR(255) NOT NULL, at TIMESTAMPTZ NOT NULL, data JSONB NOT NULL DEFAULT '{}'::jsonb, PRIMARY KEY (key, granularity, at));`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) NOT NULL, granularity VARCHAR(255) NOT NULL, at TIMESTAMPTZ NOT NULL, data JSONB NOT NULL DEFAULT '{}'::jsonb, expire_at TIMESTAMPTZ, PRIMARY KEY (key, granularity, at));`, d.TableName)
 	default:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) PRIMARY KEY, data JSONB NOT NULL DEFAULT '{}'::jsonb);`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) PRIMARY KEY, data JSONB NOT NULL DEFAULT '{}'::jsonb, expire_at TIMESTAMPTZ);`, d.TableName)
 	}
 
-	_, err := d.DB.Exec(query)
+	if _, err := d.DB.Exec(query); err != nil {
+		return err
+	}
+	if d.Retention.Enabled() {
+		columnQuery := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS expire_at TIMESTAMPTZ;`, d.TableName)
+		if _, err := d.DB.Exec(columnQuery); err != nil {
+			return err
+		}
+		indexQuery := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_expire_at_idx ON %s (expire_at);`, d.TableName, d.TableName)
+		if _, err := d.DB.Exec(indexQuery); err != nil {
+			return err
+		}
+	}
+
+	pingQuery := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key VARCHAR(255) PRIMARY KEY, at TIMESTAMPTZ NOT NULL, data JSONB NOT NULL DEFAULT '{}'::jsonb);`, d.PingTableName)
+	_, err := d.DB.Exec(pingQuery)
 	return err
 }
 
@@ -71,12 +92,22 @@ func (d *PostgresDriver) Inc(keys []Key, values map[string]any) error {
 	return d.IncCount(keys, values, 1)
 }
 
+// IncContext increments numeric values in-place using ctx.
+func (d *PostgresDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.IncCountContext(ctx, keys, values, 1)
+}
+
 // IncCount increments values and records system tracking count.
 func (d *PostgresDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
+
+// IncCountContext increments values and records system tracking count using ctx.
+func (d *PostgresDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(keys, values, "inc", count)
+	return d.writeWithOperation(ctx, keys, values, "inc", count)
 }
 
 // Set sets provided values without deleting other keys.
@@ -84,16 +115,32 @@ func (d *PostgresDriver) Set(keys []Key, values map[string]any) error {
 	return d.SetCount(keys, values, 1)
 }
 
+// SetContext sets provided values without deleting other keys using ctx.
+func (d *PostgresDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.SetCountContext(ctx, keys, values, 1)
+}
+
 // SetCount sets provided values and records system tracking count.
 func (d *PostgresDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext sets provided values and records system tracking count using ctx.
+func (d *PostgresDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(keys, values, "set", count)
+	return d.writeWithOperation(ctx, keys, values, "set", count)
 }
 
 // Get fetches values in key order.
 func (d *PostgresDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values in key order using ctx.
+func (d *PostgresDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	ctx = ensureContext(ctx)
 	if len(keys) == 0 {
 		return []map[string]any{}, nil
 	}
@@ -101,36 +148,135 @@ func (d *PostgresDriver) Get(keys []Key) ([]map[string]any, error) {
 		return nil, fmt.Errorf("postgres driver requires DB")
 	}
 
-	results := make([]map[string]any, 0, len(keys))
+	identifiers := make([]identifier, 0, len(keys))
 	for _, key := range keys {
 		ident, err := d.identifierForKey(key)
 		if err != nil {
 			return nil, err
 		}
+		identifiers = append(identifiers, ident)
+	}
 
-		packed, err := d.readPacked(nil, ident)
-		if err != nil {
+	resultMap := map[string]map[string]any{}
+	for start := 0; start < len(identifiers); start += getBatchSize {
+		end := min(start+getBatchSize, len(identifiers))
+		if err := d.fetchPacked(ctx, identifiers[start:end], resultMap); err != nil {
 			return nil, err
 		}
-		results = append(results, Unpack(packed))
+	}
+
+	results := make([]map[string]any, 0, len(keys))
+	for _, ident := range identifiers {
+		results = append(results, Unpack(resultMap[ident.lookupKey]))
 	}
 	return results, nil
 }
 
-func (d *PostgresDriver) writeWithOperation(keys []Key, values map[string]any, op string, count int64) error {
-	if len(keys) == 0 {
-		return nil
+func (d *PostgresDriver) fetchPacked(ctx context.Context, identifiers []identifier, resultMap map[string]map[string]any) error {
+	query, args := buildPostgresGetQuery(d.TableName, d.JoinedIdentifier, identifiers)
+	rows, err := d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		lookup, raw, err := scanPostgresRow(d.JoinedIdentifier, rows)
+		if err != nil {
+			return err
+		}
+
+		var packed map[string]any
+		if len(raw) == 0 {
+			packed = map[string]any{}
+		} else if err := json.Unmarshal(raw, &packed); err != nil {
+			packed = map[string]any{}
+		}
+		resultMap[lookup] = packed
 	}
+	return rows.Err()
+}
+
+// Ping replaces the status snapshot of a key in the ping table.
+func (d *PostgresDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
 	if d.DB == nil {
 		return fmt.Errorf("postgres driver requires DB")
 	}
 
-	packed := Pack(values)
-	if len(packed) == 0 {
+	dataJSON, err := json.Marshal(Pack(values))
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(
+		`INSERT INTO %s (key, at, data) VALUES ($1, $2, $3::jsonb) ON CONFLICT (key) DO UPDATE SET at = EXCLUDED.at, data = EXCLUDED.data;`,
+		d.PingTableName,
+	)
+	_, err = d.DB.ExecContext(ctx, query, key, at.UTC(), string(dataJSON))
+	return err
+}
+
+// Scan reads the status snapshot of a key from the ping table.
+func (d *PostgresDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return ValuesResult{}, fmt.Errorf("postgres driver requires DB")
+	}
+
+	query := fmt.Sprintf(`SELECT at, data FROM %s WHERE key = $1 LIMIT 1;`, d.PingTableName)
+	var at time.Time
+	var raw []byte
+	if err := d.DB.QueryRowContext(ctx, query, key).Scan(&at, &raw); err != nil {
+		if err == sql.ErrNoRows {
+			return emptyScanResult(), nil
+		}
+		return ValuesResult{}, err
+	}
+
+	var packed map[string]any
+	if err := json.Unmarshal(raw, &packed); err != nil {
+		packed = map[string]any{}
+	}
+	return scanResultFor(at, Unpack(packed)), nil
+}
+
+// Purge deletes buckets whose retention has elapsed and returns how many rows
+// were removed.
+func (d *PostgresDriver) Purge(ctx context.Context) (int64, error) {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return 0, fmt.Errorf("postgres driver requires DB")
+	}
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE expire_at <= $1;`, d.TableName)
+	result, err := d.DB.ExecContext(ctx, query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (d *PostgresDriver) writeWithOperation(ctx context.Context, keys []Key, values map[string]any, op string, count int64) error {
+	return d.WriteBatch(ctx, []BatchOperation{{Operation: op, Keys: keys, Values: values, Count: count}})
+}
+
+// WriteBatch writes operations within a single transaction. Rows are written
+// in identifier order, with writes to the same row kept in operation order,
+// so concurrent batches do not deadlock.
+func (d *PostgresDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	ctx = ensureContext(ctx)
+	writes, err := orderedRowWrites(operations, d.Retention, d.SystemTracking, d.identifierForKey)
+	if err != nil {
+		return err
+	}
+	if len(writes) == 0 {
 		return nil
 	}
+	if d.DB == nil {
+		return fmt.Errorf("postgres driver requires DB")
+	}
 
-	tx, err := d.DB.Begin()
+	tx, err := d.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -138,48 +284,15 @@ func (d *PostgresDriver) writeWithOperation(keys []Key, values map[string]any, o
 		_ = tx.Rollback()
 	}()
 
-	for _, key := range keys {
-		ident, err := d.identifierForKey(key)
-		if err != nil {
-			return err
-		}
-		existing, err := d.readPacked(tx, ident)
+	for _, write := range writes {
+		query, args, err := buildPostgresWriteQuery(d.TableName, write.ident, write.packed, write.op, write.expireAt)
 		if err != nil {
 			return err
 		}
-		merged, err := mergePackedValues(existing, packed, op)
-		if err != nil {
-			return err
-		}
-		if err := d.upsertPacked(tx, ident, merged); err != nil {
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
 			return err
 		}
-
-		if d.SystemTracking {
-			systemKey := Key{
-				Key:         systemKeyName,
-				Granularity: key.Granularity,
-				At:          key.At,
-				TrackingKey: key.TrackingKey,
-			}
-			systemIdent, err := d.identifierForKey(systemKey)
-			if err != nil {
-				return err
-			}
-			systemExisting, err := d.readPacked(tx, systemIdent)
-			if err != nil {
-				return err
-			}
-			systemMerged, err := mergePackedValues(systemExisting, systemDataFor(key.SystemTrackingKey(), count), "inc")
-			if err != nil {
-				return err
-			}
-			if err := d.upsertPacked(tx, systemIdent, systemMerged); err != nil {
-				return err
-			}
-		}
 	}
-
 	return tx.Commit()
 }
 
@@ -221,101 +334,143 @@ func (d *PostgresDriver) identifierForKey(k Key) (identifier, error) {
 	}
 }
 
-func (d *PostgresDriver) readPacked(tx *sql.Tx, ident identifier) (map[string]any, error) {
-	query, args := d.selectQuery(ident)
+// postgresJSONBBuildPairs caps key/value pairs per jsonb_build_object call,
+// which accepts at most 100 arguments.
+const postgresJSONBBuildPairs = 50
 
-	var row *sql.Row
-	if tx != nil {
-		row = tx.QueryRow(query, args...)
-	} else {
-		row = d.DB.QueryRow(query, args...)
+func buildPostgresWriteQuery(table string, ident identifier, packed map[string]any, op string, expireAt *time.Time) (string, []any, error) {
+	keys := make([]string, 0, len(packed))
+	for key := range packed {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	var raw []byte
-	if err := row.Scan(&raw); err != nil {
-		if err == sql.ErrNoRows {
-			return map[string]any{}, nil
+	insertData := packed
+	if op == "inc" {
+		insertData = make(map[string]any, len(packed))
+		for _, key := range keys {
+			delta, ok := toFloat(packed[key])
+			if !ok {
+				return "", nil, fmt.Errorf("increment requires numeric value for key %q", key)
+			}
+			insertData[key] = delta
 		}
-		return nil, err
-	}
-
-	if len(raw) == 0 {
-		return map[string]any{}, nil
-	}
-	var decoded map[string]any
-	if err := json.Unmarshal(raw, &decoded); err != nil {
-		return map[string]any{}, nil
 	}
-	return decoded, nil
-}
-
-func (d *PostgresDriver) upsertPacked(tx *sql.Tx, ident identifier, packed map[string]any) error {
-	dataJSON, err := json.Marshal(packed)
+	dataJSON, err := json.Marshal(insertData)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	columns := append([]string{}, ident.columns...)
-	columns = append(columns, "data")
-	conflict := strings.Join(ident.columns, ", ")
-
-	args := append([]any{}, ident.values...)
-	args = append(args, string(dataJSON))
-
+	columns := append(append([]string{}, ident.columns...), "data")
+	args := append(append([]any{}, ident.values...), string(dataJSON))
 	placeholders := make([]string, 0, len(args))
-	for idx := range args {
-		n := idx + 1
-		if idx == len(args)-1 {
-			placeholders = append(placeholders, fmt.Sprintf("$%d::jsonb", n))
-			continue
+	for idx := range ident.values {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", idx+1))
+	}
+	placeholders = append(placeholders, fmt.Sprintf("$%d::jsonb", len(args)))
+	if expireAt != nil {
+		columns = append(columns, "expire_at")
+		args = append(args, expireAt.UTC())
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+
+	var update string
+	switch op {
+	case "inc":
+		objects := make([]string, 0, len(keys)/postgresJSONBBuildPairs+1)
+		for start := 0; start < len(keys); start += postgresJSONBBuildPairs {
+			end := min(start+postgresJSONBBuildPairs, len(keys))
+			pairs := make([]string, 0, end-start)
+			for _, key := range keys[start:end] {
+				args = append(args, key, insertData[key])
+				keyArg, deltaArg := len(args)-1, len(args)
+				pairs = append(pairs, fmt.Sprintf(
+					"$%d::text, CASE WHEN jsonb_typeof(stats.data->$%d::text) = 'number' THEN (stats.data->>$%d::text)::numeric ELSE 0 END + $%d::numeric",
+					keyArg, keyArg, keyArg, deltaArg,
+				))
+			}
+			objects = append(objects, "jsonb_build_object("+strings.Join(pairs, ", ")+")")
 		}
-		placeholders = append(placeholders, fmt.Sprintf("$%d", n))
+		update = "stats.data || " + strings.Join(objects, " || ")
+	case "set":
+		update = "stats.data || EXCLUDED.data"
+	default:
+		return "", nil, fmt.Errorf("invalid operation: %s", op)
+	}
+	if expireAt != nil {
+		update += ", expire_at = EXCLUDED.expire_at"
 	}
 
 	query := fmt.Sprintf(
-		`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET data = EXCLUDED.data;`,
-		d.TableName,
+		`INSERT INTO %s AS stats (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET data = %s;`,
+		table,
 		strings.Join(columns, ", "),
 		strings.Join(placeholders, ", "),
-		conflict,
+		strings.Join(ident.columns, ", "),
+		update,
 	)
-	_, err = tx.Exec(query, args...)
-	return err
+	return query, args, nil
 }
 
-func (d *PostgresDriver) selectQuery(ident identifier) (string, []any) {
-	parts := make([]string, 0, len(ident.columns))
-	args := make([]any, 0, len(ident.values))
-	for idx, col := range ident.columns {
-		parts = append(parts, fmt.Sprintf("%s = $%d", col, idx+1))
-		args = append(args, ident.values[idx])
+func buildPostgresGetQuery(table string, mode JoinedIdentifier, identifiers []identifier) (string, []any) {
+	columns := []string{"key"}
+	if mode == JoinedPartial {
+		columns = []string{"key", "at"}
+	} else if mode == JoinedSeparated {
+		columns = []string{"key", "granularity", "at"}
+	}
+	selectColumns := strings.Join(append(append([]string{}, columns...), "data"), ", ")
+
+	tuples := make([]string, 0, len(identifiers))
+	args := make([]any, 0, len(identifiers)*len(columns))
+	for _, ident := range identifiers {
+		placeholders := make([]string, 0, len(ident.values))
+		for _, value := range ident.values {
+			args = append(args, value)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		if len(placeholders) == 1 {
+			tuples = append(tuples, placeholders[0])
+			continue
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ", ")+")")
 	}
-	query := fmt.Sprintf(`SELECT data FROM %s WHERE %s LIMIT 1;`, d.TableName, strings.Join(parts, " AND "))
-	return query, args
-}
 
-func mergePackedValues(existing map[string]any, incoming map[string]any, op string) (map[string]any, error) {
-	out := cloneMap(existing)
+	if len(tuples) == 0 {
+		return fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0;", selectColumns, table), []any{}
+	}
 
-	switch op {
-	case "inc":
-		for key, value := range incoming {
-			delta, ok := toFloat(value)
-			if !ok {
-				return nil, fmt.Errorf("increment requires numeric value for key %q", key)
-			}
-			base := 0.0
-			if existingValue, ok := toFloat(out[key]); ok {
-				base = existingValue
-			}
-			out[key] = base + delta
+	target := columns[0]
+	if len(columns) > 1 {
+		target = "(" + strings.Join(columns, ", ") + ")"
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s IN (%s);", selectColumns, table, target, strings.Join(tuples, ", ")), args
+}
+
+func scanPostgresRow(mode JoinedIdentifier, rows *sql.Rows) (string, []byte, error) {
+	switch mode {
+	case JoinedPartial:
+		var key string
+		var at time.Time
+		var data []byte
+		if err := rows.Scan(&key, &at, &data); err != nil {
+			return "", nil, err
 		}
-	case "set":
-		for key, value := range incoming {
-			out[key] = value
+		return key + "|" + formatAt(at), data, nil
+	case JoinedSeparated:
+		var key, granularity string
+		var at time.Time
+		var data []byte
+		if err := rows.Scan(&key, &granularity, &at, &data); err != nil {
+			return "", nil, err
 		}
+		return key + "|" + granularity + "|" + formatAt(at), data, nil
 	default:
-		return nil, fmt.Errorf("invalid operation: %s", op)
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return "", nil, err
+		}
+		return key, data, nil
 	}
-	return out, nil
 }
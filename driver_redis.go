@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -15,6 +18,7 @@ type RedisDriver struct {
 	Prefix         string
 	Separator      string
 	SystemTracking bool
+	Retention      Retention
 }
 
 // NewRedisDriver creates a Redis driver.
@@ -39,43 +43,19 @@ func (d *RedisDriver) Inc(keys []Key, values map[string]any) error {
 	return d.IncCount(keys, values, 1)
 }
 
+// IncContext increments numeric values in-place using ctx.
+func (d *RedisDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.IncCountContext(ctx, keys, values, 1)
+}
+
 // IncCount increments values and records system tracking count.
 func (d *RedisDriver) IncCount(keys []Key, values map[string]any, count int64) error {
-	if count <= 0 {
-		count = 1
-	}
-	if len(keys) == 0 {
-		return nil
-	}
-	if d.Client == nil {
-		return fmt.Errorf("redis driver requires Client")
-	}
-
-	packed := Pack(values)
-	if len(packed) == 0 {
-		return nil
-	}
-
-	ctx := context.Background()
-	for _, key := range keys {
-		mainKey := d.joinedKey(key)
-		if err := d.incrementPacked(ctx, mainKey, packed); err != nil {
-			return err
-		}
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
 
-		if d.SystemTracking {
-			systemKey := Key{
-				Key:         systemKeyName,
-				Granularity: key.Granularity,
-				At:          key.At,
-				TrackingKey: key.TrackingKey,
-			}
-			if err := d.incrementPacked(ctx, d.joinedKey(systemKey), systemDataFor(key.SystemTrackingKey(), count)); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+// IncCountContext increments values and records system tracking count using ctx.
+func (d *RedisDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	return singleBatchError(d.WriteBatch(ctx, []BatchOperation{{Operation: "inc", Keys: keys, Values: values, Count: count}}))
 }
 
 // Set writes values without deleting unspecified fields.
@@ -83,48 +63,92 @@ func (d *RedisDriver) Set(keys []Key, values map[string]any) error {
 	return d.SetCount(keys, values, 1)
 }
 
+// SetContext writes values without deleting unspecified fields using ctx.
+func (d *RedisDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.SetCountContext(ctx, keys, values, 1)
+}
+
 // SetCount writes values and records system tracking count.
 func (d *RedisDriver) SetCount(keys []Key, values map[string]any, count int64) error {
-	if count <= 0 {
-		count = 1
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext writes values and records system tracking count using ctx.
+func (d *RedisDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	return singleBatchError(d.WriteBatch(ctx, []BatchOperation{{Operation: "set", Keys: keys, Values: values, Count: count}}))
+}
+
+// WriteBatch writes operations in order through a single pipeline.
+func (d *RedisDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	ctx = ensureContext(ctx)
+	packed := make([]map[string]any, len(operations))
+	pending := 0
+	for idx, operation := range operations {
+		if len(operation.Keys) == 0 {
+			continue
+		}
+		packed[idx] = Pack(operation.Values)
+		if len(packed[idx]) > 0 {
+			pending++
+		}
 	}
-	if len(keys) == 0 {
+	if pending == 0 {
 		return nil
 	}
 	if d.Client == nil {
 		return fmt.Errorf("redis driver requires Client")
 	}
 
-	packed := Pack(values)
-	if len(packed) == 0 {
+	// ends[idx] is the pipeline length after operation idx was queued, so each
+	// operation owns the commands from ends[idx-1] to ends[idx].
+	ends := make([]int, len(operations))
+	cmds, err := d.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for idx, operation := range operations {
+			if len(packed[idx]) > 0 {
+				if err := d.queueOperation(ctx, pipe, operation.Operation, operation.Keys, packed[idx], max(operation.Count, 1)); err != nil {
+					return err
+				}
+			}
+			ends[idx] = pipe.Len()
+		}
+		return nil
+	})
+	if err == nil {
 		return nil
 	}
+	if len(cmds) == 0 {
+		return err
+	}
 
-	ctx := context.Background()
-	fields := toRedisFieldValues(packed)
-	for _, key := range keys {
-		mainKey := d.joinedKey(key)
-		if err := d.Client.HSet(ctx, mainKey, fields...).Err(); err != nil {
-			return err
-		}
-
-		if d.SystemTracking {
-			systemKey := Key{
-				Key:         systemKeyName,
-				Granularity: key.Granularity,
-				At:          key.At,
-				TrackingKey: key.TrackingKey,
-			}
-			if err := d.incrementPacked(ctx, d.joinedKey(systemKey), systemDataFor(key.SystemTrackingKey(), count)); err != nil {
-				return err
+	// The pipeline is not a transaction: commands run on their own, so only
+	// the operations with a failed command are left unwritten.
+	errs := make([]error, len(operations))
+	failed := false
+	start := 0
+	for idx, end := range ends {
+		for _, cmd := range cmds[start:end] {
+			if cmdErr := cmd.Err(); cmdErr != nil {
+				errs[idx] = cmdErr
+				failed = true
+				break
 			}
 		}
+		start = end
 	}
-	return nil
+	if !failed {
+		return err
+	}
+	return &BatchError{Errs: errs}
 }
 
 // Get fetches values for keys in order.
 func (d *RedisDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values for keys in order using ctx.
+func (d *RedisDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	ctx = ensureContext(ctx)
 	if len(keys) == 0 {
 		return []map[string]any{}, nil
 	}
@@ -132,14 +156,20 @@ func (d *RedisDriver) Get(keys []Key) ([]map[string]any, error) {
 		return nil, fmt.Errorf("redis driver requires Client")
 	}
 
-	ctx := context.Background()
-	results := make([]map[string]any, 0, len(keys))
-	for _, key := range keys {
-		mainKey := d.joinedKey(key)
-		raw, err := d.Client.HGetAll(ctx, mainKey).Result()
-		if err != nil {
-			return nil, err
+	cmds := make([]*redis.MapStringStringCmd, 0, len(keys))
+	_, err := d.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			cmds = append(cmds, pipe.HGetAll(ctx, d.joinedKey(key)))
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]any, 0, len(keys))
+	for _, cmd := range cmds {
+		raw := cmd.Val()
 		packed := make(map[string]any, len(raw))
 		for field, value := range raw {
 			packed[field] = parseRedisScalar(value)
@@ -149,12 +179,113 @@ func (d *RedisDriver) Get(keys []Key) ([]map[string]any, error) {
 	return results, nil
 }
 
+// Ping replaces the status snapshot hash of a key.
+func (d *RedisDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
+	if d.Client == nil {
+		return fmt.Errorf("redis driver requires Client")
+	}
+
+	pingKey := d.pingKey(key)
+	fields := []any{"at", at.Unix()}
+	fields = append(fields, toRedisFieldValues(Pack(map[string]any{"data": values}))...)
+	_, err := d.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, pingKey)
+		pipe.HSet(ctx, pingKey, fields...)
+		return nil
+	})
+	return err
+}
+
+// Scan reads the status snapshot hash of a key.
+func (d *RedisDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	if d.Client == nil {
+		return ValuesResult{}, fmt.Errorf("redis driver requires Client")
+	}
+
+	raw, err := d.Client.HGetAll(ctx, d.pingKey(key)).Result()
+	if err != nil {
+		return ValuesResult{}, err
+	}
+	if len(raw) == 0 {
+		return emptyScanResult(), nil
+	}
+
+	unix, err := strconv.ParseInt(raw["at"], 10, 64)
+	if err != nil {
+		return ValuesResult{}, fmt.Errorf("invalid ping timestamp for key %q", key)
+	}
+	packed := make(map[string]any, len(raw))
+	for field, value := range raw {
+		if name, ok := strings.CutPrefix(field, "data."); ok {
+			packed[name] = parseRedisScalar(value)
+		}
+	}
+	return scanResultFor(time.Unix(unix, 0).UTC(), Unpack(packed)), nil
+}
+
+func (d *RedisDriver) pingKey(key string) string {
+	return Key{Prefix: d.Prefix + d.Separator + "ping", Key: key}.Join(d.Separator)
+}
+
 func (d *RedisDriver) joinedKey(key Key) string {
 	key.Prefix = d.Prefix
 	return key.Join(d.Separator)
 }
 
-func (d *RedisDriver) incrementPacked(ctx context.Context, redisKey string, packed map[string]any) error {
+func (d *RedisDriver) queueOperation(ctx context.Context, pipe redis.Pipeliner, op string, keys []Key, packed map[string]any, count int64) error {
+	var fields []any
+	switch op {
+	case "inc":
+	case "set":
+		fields = toRedisFieldValues(packed)
+	default:
+		return fmt.Errorf("invalid operation: %s", op)
+	}
+	for _, key := range keys {
+		redisKey := d.joinedKey(key)
+		if op == "set" {
+			pipe.HSet(ctx, redisKey, fields...)
+		} else if err := queueIncrement(ctx, pipe, redisKey, packed); err != nil {
+			return err
+		}
+		d.queueExpiry(ctx, pipe, redisKey, key)
+		if err := d.queueSystemTracking(ctx, pipe, key, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *RedisDriver) queueSystemTracking(ctx context.Context, pipe redis.Pipeliner, key Key, count int64) error {
+	if !d.SystemTracking {
+		return nil
+	}
+	systemKey := Key{
+		Key:         systemKeyName,
+		Granularity: key.Granularity,
+		At:          key.At,
+		TrackingKey: key.TrackingKey,
+	}
+	redisKey := d.joinedKey(systemKey)
+	if err := queueIncrement(ctx, pipe, redisKey, systemDataFor(key.SystemTrackingKey(), count)); err != nil {
+		return err
+	}
+	d.queueExpiry(ctx, pipe, redisKey, key)
+	return nil
+}
+
+// queueExpiry queues EXPIREAT for buckets whose granularity has a retention.
+func (d *RedisDriver) queueExpiry(ctx context.Context, pipe redis.Pipeliner, redisKey string, key Key) {
+	if expireAt := d.Retention.ExpireAt(key.Granularity, key.At); expireAt != nil {
+		pipe.ExpireAt(ctx, redisKey, *expireAt)
+	}
+}
+
+// queueIncrement queues one HINCRBY/HINCRBYFLOAT per packed field. Values are
+// validated before queueing so a rejected write leaves the pipeline unsent.
+func queueIncrement(ctx context.Context, pipe redis.Pipeliner, redisKey string, packed map[string]any) error {
 	fields := make([]string, 0, len(packed))
 	for field := range packed {
 		fields = append(fields, field)
@@ -162,21 +293,16 @@ func (d *RedisDriver) incrementPacked(ctx context.Context, redisKey string, pack
 	sort.Strings(fields)
 
 	for _, field := range fields {
-		value := packed[field]
-		delta, ok := toFloat(value)
+		delta, ok := toFloat(packed[field])
 		if !ok {
 			return fmt.Errorf("increment requires numeric value for key %q", field)
 		}
 
 		if math.Mod(delta, 1) == 0 {
-			if err := d.Client.HIncrBy(ctx, redisKey, field, int64(delta)).Err(); err != nil {
-				return err
-			}
+			pipe.HIncrBy(ctx, redisKey, field, int64(delta))
 			continue
 		}
-		if err := d.Client.HIncrByFloat(ctx, redisKey, field, delta).Err(); err != nil {
-			return err
-		}
+		pipe.HIncrByFloat(ctx, redisKey, field, delta)
 	}
 	return nil
 }
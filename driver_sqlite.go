@@ -1,6 +1,7 @@
 package triflestats
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -15,9 +16,13 @@ import (
 type SQLiteDriver struct {
 	DB               *sql.DB
 	TableName        string
+	PingTableName    string
 	Separator        string
 	JoinedIdentifier JoinedIdentifier
 	SystemTracking   bool
+	// Retention stamps expire_at on buckets for Purge to sweep. Setup adds the
+	// expire_at column to tables created before it existed.
+	Retention Retention
 }
 
 // NewSQLiteDriver creates a new SQLite driver.
@@ -28,6 +33,7 @@ func NewSQLiteDriver(db *sql.DB, tableName string, joinedIdentifier JoinedIdenti
 	return &SQLiteDriver{
 		DB:               db,
 		TableName:        tableName,
+		PingTableName:    tableName + "_ping",
 		Separator:        "::",
 		JoinedIdentifier: joinedIdentifier,
 		SystemTracking:   true,
@@ -46,15 +52,42 @@ func (d *SQLiteDriver) Setup() error {
 	var query string
 	switch d.JoinedIdentifier {
 	case JoinedFull:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, data TEXT NOT NULL DEFAULT '{}');`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, data TEXT NOT NULL DEFAULT '{}', expire_at TEXT);`, d.TableName)
 	case JoinedPartial:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL, at TEXT NOT NULL, data TEXT NOT NULL DEFAULT '{}', PRIMARY KEY (key, at));`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL, at TEXT NOT NULL, data TEXT NOT NULL DEFAULT '{}', expire_at TEXT, PRIMARY KEY (key, at));`, d.TableName)
 	case JoinedSeparated:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL, granularity TEXT NOT NULL, at TEXT NOT NULL, data TEXT NOT NULL DEFAULT '{}', PRIMARY KEY (key, granularity, at));`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL, granularity TEXT NOT NULL, at TEXT NOT NULL, data TEXT NOT NULL DEFAULT '{}', expire_at TEXT, PRIMARY KEY (key, granularity, at));`, d.TableName)
 	default:
-		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, data TEXT NOT NULL DEFAULT '{}');`, d.TableName)
+		query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, data TEXT NOT NULL DEFAULT '{}', expire_at TEXT);`, d.TableName)
 	}
-	_, err := d.DB.Exec(query)
+	if _, err := d.DB.Exec(query); err != nil {
+		return err
+	}
+	if d.Retention.Enabled() {
+		if err := d.addExpireAtColumn(); err != nil {
+			return err
+		}
+		indexQuery := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_expire_at_idx ON %s (expire_at);`, d.TableName, d.TableName)
+		if _, err := d.DB.Exec(indexQuery); err != nil {
+			return err
+		}
+	}
+
+	pingQuery := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, at TEXT NOT NULL, data TEXT NOT NULL DEFAULT '{}');`, d.PingTableName)
+	_, err := d.DB.Exec(pingQuery)
+	return err
+}
+
+// addExpireAtColumn adds expire_at to tables created before it existed.
+func (d *SQLiteDriver) addExpireAtColumn() error {
+	var columns int
+	if err := d.DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'expire_at';`, d.TableName).Scan(&columns); err != nil {
+		return err
+	}
+	if columns > 0 {
+		return nil
+	}
+	_, err := d.DB.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN expire_at TEXT;`, d.TableName))
 	return err
 }
 
@@ -73,12 +106,22 @@ func (d *SQLiteDriver) Inc(keys []Key, values map[string]any) error {
 	return d.IncCount(keys, values, 1)
 }
 
+// IncContext increments numeric values in-place using ctx.
+func (d *SQLiteDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.IncCountContext(ctx, keys, values, 1)
+}
+
 // IncCount increments values and records system tracking count.
 func (d *SQLiteDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
+
+// IncCountContext increments values and records system tracking count using ctx.
+func (d *SQLiteDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(keys, values, "inc", count)
+	return d.writeWithOperation(ctx, keys, values, "inc", count)
 }
 
 // Set sets provided values (without deleting other keys).
@@ -86,16 +129,32 @@ func (d *SQLiteDriver) Set(keys []Key, values map[string]any) error {
 	return d.SetCount(keys, values, 1)
 }
 
+// SetContext sets provided values (without deleting other keys) using ctx.
+func (d *SQLiteDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.SetCountContext(ctx, keys, values, 1)
+}
+
 // SetCount sets values and records system tracking count.
 func (d *SQLiteDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext sets values and records system tracking count using ctx.
+func (d *SQLiteDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
 	if count <= 0 {
 		count = 1
 	}
-	return d.writeWithOperation(keys, values, "set", count)
+	return d.writeWithOperation(ctx, keys, values, "set", count)
 }
 
 // Get fetches values for keys in order.
 func (d *SQLiteDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values for keys in order using ctx.
+func (d *SQLiteDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	ctx = ensureContext(ctx)
 	if len(keys) == 0 {
 		return []map[string]any{}, nil
 	}
@@ -109,18 +168,34 @@ func (d *SQLiteDriver) Get(keys []Key) ([]map[string]any, error) {
 		identifiers = append(identifiers, ident)
 	}
 
-	query, args := buildGetQuery(d.TableName, identifiers)
-	rows, err := d.DB.Query(query, args...)
+	resultMap := map[string]map[string]any{}
+	for start := 0; start < len(identifiers); start += getBatchSize {
+		end := min(start+getBatchSize, len(identifiers))
+		if err := d.fetchPacked(ctx, identifiers[start:end], resultMap); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]map[string]any, 0, len(keys))
+	for _, ident := range identifiers {
+		packed := resultMap[ident.lookupKey]
+		results = append(results, Unpack(packed))
+	}
+	return results, nil
+}
+
+func (d *SQLiteDriver) fetchPacked(ctx context.Context, identifiers []identifier, resultMap map[string]map[string]any) error {
+	query, args := buildGetQuery(d.TableName, d.JoinedIdentifier, identifiers)
+	rows, err := d.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	resultMap := map[string]map[string]any{}
 	for rows.Next() {
 		rowIdent, dataJSON, err := scanRow(d.JoinedIdentifier, rows)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		var packed map[string]any
 		if dataJSON == "" {
@@ -132,20 +207,69 @@ func (d *SQLiteDriver) Get(keys []Key) ([]map[string]any, error) {
 		}
 		resultMap[rowIdent] = packed
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return rows.Err()
+}
+
+// Ping replaces the status snapshot of a key in the ping table.
+func (d *SQLiteDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return fmt.Errorf("sqlite driver requires DB")
 	}
 
-	results := make([]map[string]any, 0, len(keys))
-	for _, k := range keys {
-		ident, err := d.identifierForKey(k)
-		if err != nil {
-			return nil, err
+	dataJSON, err := json.Marshal(Pack(values))
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (key, at, data) VALUES (?, ?, json(?)) ON CONFLICT (key) DO UPDATE SET at = excluded.at, data = excluded.data;",
+		d.PingTableName,
+	)
+	_, err = d.DB.ExecContext(ctx, query, key, formatAt(at), string(dataJSON))
+	return err
+}
+
+// Scan reads the status snapshot of a key from the ping table.
+func (d *SQLiteDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return ValuesResult{}, fmt.Errorf("sqlite driver requires DB")
+	}
+
+	query := fmt.Sprintf("SELECT at, data FROM %s WHERE key = ? LIMIT 1;", d.PingTableName)
+	var rawAt, dataJSON string
+	if err := d.DB.QueryRowContext(ctx, query, key).Scan(&rawAt, &dataJSON); err != nil {
+		if err == sql.ErrNoRows {
+			return emptyScanResult(), nil
 		}
-		packed := resultMap[ident.lookupKey]
-		results = append(results, Unpack(packed))
+		return ValuesResult{}, err
 	}
-	return results, nil
+	at, err := time.Parse(time.RFC3339Nano, rawAt)
+	if err != nil {
+		return ValuesResult{}, err
+	}
+
+	var packed map[string]any
+	if err := json.Unmarshal([]byte(dataJSON), &packed); err != nil {
+		packed = map[string]any{}
+	}
+	return scanResultFor(at, Unpack(packed)), nil
+}
+
+// Purge deletes buckets whose retention has elapsed and returns how many rows
+// were removed.
+func (d *SQLiteDriver) Purge(ctx context.Context) (int64, error) {
+	ctx = ensureContext(ctx)
+	if d.DB == nil {
+		return 0, fmt.Errorf("sqlite driver requires DB")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE expire_at <= ?;", d.TableName)
+	result, err := d.DB.ExecContext(ctx, query, formatAt(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 // --- internal helpers ---
@@ -196,20 +320,27 @@ func (d *SQLiteDriver) identifierForKey(k Key) (identifier, error) {
 	}
 }
 
-func (d *SQLiteDriver) writeWithOperation(keys []Key, values map[string]any, op string, count int64) error {
-	if len(keys) == 0 {
+func (d *SQLiteDriver) writeWithOperation(ctx context.Context, keys []Key, values map[string]any, op string, count int64) error {
+	return d.WriteBatch(ctx, []BatchOperation{{Operation: op, Keys: keys, Values: values, Count: count}})
+}
+
+// WriteBatch writes operations within a single transaction. Rows are written
+// in identifier order, with writes to the same row kept in operation order,
+// so concurrent batches do not deadlock.
+func (d *SQLiteDriver) WriteBatch(ctx context.Context, operations []BatchOperation) error {
+	ctx = ensureContext(ctx)
+	writes, err := orderedRowWrites(operations, d.Retention, d.SystemTracking, d.identifierForKey)
+	if err != nil {
+		return err
+	}
+	if len(writes) == 0 {
 		return nil
 	}
 	if d.DB == nil {
 		return fmt.Errorf("sqlite driver requires DB")
 	}
 
-	packed := Pack(values)
-	if len(packed) == 0 {
-		return nil
-	}
-
-	tx, err := d.DB.Begin()
+	tx, err := d.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -217,35 +348,15 @@ func (d *SQLiteDriver) writeWithOperation(keys []Key, values map[string]any, op
 		_ = tx.Rollback()
 	}()
 
-	for _, k := range keys {
-		ident, err := d.identifierForKey(k)
-		if err != nil {
-			return err
-		}
-		if err := d.batchWrite(tx, ident, packed, op); err != nil {
+	for _, write := range writes {
+		if err := d.batchWrite(ctx, tx, write.ident, write.packed, write.op, write.expireAt); err != nil {
 			return err
 		}
-		if d.SystemTracking {
-			systemKey := Key{
-				Key:         systemKeyName,
-				Granularity: k.Granularity,
-				At:          k.At,
-			}
-			systemIdent, err := d.identifierForKey(systemKey)
-			if err != nil {
-				return err
-			}
-			systemData := systemDataFor(k.SystemTrackingKey(), count)
-			if err := d.batchWrite(tx, systemIdent, systemData, "inc"); err != nil {
-				return err
-			}
-		}
 	}
-
 	return tx.Commit()
 }
 
-func (d *SQLiteDriver) batchWrite(tx *sql.Tx, ident identifier, packed map[string]any, op string) error {
+func (d *SQLiteDriver) batchWrite(ctx context.Context, tx *sql.Tx, ident identifier, packed map[string]any, op string, expireAt *time.Time) error {
 	const batchSize = 10
 
 	keys := make([]string, 0, len(packed))
@@ -264,11 +375,11 @@ func (d *SQLiteDriver) batchWrite(tx *sql.Tx, ident identifier, packed map[strin
 		for _, k := range batchKeys {
 			batch[k] = packed[k]
 		}
-		query, args, err := buildWriteQuery(d.TableName, ident, batch, op)
+		query, args, err := buildWriteQuery(d.TableName, ident, batch, op, expireAt)
 		if err != nil {
 			return err
 		}
-		if _, err := tx.Exec(query, args...); err != nil {
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
 			return err
 		}
 	}
@@ -277,6 +388,10 @@ func (d *SQLiteDriver) batchWrite(tx *sql.Tx, ident identifier, packed map[strin
 
 const systemKeyName = "__system__key__"
 
+// getBatchSize caps identifiers per batched lookup query so multi-key reads stay
+// below database placeholder limits.
+const getBatchSize = 500
+
 func systemDataFor(key string, count int64) map[string]any {
 	return Pack(map[string]any{
 		"count": count,
@@ -286,9 +401,8 @@ func systemDataFor(key string, count int64) map[string]any {
 	})
 }
 
-func buildWriteQuery(table string, ident identifier, batch map[string]any, op string) (string, []any, error) {
-	columns := ident.columns
-	colList := strings.Join(columns, ", ")
+func buildWriteQuery(table string, ident identifier, batch map[string]any, op string, expireAt *time.Time) (string, []any, error) {
+	columns := append(append([]string{}, ident.columns...), "data")
 	placeholders := make([]string, 0, len(columns)+1)
 	args := make([]any, 0, len(columns)+1+len(batch))
 
@@ -304,22 +418,31 @@ func buildWriteQuery(table string, ident identifier, batch map[string]any, op st
 	placeholders = append(placeholders, "json(?)")
 	args = append(args, string(batchJSON))
 
-	conflict := strings.Join(columns, ", ")
-	jsonExpr, valArgs := buildJSONExpression(batch, op)
+	jsonExpr, valArgs, err := buildJSONExpression(batch, op)
+	if err != nil {
+		return "", nil, err
+	}
+	update := "data = " + jsonExpr
+	if expireAt != nil {
+		columns = append(columns, "expire_at")
+		placeholders = append(placeholders, "?")
+		args = append(args, formatAt(*expireAt))
+		update += ", expire_at = excluded.expire_at"
+	}
 	args = append(args, valArgs...)
 
 	query := fmt.Sprintf(
-		"INSERT INTO %s (%s, data) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET data = %s;",
+		"INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s;",
 		table,
-		colList,
+		strings.Join(columns, ", "),
 		strings.Join(placeholders, ", "),
-		conflict,
-		jsonExpr,
+		strings.Join(ident.columns, ", "),
+		update,
 	)
 	return query, args, nil
 }
 
-func buildJSONExpression(batch map[string]any, op string) (string, []any) {
+func buildJSONExpression(batch map[string]any, op string) (string, []any, error) {
 	keys := make([]string, 0, len(batch))
 	for k := range batch {
 		keys = append(keys, k)
@@ -330,28 +453,42 @@ func buildJSONExpression(batch map[string]any, op string) (string, []any) {
 	args := []any{}
 
 	for _, k := range keys {
+		if op == "inc" {
+			if _, ok := toFloat(batch[k]); !ok {
+				return "", nil, fmt.Errorf("increment requires numeric value for key %q", k)
+			}
+		} else if op != "set" {
+			return "", nil, fmt.Errorf("invalid operation: %s", op)
+		}
+		if strings.ContainsAny(k, `"\`) {
+			expr, args = patchJSONKey(expr, args, k, batch[k], op)
+			continue
+		}
 		path := jsonPathForKey(k)
-		switch op {
-		case "inc":
+		if op == "inc" {
 			expr = fmt.Sprintf(
 				"json_set(%s, '%s', IFNULL(json_extract(data, '%s'), 0) + ?)",
 				expr, path, path,
 			)
-			args = append(args, batch[k])
-		case "set":
+		} else {
 			expr = fmt.Sprintf(
 				"json_set(%s, '%s', ?)",
 				expr, path,
 			)
-			args = append(args, batch[k])
-		default:
-			panic("invalid op")
 		}
+		args = append(args, batch[k])
 	}
-	return expr, args
+	return expr, args, nil
 }
 
-func buildGetQuery(table string, identifiers []identifier) (string, []any) {
+func buildGetQuery(table string, mode JoinedIdentifier, identifiers []identifier) (string, []any) {
+	selectColumns := "key, data"
+	if mode == JoinedPartial {
+		selectColumns = "key, at, data"
+	} else if mode == JoinedSeparated {
+		selectColumns = "key, granularity, at, data"
+	}
+
 	conds := make([]string, 0, len(identifiers))
 	args := []any{}
 
@@ -374,9 +511,9 @@ func buildGetQuery(table string, identifiers []identifier) (string, []any) {
 	}
 
 	if len(conds) == 0 {
-		return fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0;", table), []any{}
+		return fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0;", selectColumns, table), []any{}
 	}
-	return fmt.Sprintf("SELECT * FROM %s WHERE %s;", table, strings.Join(conds, " OR ")), args
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s;", selectColumns, table, strings.Join(conds, " OR ")), args
 }
 
 func scanRow(mode JoinedIdentifier, rows *sql.Rows) (string, string, error) {
@@ -432,9 +569,27 @@ func normalizeSQLiteAtForLookup(value string) string {
 	return formatAt(parsed)
 }
 
+// jsonPathForKey quotes the packed key as a single path label so dotted keys
+// address the flat field instead of a nested object.
 func jsonPathForKey(key string) string {
 	escaped := strings.ReplaceAll(key, "'", "''")
-	return fmt.Sprintf("$.%s", escaped)
+	return fmt.Sprintf("$.\"%s\"", escaped)
+}
+
+// patchJSONKey updates a key that a path label cannot address. SQLite matches
+// quoted labels against the raw JSON text, so keys holding a double quote or
+// backslash are read through json_each and written through json_patch, which
+// compare decoded keys instead.
+func patchJSONKey(expr string, args []any, key string, value any, op string) (string, []any) {
+	if op == "inc" {
+		expr = fmt.Sprintf(
+			"json_patch(%s, json_object(?, IFNULL((SELECT value FROM json_each(data) WHERE key = ?), 0) + ?))",
+			expr,
+		)
+		return expr, append(args, key, key, value)
+	}
+	expr = fmt.Sprintf("json_patch(%s, json_object(?, ?))", expr)
+	return expr, append(args, key, value)
 }
 
 func (d *SQLiteDriver) applyPragmas() error {
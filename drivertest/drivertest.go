@@ -0,0 +1,435 @@
+// Package drivertest provides a conformance suite for triflestats drivers.
+//
+// Every driver shipped with triflestats runs the suite, and third-party drivers
+// can run it from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		drivertest.RunConformance(t, func(t *testing.T) triflestats.Driver {
+//			return newEmptyDriver(t)
+//		})
+//	}
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	triflestats "github.com/trifle-io/trifle_stats_go"
+)
+
+const (
+	systemKey    = "__system__key__"
+	untrackedKey = "__untracked__"
+)
+
+// Factory returns an empty driver with system tracking enabled. It is called
+// once per subtest so cases never observe each other's writes.
+type Factory func(t *testing.T) triflestats.Driver
+
+// RunConformance checks that drivers built by factory follow the storage
+// contract shared by all triflestats drivers. Numbers are compared by value, so
+// drivers may return any numeric type on read.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Helper()
+
+	cases := []struct {
+		name string
+		run  func(t *testing.T, driver triflestats.Driver)
+	}{
+		{"SetGet", testSetGet},
+		{"SetKeepsUnspecifiedFields", testSetKeepsUnspecifiedFields},
+		{"IncAccumulates", testIncAccumulates},
+		{"IncAfterSet", testIncAfterSet},
+		{"IncRejectsNonNumeric", testIncRejectsNonNumeric},
+		{"EmptyValuesWriteNothing", testEmptyValuesWriteNothing},
+		{"MissingKeys", testMissingKeys},
+		{"GetPreservesOrder", testGetPreservesOrder},
+		{"BucketsAreIsolated", testBucketsAreIsolated},
+		{"NestedPacking", testNestedPacking},
+		{"SystemTracking", testSystemTracking},
+		{"TrackingKey", testTrackingKey},
+		{"Untracked", testUntracked},
+		{"IncCount", testIncCount},
+		{"SetCount", testSetCount},
+		{"WriteBatch", testWriteBatch},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			driver := factory(t)
+			if driver == nil {
+				t.Fatalf("factory returned nil driver")
+			}
+			tc.run(t, driver)
+		})
+	}
+}
+
+var baseAt = time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+
+func bucket(key, granularity string, at time.Time) triflestats.Key {
+	return triflestats.Key{Key: key, Granularity: granularity, At: &at}
+}
+
+func systemBucket(granularity string, at time.Time) triflestats.Key {
+	return bucket(systemKey, granularity, at)
+}
+
+func testSetGet(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	mustSet(t, driver, key, map[string]any{"count": 1, "status": "ok"})
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{"count": 1, "status": "ok"})
+}
+
+func testSetKeepsUnspecifiedFields(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	mustSet(t, driver, key, map[string]any{"a": 1, "b": 2})
+	mustSet(t, driver, key, map[string]any{"b": 3})
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{"a": 1, "b": 3})
+}
+
+func testIncAccumulates(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	mustInc(t, driver, key, map[string]any{"count": 1, "duration": 0.5})
+	mustInc(t, driver, key, map[string]any{"count": int64(2), "duration": 1.25})
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{"count": 3, "duration": 1.75})
+}
+
+func testIncAfterSet(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	mustSet(t, driver, key, map[string]any{"count": 5})
+	mustInc(t, driver, key, map[string]any{"count": 1, "errors": 2})
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{"count": 6, "errors": 2})
+}
+
+func testIncRejectsNonNumeric(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	if err := driver.Inc([]triflestats.Key{key}, map[string]any{"status": "bad"}); err == nil {
+		t.Fatalf("expected error incrementing a non-numeric value")
+	}
+}
+
+func testEmptyValuesWriteNothing(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	if err := driver.Inc([]triflestats.Key{key}, map[string]any{}); err != nil {
+		t.Fatalf("inc with empty values failed: %v", err)
+	}
+	if err := driver.Set([]triflestats.Key{key}, nil); err != nil {
+		t.Fatalf("set with nil values failed: %v", err)
+	}
+	if err := driver.Inc(nil, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc without keys failed: %v", err)
+	}
+
+	got := mustGet(t, driver, key, systemBucket("1h", baseAt))
+	assertValues(t, got[0], map[string]any{})
+	assertValues(t, got[1], map[string]any{})
+}
+
+func testMissingKeys(t *testing.T, driver triflestats.Driver) {
+	got, err := driver.Get([]triflestats.Key{})
+	if err != nil {
+		t.Fatalf("get without keys failed: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no results for no keys, got %+v", got)
+	}
+
+	got = mustGet(t, driver, bucket("missing", "1h", baseAt), bucket("missing", "1d", baseAt))
+	for idx, values := range got {
+		if values == nil {
+			t.Fatalf("expected empty map for missing key %d, got nil", idx)
+		}
+		assertValues(t, values, map[string]any{})
+	}
+}
+
+func testGetPreservesOrder(t *testing.T, driver triflestats.Driver) {
+	first := bucket("first", "1h", baseAt)
+	second := bucket("second", "1h", baseAt)
+	missing := bucket("missing", "1h", baseAt)
+	mustSet(t, driver, first, map[string]any{"value": 1})
+	mustSet(t, driver, second, map[string]any{"value": 2})
+
+	got := mustGet(t, driver, second, missing, first, second)
+	assertValues(t, got[0], map[string]any{"value": 2})
+	assertValues(t, got[1], map[string]any{})
+	assertValues(t, got[2], map[string]any{"value": 1})
+	assertValues(t, got[3], map[string]any{"value": 2})
+}
+
+func testBucketsAreIsolated(t *testing.T, driver triflestats.Driver) {
+	hour := bucket("event", "1h", baseAt)
+	nextHour := bucket("event", "1h", baseAt.Add(time.Hour))
+	day := bucket("event", "1d", baseAt)
+	other := bucket("other", "1h", baseAt)
+	if err := driver.Inc([]triflestats.Key{hour, day}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	mustInc(t, driver, nextHour, map[string]any{"count": 5})
+
+	got := mustGet(t, driver, hour, nextHour, day, other)
+	assertValues(t, got[0], map[string]any{"count": 1})
+	assertValues(t, got[1], map[string]any{"count": 5})
+	assertValues(t, got[2], map[string]any{"count": 1})
+	assertValues(t, got[3], map[string]any{})
+}
+
+func testNestedPacking(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	mustInc(t, driver, key, map[string]any{
+		"count": 1,
+		"meta": map[string]any{
+			"duration": 2,
+			"queue":    map[string]any{"default": 3},
+		},
+	})
+	mustInc(t, driver, key, map[string]any{"meta": map[string]any{"queue": map[string]any{"default": 1, "mailers": 4}}})
+	mustSet(t, driver, key, map[string]any{"meta": map[string]any{"status": "ok"}})
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{
+		"count": 1,
+		"meta": map[string]any{
+			"duration": 2,
+			"status":   "ok",
+			"queue":    map[string]any{"default": 4, "mailers": 4},
+		},
+	})
+}
+
+func testSystemTracking(t *testing.T, driver triflestats.Driver) {
+	mustInc(t, driver, bucket("event", "1h", baseAt), map[string]any{"count": 1})
+	mustInc(t, driver, bucket("event", "1h", baseAt), map[string]any{"count": 1})
+	mustSet(t, driver, bucket("other", "1h", baseAt), map[string]any{"status": "ok"})
+
+	assertValues(t, mustGetOne(t, driver, systemBucket("1h", baseAt)), map[string]any{
+		"count": 3,
+		"keys":  map[string]any{"event": 2, "other": 1},
+	})
+}
+
+func testTrackingKey(t *testing.T, driver triflestats.Driver) {
+	key := bucket("event", "1h", baseAt)
+	key.TrackingKey = "events"
+	mustInc(t, driver, key, map[string]any{"count": 1})
+
+	assertValues(t, mustGetOne(t, driver, bucket("event", "1h", baseAt)), map[string]any{"count": 1})
+	assertValues(t, mustGetOne(t, driver, systemBucket("1h", baseAt)), map[string]any{
+		"count": 1,
+		"keys":  map[string]any{"events": 1},
+	})
+}
+
+func testUntracked(t *testing.T, driver triflestats.Driver) {
+	cfg := triflestats.DefaultConfig()
+	cfg.Driver = driver
+	cfg.TimeZone = "UTC"
+	cfg.Granularities = []string{"1h"}
+	cfg.BufferEnabled = false
+
+	at := baseAt.Add(15 * time.Minute)
+	if err := triflestats.Track(cfg, "event", at, map[string]any{"count": 1}, triflestats.Untracked()); err != nil {
+		t.Fatalf("track failed: %v", err)
+	}
+	if err := triflestats.Track(cfg, "event", at, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("track failed: %v", err)
+	}
+
+	assertValues(t, mustGetOne(t, driver, bucket("event", "1h", baseAt)), map[string]any{"count": 2})
+	assertValues(t, mustGetOne(t, driver, systemBucket("1h", baseAt)), map[string]any{
+		"count": 2,
+		"keys":  map[string]any{"event": 1, untrackedKey: 1},
+	})
+}
+
+func testIncCount(t *testing.T, driver triflestats.Driver) {
+	counter := countDriver(t, driver)
+	key := bucket("event", "1h", baseAt)
+	if err := counter.IncCount([]triflestats.Key{key}, map[string]any{"count": 4}, 3); err != nil {
+		t.Fatalf("inc count failed: %v", err)
+	}
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{"count": 4})
+	assertValues(t, mustGetOne(t, driver, systemBucket("1h", baseAt)), map[string]any{
+		"count": 3,
+		"keys":  map[string]any{"event": 3},
+	})
+}
+
+func testSetCount(t *testing.T, driver triflestats.Driver) {
+	counter := countDriver(t, driver)
+	key := bucket("event", "1h", baseAt)
+	if err := counter.SetCount([]triflestats.Key{key}, map[string]any{"status": "ok"}, 2); err != nil {
+		t.Fatalf("set count failed: %v", err)
+	}
+	if err := counter.SetCount([]triflestats.Key{key}, map[string]any{"status": "done"}, 0); err != nil {
+		t.Fatalf("set count with zero count failed: %v", err)
+	}
+
+	assertValues(t, mustGetOne(t, driver, key), map[string]any{"status": "done"})
+	assertValues(t, mustGetOne(t, driver, systemBucket("1h", baseAt)), map[string]any{
+		"count": 3,
+		"keys":  map[string]any{"event": 3},
+	})
+}
+
+func testWriteBatch(t *testing.T, driver triflestats.Driver) {
+	batcher, ok := driver.(triflestats.BatchDriver)
+	if !ok {
+		t.Skipf("%s does not implement BatchDriver", driver.Description())
+	}
+	first := bucket("event", "1h", baseAt)
+	second := bucket("other", "1h", baseAt)
+	operations := []triflestats.BatchOperation{
+		{Operation: "set", Keys: []triflestats.Key{first}, Values: map[string]any{"count": 10, "status": "ok"}, Count: 1},
+		{Operation: "inc", Keys: []triflestats.Key{first, second}, Values: map[string]any{"count": 2}, Count: 3},
+		{Operation: "inc", Keys: []triflestats.Key{second}, Values: map[string]any{}, Count: 1},
+	}
+	if err := batcher.WriteBatch(context.Background(), operations); err != nil {
+		t.Fatalf("write batch failed: %v", err)
+	}
+
+	assertValues(t, mustGetOne(t, driver, first), map[string]any{"count": 12, "status": "ok"})
+	assertValues(t, mustGetOne(t, driver, second), map[string]any{"count": 2})
+	assertValues(t, mustGetOne(t, driver, systemBucket("1h", baseAt)), map[string]any{
+		"count": 7,
+		"keys":  map[string]any{"event": 4, "other": 3},
+	})
+}
+
+func countDriver(t *testing.T, driver triflestats.Driver) triflestats.CountDriver {
+	t.Helper()
+	counter, ok := driver.(triflestats.CountDriver)
+	if !ok {
+		t.Skipf("%s does not implement CountDriver", driver.Description())
+	}
+	return counter
+}
+
+func mustInc(t *testing.T, driver triflestats.Driver, key triflestats.Key, values map[string]any) {
+	t.Helper()
+	if err := driver.Inc([]triflestats.Key{key}, values); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+}
+
+func mustSet(t *testing.T, driver triflestats.Driver, key triflestats.Key, values map[string]any) {
+	t.Helper()
+	if err := driver.Set([]triflestats.Key{key}, values); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+}
+
+func mustGet(t *testing.T, driver triflestats.Driver, keys ...triflestats.Key) []map[string]any {
+	t.Helper()
+	got, err := driver.Get(keys)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), len(got))
+	}
+	return got
+}
+
+func mustGetOne(t *testing.T, driver triflestats.Driver, key triflestats.Key) map[string]any {
+	t.Helper()
+	return mustGet(t, driver, key)[0]
+}
+
+func assertValues(t *testing.T, got, want map[string]any) {
+	t.Helper()
+	if err := compareValues("", got, want); err != nil {
+		t.Fatalf("%v\n got: %#v\nwant: %#v", err, got, want)
+	}
+}
+
+func compareValues(path string, got, want any) error {
+	if wantMap, ok := asMap(want); ok {
+		gotMap, ok := asMap(got)
+		if !ok {
+			return fmt.Errorf("%s: expected a map, got %T", displayPath(path), got)
+		}
+		if len(gotMap) != len(wantMap) {
+			return fmt.Errorf("%s: expected %d fields, got %d", displayPath(path), len(wantMap), len(gotMap))
+		}
+		for field, wantValue := range wantMap {
+			gotValue, ok := gotMap[field]
+			if !ok {
+				return fmt.Errorf("%s: missing field", displayPath(joinPath(path, field)))
+			}
+			if err := compareValues(joinPath(path, field), gotValue, wantValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if wantNumber, ok := asNumber(want); ok {
+		gotNumber, ok := asNumber(got)
+		if !ok {
+			return fmt.Errorf("%s: expected number %v, got %#v", displayPath(path), wantNumber, got)
+		}
+		if math.Abs(gotNumber-wantNumber) > 1e-9 {
+			return fmt.Errorf("%s: expected %v, got %v", displayPath(path), wantNumber, gotNumber)
+		}
+		return nil
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("%s: expected %#v, got %#v", displayPath(path), want, got)
+	}
+	return nil
+}
+
+func asMap(value any) (map[string]any, bool) {
+	if value == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	out := make(map[string]any, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		out[iter.Key().String()] = iter.Value().Interface()
+	}
+	return out, true
+}
+
+func asNumber(value any) (float64, bool) {
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "values"
+	}
+	return path
+}
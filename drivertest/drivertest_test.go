@@ -0,0 +1,66 @@
+package drivertest_test
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	triflestats "github.com/trifle-io/trifle_stats_go"
+	"github.com/trifle-io/trifle_stats_go/drivertest"
+	_ "modernc.org/sqlite"
+)
+
+var modes = map[string]triflestats.JoinedIdentifier{
+	"full":      triflestats.JoinedFull,
+	"partial":   triflestats.JoinedPartial,
+	"separated": triflestats.JoinedSeparated,
+}
+
+func TestMemoryDriverConformance(t *testing.T) {
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			drivertest.RunConformance(t, func(t *testing.T) triflestats.Driver {
+				return triflestats.NewMemoryDriver(mode)
+			})
+		})
+	}
+}
+
+func TestSQLiteDriverConformance(t *testing.T) {
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			drivertest.RunConformance(t, func(t *testing.T) triflestats.Driver {
+				dsn := fmt.Sprintf("file:conformance_%d?mode=memory&cache=shared", time.Now().UnixNano())
+				db, err := sql.Open("sqlite", dsn)
+				if err != nil {
+					t.Fatalf("open db failed: %v", err)
+				}
+				t.Cleanup(func() { _ = db.Close() })
+
+				driver := triflestats.NewSQLiteDriver(db, "trifle_stats", mode)
+				if err := driver.Setup(); err != nil {
+					t.Fatalf("setup failed: %v", err)
+				}
+				return driver
+			})
+		})
+	}
+}
+
+func TestRedisDriverConformance(t *testing.T) {
+	drivertest.RunConformance(t, func(t *testing.T) triflestats.Driver {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatalf("start miniredis failed: %v", err)
+		}
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() {
+			_ = client.Close()
+			server.Close()
+		})
+		return triflestats.NewRedisDriver(client, "test")
+	})
+}
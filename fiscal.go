@@ -0,0 +1,109 @@
+package triflestats
+
+import "time"
+
+// FiscalCalendar selects how fiscal quarters and years are laid out.
+type FiscalCalendar int
+
+const (
+	// FiscalMonths starts fiscal years on the first of FiscalYearStartMonth,
+	// with quarters of three months.
+	FiscalMonths FiscalCalendar = iota
+	// Fiscal445 is the 4-4-5 retail calendar of whole weeks. Fiscal years
+	// start on the BeginningOfWeek day nearest to the first of
+	// FiscalYearStartMonth and last 52 or 53 weeks. Quarters last 13 weeks
+	// and the last one takes the 53rd week.
+	Fiscal445
+)
+
+const weeksPerFiscalQuarter = 13
+
+func (c *Config) fiscalYearStartMonth() time.Month {
+	if c == nil || c.FiscalYearStartMonth < time.January || c.FiscalYearStartMonth > time.December {
+		return time.January
+	}
+	return c.FiscalYearStartMonth
+}
+
+func (c *Config) fiscalCalendar() FiscalCalendar {
+	if c == nil {
+		return FiscalMonths
+	}
+	return c.FiscalCalendar
+}
+
+// fiscalQuarterOf returns the fiscal year and zero-based quarter holding a
+// date. Fiscal years are numbered by the calendar year they start in.
+func (n *Nocturnal) fiscalQuarterOf(year int, month time.Month, day int) (int, int) {
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	fiscalYear := year
+	if date.Before(n.fiscalYearStart(fiscalYear)) {
+		fiscalYear--
+	} else if !date.Before(n.fiscalYearStart(fiscalYear + 1)) {
+		fiscalYear++
+	}
+
+	start := n.fiscalYearStart(fiscalYear)
+	if n.Config.fiscalCalendar() == Fiscal445 {
+		weeks := int(date.Sub(start) / (7 * 24 * time.Hour))
+		return fiscalYear, min(weeks/weeksPerFiscalQuarter, 3)
+	}
+	months := (date.Year()-start.Year())*12 + int(date.Month()) - int(start.Month())
+	return fiscalYear, months / 3
+}
+
+// fiscalQuarterStart returns the first date of a fiscal quarter. Quarters past
+// the fourth continue into the following fiscal years.
+func (n *Nocturnal) fiscalQuarterStart(fiscalYear, quarter int) time.Time {
+	fiscalYear += floorDiv(quarter, 4)
+	quarter = mod(quarter, 4)
+
+	start := n.fiscalYearStart(fiscalYear)
+	if n.Config.fiscalCalendar() == Fiscal445 {
+		return start.AddDate(0, 0, quarter*weeksPerFiscalQuarter*7)
+	}
+	return start.AddDate(0, quarter*3, 0)
+}
+
+// fiscalYearStart returns the first date of a fiscal year.
+func (n *Nocturnal) fiscalYearStart(fiscalYear int) time.Time {
+	first := time.Date(fiscalYear, n.Config.fiscalYearStartMonth(), 1, 0, 0, 0, 0, time.UTC)
+	if n.Config.fiscalCalendar() != Fiscal445 {
+		return first
+	}
+
+	shift := mod(daysIntoWeek(n.configBeginningOfWeek())-int(first.Weekday()), 7)
+	if shift > 3 {
+		shift -= 7
+	}
+	return first.AddDate(0, 0, shift)
+}
+
+// addFiscal moves t by fiscal quarters or years. The 4-4-5 calendar keeps the
+// position within the quarter, clamped to the end of shorter quarters.
+func (n *Nocturnal) addFiscal(t time.Time, offset int, unit Unit) time.Time {
+	if n.Config.fiscalCalendar() != Fiscal445 {
+		if unit == UnitFiscalYear {
+			return addYears(t, offset)
+		}
+		return addMonths(t, offset*3)
+	}
+
+	year, month, day := t.Date()
+	fiscalYear, quarter := n.fiscalQuarterOf(year, month, day)
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	elapsed := date.Sub(n.fiscalQuarterStart(fiscalYear, quarter))
+
+	if unit == UnitFiscalYear {
+		fiscalYear += offset
+	} else {
+		quarter += offset
+	}
+	start := n.fiscalQuarterStart(fiscalYear, quarter)
+	last := n.fiscalQuarterStart(fiscalYear, quarter+1).AddDate(0, 0, -1)
+	target := start.Add(elapsed)
+	if target.After(last) {
+		target = last
+	}
+	return time.Date(target.Year(), target.Month(), target.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
@@ -0,0 +1,190 @@
+package triflestats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newFiscalConfig(startMonth time.Month, calendar FiscalCalendar) *Config {
+	cfg := DefaultConfig()
+	cfg.TimeZone = "UTC"
+	cfg.BeginningOfWeek = time.Sunday
+	cfg.FiscalYearStartMonth = startMonth
+	cfg.FiscalCalendar = calendar
+	return cfg
+}
+
+func TestParseGranularityFiscal(t *testing.T) {
+	offset, unit, ok := ParseGranularity("1fq")
+	if !ok || offset != 1 || unit != UnitFiscalQuarter {
+		t.Fatalf("unexpected fiscal quarter parse: %d %v %v", offset, unit, ok)
+	}
+	offset, unit, ok = ParseGranularity("2fy")
+	if !ok || offset != 2 || unit != UnitFiscalYear {
+		t.Fatalf("unexpected fiscal year parse: %d %v %v", offset, unit, ok)
+	}
+}
+
+func TestNocturnalFiscalMonths(t *testing.T) {
+	loc := time.UTC
+	cfg := newFiscalConfig(time.February, FiscalMonths)
+
+	cases := []struct {
+		at       time.Time
+		offset   int
+		unit     Unit
+		expected time.Time
+	}{
+		{time.Date(2025, 1, 15, 10, 0, 0, 0, loc), 1, UnitFiscalQuarter, time.Date(2024, 11, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 1, 15, 10, 0, 0, 0, loc), 1, UnitFiscalYear, time.Date(2024, 2, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 2, 1, 0, 0, 0, 0, loc), 1, UnitFiscalQuarter, time.Date(2025, 2, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 9, 10, 0, 0, 0, 0, loc), 2, UnitFiscalQuarter, time.Date(2025, 8, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 7, 31, 0, 0, 0, 0, loc), 2, UnitFiscalQuarter, time.Date(2025, 2, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2025, 1, 31, 0, 0, 0, 0, loc), 2, UnitFiscalYear, time.Date(2024, 2, 1, 0, 0, 0, 0, loc)},
+	}
+	for _, tc := range cases {
+		if got := NewNocturnal(tc.at, cfg).Floor(tc.offset, tc.unit); !got.Equal(tc.expected) {
+			t.Fatalf("floor %v to %d/%v: expected %v, got %v", tc.at, tc.offset, tc.unit, tc.expected, got)
+		}
+	}
+
+	timeline := Timeline(time.Date(2025, 1, 1, 0, 0, 0, 0, loc), time.Date(2025, 12, 31, 0, 0, 0, 0, loc), 1, UnitFiscalQuarter, cfg)
+	expected := []time.Time{
+		time.Date(2024, 11, 1, 0, 0, 0, 0, loc),
+		time.Date(2025, 2, 1, 0, 0, 0, 0, loc),
+		time.Date(2025, 5, 1, 0, 0, 0, 0, loc),
+		time.Date(2025, 8, 1, 0, 0, 0, 0, loc),
+		time.Date(2025, 11, 1, 0, 0, 0, 0, loc),
+	}
+	if !reflect.DeepEqual(timeline, expected) {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+
+	added := NewNocturnal(time.Date(2025, 1, 31, 0, 0, 0, 0, loc), cfg).Add(1, UnitFiscalQuarter)
+	if !added.Equal(time.Date(2025, 4, 30, 0, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected fiscal quarter add: %v", added)
+	}
+}
+
+func TestNocturnalFiscal445(t *testing.T) {
+	loc := time.UTC
+	cfg := newFiscalConfig(time.February, Fiscal445)
+
+	// Fiscal 2023 starts on 2023-01-29 and runs 53 weeks, so its last quarter
+	// lasts 14 weeks until fiscal 2024 starts on 2024-02-04.
+	at := time.Date(2024, 2, 3, 12, 0, 0, 0, loc)
+	n := NewNocturnal(at, cfg)
+	if got := n.Floor(1, UnitFiscalYear); !got.Equal(time.Date(2023, 1, 29, 0, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected fiscal year start: %v", got)
+	}
+	if got := n.Floor(1, UnitFiscalQuarter); !got.Equal(time.Date(2023, 10, 29, 0, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected fiscal quarter start: %v", got)
+	}
+	if got := n.Next(1, UnitFiscalQuarter); !got.Equal(time.Date(2024, 2, 4, 0, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected next fiscal quarter: %v", got)
+	}
+
+	// The 98th day of a 14 week quarter clamps to the end of a 13 week one.
+	if got := n.Add(1, UnitFiscalQuarter); !got.Equal(time.Date(2024, 5, 4, 12, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected fiscal quarter add: %v", got)
+	}
+}
+
+func TestNocturnalFiscal445Timeline(t *testing.T) {
+	cfg := newFiscalConfig(time.February, Fiscal445)
+	from := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2035, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	years := Timeline(from, to, 1, UnitFiscalYear, cfg)
+	for idx, start := range years {
+		if start.Weekday() != time.Sunday {
+			t.Fatalf("fiscal year %v does not start on a Sunday", start)
+		}
+		if distance := start.Sub(time.Date(start.Year(), time.February, 1, 0, 0, 0, 0, time.UTC)); distance.Abs() > 3*24*time.Hour {
+			t.Fatalf("fiscal year %v is not nearest to February 1st", start)
+		}
+		if idx > 0 {
+			if weeks := start.Sub(years[idx-1]) / (7 * 24 * time.Hour); weeks != 52 && weeks != 53 {
+				t.Fatalf("fiscal year %v lasts %d weeks", years[idx-1], weeks)
+			}
+		}
+	}
+
+	quarters := Timeline(from, to, 1, UnitFiscalQuarter, cfg)
+	for idx := 1; idx < len(quarters); idx++ {
+		previous, start := quarters[idx-1], quarters[idx]
+		weeks := start.Sub(previous) / (7 * 24 * time.Hour)
+		_, quarter := NewNocturnal(previous, cfg).fiscalQuarterOf(previous.Date())
+		if weeks != 13 && !(weeks == 14 && quarter == 3) {
+			t.Fatalf("fiscal quarter %v lasts %d weeks", previous, weeks)
+		}
+		if got := NewNocturnal(start.Add(-time.Nanosecond), cfg).Floor(1, UnitFiscalQuarter); !got.Equal(previous) {
+			t.Fatalf("instant before %v floors to %v", start, got)
+		}
+	}
+}
+
+func TestGranularityNestsFiscal(t *testing.T) {
+	months := newFiscalConfig(time.February, FiscalMonths)
+	april := newFiscalConfig(time.April, FiscalMonths)
+	retail := newFiscalConfig(time.February, Fiscal445)
+
+	cases := []struct {
+		cfg            *Config
+		source, target string
+		nests          bool
+	}{
+		{months, "1h", "1fq", true},
+		{months, "1d", "1fy", true},
+		{months, "1w", "1fq", false},
+		{months, "1mo", "1fq", true},
+		{months, "2mo", "1fq", false},
+		{months, "1q", "1fq", false},
+		{april, "1q", "1fq", true},
+		{months, "1y", "1fy", false},
+		{months, "1fq", "1fy", true},
+		{months, "1fq", "2fq", true},
+		{months, "1fq", "1y", false},
+		{retail, "1d", "1fq", true},
+		{retail, "1mo", "1fq", false},
+		{retail, "1fq", "1fy", true},
+	}
+	for _, tc := range cases {
+		if got := granularityNests(tc.cfg, NewParser(tc.source), NewParser(tc.target)); got != tc.nests {
+			t.Fatalf("granularityNests(%s, %s) = %v, want %v", tc.source, tc.target, got, tc.nests)
+		}
+	}
+}
+
+func TestValuesRollupIntoFiscalQuarters(t *testing.T) {
+	cfg := newRollupConfig("1mo", "1fy")
+	cfg.FiscalYearStartMonth = time.February
+	for month := time.January; month <= time.June; month++ {
+		if err := Track(cfg, "orders", time.Date(2025, month, 10, 0, 0, 0, 0, time.UTC), map[string]any{"count": 1}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+	}
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	result, err := Values(cfg, "orders", from, to, "1fq", false, Rollup(RollupSum))
+	if err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	counts := make([]any, 0, len(result.Values))
+	for _, values := range result.Values {
+		counts = append(counts, values["count"])
+	}
+	if !reflect.DeepEqual(counts, []any{float64(1), float64(3), float64(2)}) {
+		t.Fatalf("unexpected fiscal quarter counts: %v at %v", counts, result.At)
+	}
+
+	years, err := Values(cfg, "orders", from, to, "1fy", false)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if len(years.Values) != 2 || years.Values[0]["count"] != float64(1) || years.Values[1]["count"] != float64(5) {
+		t.Fatalf("unexpected fiscal year values: %+v", years)
+	}
+}
@@ -0,0 +1,164 @@
+package triflestats
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryDriver_Description(t *testing.T) {
+	cases := map[JoinedIdentifier]string{
+		JoinedFull:      "MemoryDriver(J)",
+		JoinedPartial:   "MemoryDriver(P)",
+		JoinedSeparated: "MemoryDriver(S)",
+	}
+	for mode, expected := range cases {
+		if got := NewMemoryDriver(mode).Description(); got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+}
+
+func TestMemoryDriver_SetIncGetAndSystemTracking(t *testing.T) {
+	for _, mode := range []JoinedIdentifier{JoinedFull, JoinedPartial, JoinedSeparated} {
+		t.Run(modeName(mode), func(t *testing.T) {
+			driver := NewMemoryDriver(mode)
+			at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+			key := Key{Key: "event", Granularity: "1h", At: &at}
+			untracked := Key{Key: "other", TrackingKey: untrackedKeyName, Granularity: "1h", At: &at}
+
+			if err := driver.SetCount([]Key{key}, map[string]any{"count": 1, "meta": map[string]any{"duration": 2}, "status": "ok"}, 2); err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+			if err := driver.Inc([]Key{key, untracked}, map[string]any{"count": 2, "meta": map[string]any{"duration": 0.5}}); err != nil {
+				t.Fatalf("inc failed: %v", err)
+			}
+
+			got, err := driver.Get([]Key{key, {Key: "missing", Granularity: "1h", At: &at}})
+			if err != nil {
+				t.Fatalf("get failed: %v", err)
+			}
+			expected := map[string]any{
+				"count":  float64(3),
+				"meta":   map[string]any{"duration": 2.5},
+				"status": "ok",
+			}
+			if !reflect.DeepEqual(got[0], expected) {
+				t.Fatalf("unexpected values: %+v", got[0])
+			}
+			if len(got[1]) != 0 {
+				t.Fatalf("expected missing key to be empty, got %+v", got[1])
+			}
+
+			system, err := driver.Get([]Key{{Key: systemKeyName, Granularity: "1h", At: &at}})
+			if err != nil {
+				t.Fatalf("get system failed: %v", err)
+			}
+			expectedSystem := map[string]any{
+				"count": float64(4),
+				"keys": map[string]any{
+					"event":          float64(3),
+					untrackedKeyName: float64(1),
+				},
+			}
+			if !reflect.DeepEqual(system[0], expectedSystem) {
+				t.Fatalf("unexpected system tracking: %+v", system[0])
+			}
+		})
+	}
+}
+
+func TestMemoryDriver_RejectedWritesLeaveStoreUntouched(t *testing.T) {
+	driver := NewMemoryDriver(JoinedFull)
+	at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "event", Granularity: "1h", At: &at}
+
+	if err := driver.Inc([]Key{key}, map[string]any{"count": 1, "status": "bad"}); err == nil {
+		t.Fatalf("expected non-numeric increment error")
+	}
+	got, err := driver.Get([]Key{key, {Key: systemKeyName, Granularity: "1h", At: &at}})
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if len(got[0]) != 0 || len(got[1]) != 0 {
+		t.Fatalf("expected nothing written, got %+v", got)
+	}
+
+	partial := NewMemoryDriver(JoinedPartial)
+	if err := partial.Inc([]Key{{Key: "event", Granularity: "1h"}}, map[string]any{"count": 1}); err == nil {
+		t.Fatalf("expected missing At error in partial mode")
+	}
+}
+
+func TestMemoryDriver_SnapshotRestore(t *testing.T) {
+	driver := NewMemoryDriver(JoinedSeparated)
+	at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "event", Granularity: "1h", At: &at}
+
+	if err := driver.Inc([]Key{key}, map[string]any{"count": 3, "meta": map[string]any{"duration": 1.5}}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	if err := driver.Ping(context.Background(), "workers", at, map[string]any{"busy": 2}); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := driver.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	restored := NewMemoryDriver(JoinedSeparated)
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	keys := []Key{key, {Key: systemKeyName, Granularity: "1h", At: &at}}
+	original, err := driver.Get(keys)
+	if err != nil {
+		t.Fatalf("get original failed: %v", err)
+	}
+	got, err := restored.Get(keys)
+	if err != nil {
+		t.Fatalf("get restored failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, original) {
+		t.Fatalf("restored values differ: %+v vs %+v", got, original)
+	}
+
+	scan, err := restored.Scan(context.Background(), "workers")
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(scan.At) != 1 || !scan.At[0].Equal(at) || scan.Values[0]["busy"] != float64(2) {
+		t.Fatalf("unexpected restored scan: %+v", scan)
+	}
+
+	if err := restored.Restore(bytes.NewBufferString("not json")); err == nil {
+		t.Fatalf("expected restore error for invalid snapshot")
+	}
+}
+
+func TestMemoryDriver_BacksTrackAndValues(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Driver = NewMemoryDriver(JoinedFull)
+	cfg.TimeZone = "UTC"
+	cfg.Granularities = []string{"1h", "1d"}
+	cfg.BufferEnabled = false
+
+	at := time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := Track(cfg, "orders", at, map[string]any{"count": 1}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+	}
+
+	result, err := Values(cfg, "orders", at.Add(-time.Hour), at.Add(time.Hour), "1d", true)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if len(result.Values) != 1 || result.Values[0]["count"] != float64(3) {
+		t.Fatalf("unexpected values: %+v", result)
+	}
+}
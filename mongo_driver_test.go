@@ -2,6 +2,7 @@ package triflestats
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -65,7 +66,7 @@ func TestMongoDriver_SetupCreatesIndexes(t *testing.T) {
 		driver := NewMongoDriver(mt.Coll, JoinedSeparated)
 		driver.ExpireAfter = 5 * time.Minute
 
-		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
 
 		if err := driver.Setup(context.Background()); err != nil {
 			mt.Fatalf("setup failed: %v", err)
@@ -98,7 +99,7 @@ func TestMongoDriver_BuildUpdateDocument(t *testing.T) {
 	driver.ExpireAfter = 10 * time.Minute
 
 	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
-	incUpdate, err := driver.buildUpdateDocument("inc", map[string]any{"count": 2, "meta.duration": 3}, &at)
+	incUpdate, err := driver.buildUpdateDocument("inc", map[string]any{"count": 2, "meta.duration": 3}, "1h", &at)
 	if err != nil {
 		t.Fatalf("build inc update failed: %v", err)
 	}
@@ -109,7 +110,7 @@ func TestMongoDriver_BuildUpdateDocument(t *testing.T) {
 		t.Fatalf("expected $set clause for expire_at")
 	}
 
-	setUpdate, err := driver.buildUpdateDocument("set", map[string]any{"status": "ok"}, &at)
+	setUpdate, err := driver.buildUpdateDocument("set", map[string]any{"status": "ok"}, "1h", &at)
 	if err != nil {
 		t.Fatalf("build set update failed: %v", err)
 	}
@@ -124,11 +125,36 @@ func TestMongoDriver_BuildUpdateDocument(t *testing.T) {
 		t.Fatalf("expected expire_at field in set clause")
 	}
 
-	if _, err := driver.buildUpdateDocument("inc", map[string]any{"status": "invalid"}, &at); err == nil {
+	if _, err := driver.buildUpdateDocument("inc", map[string]any{"status": "invalid"}, "1h", &at); err == nil {
 		t.Fatalf("expected non-numeric increment error")
 	}
 }
 
+func TestMongoDriver_ExpireAtPrefersRetention(t *testing.T) {
+	driver := NewMongoDriver(nil, JoinedFull)
+	driver.ExpireAfter = 10 * time.Minute
+	driver.Retention = Retention{"1m": time.Hour, "1d": 0}
+
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	if got := driver.expireAtFor("1m", &at); got == nil || !got.Equal(at.Add(time.Hour)) {
+		t.Fatalf("expected 1m retention expiry, got %v", got)
+	}
+	if got := driver.expireAtFor("1h", &at); got == nil || !got.Equal(at.Add(10*time.Minute)) {
+		t.Fatalf("expected ExpireAfter fallback for 1h, got %v", got)
+	}
+	if got := driver.expireAtFor("1d", &at); got != nil {
+		t.Fatalf("expected 1d to be kept forever, got %v", got)
+	}
+
+	update, err := driver.buildUpdateDocument("set", map[string]any{"status": "ok"}, "1d", &at)
+	if err != nil {
+		t.Fatalf("build set update failed: %v", err)
+	}
+	if _, ok := update["$set"].(bson.M)["expire_at"]; ok {
+		t.Fatalf("expected no expire_at for retained granularity, got %+v", update)
+	}
+}
+
 func TestMongoDriver_IncCountBulkWriteAndTracking(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
 	mt.Run("bulk write", func(mt *mtest.T) {
@@ -193,6 +219,108 @@ func TestMongoDriver_IncCountSequentialUpdatesWhenBulkWriteDisabled(t *testing.T
 	})
 }
 
+func TestMongoDriver_WriteBatchSendsSingleBulkWrite(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("write batch", func(mt *mtest.T) {
+		driver := NewMongoDriver(mt.Coll, JoinedFull)
+		driver.BulkWrite = true
+		driver.SystemTracking = true
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+		err := driver.WriteBatch(context.Background(), []BatchOperation{
+			{Operation: "inc", Keys: []Key{{Key: "events", Granularity: "1h", At: &at}}, Values: map[string]any{"count": 1}, Count: 2},
+			{Operation: "set", Keys: []Key{{Key: "status", Granularity: "1h", At: &at}}, Values: map[string]any{"state": "ok"}, Count: 1},
+		})
+		if err != nil {
+			mt.Fatalf("write batch failed: %v", err)
+		}
+
+		events := mt.GetAllStartedEvents()
+		if len(events) != 1 || events[0].CommandName != "update" {
+			mt.Fatalf("expected a single update command, got %d events", len(events))
+		}
+		command := events[0].Command.String()
+		if !(strings.Contains(command, "events") && strings.Contains(command, "status") && strings.Contains(command, "__system__key__")) {
+			mt.Fatalf("expected both operations in one command: %s", command)
+		}
+	})
+}
+
+func TestMongoDriver_WriteBatchReportsOperationsBeforeBulkWriteError(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("partial bulk write", func(mt *mtest.T) {
+		driver := NewMongoDriver(mt.Coll, JoinedFull)
+		driver.BulkWrite = true
+		driver.SystemTracking = true
+
+		// Each operation writes its data and system documents, so model 3 is
+		// the system document of the second operation.
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 3, Code: 11000, Message: "duplicate key"}))
+
+		at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+		err := driver.WriteBatch(context.Background(), []BatchOperation{
+			{Operation: "inc", Keys: []Key{{Key: "a", Granularity: "1h", At: &at}}, Values: map[string]any{"count": 1}, Count: 1},
+			{Operation: "inc", Keys: []Key{{Key: "b", Granularity: "1h", At: &at}}, Values: map[string]any{"count": 1}, Count: 1},
+			{Operation: "inc", Keys: []Key{{Key: "c", Granularity: "1h", At: &at}}, Values: map[string]any{"count": 1}, Count: 1},
+		})
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			mt.Fatalf("expected BatchError, got %v", err)
+		}
+		errs := batchErr.Errs
+		if len(errs) != 3 || errs[0] != nil || errs[1] == nil || errors.Is(errs[1], ErrBatchAborted) || !errors.Is(errs[2], ErrBatchAborted) {
+			mt.Fatalf("unexpected operation errors: %v", errs)
+		}
+	})
+}
+
+func TestMongoDriver_WriteBatchRetryReappliesPartiallyWrittenOperation(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("partial operation", func(mt *mtest.T) {
+		driver := NewMongoDriver(mt.Coll, JoinedFull)
+		driver.BulkWrite = false
+		driver.SystemTracking = true
+
+		// The data document of the first operation is written before its
+		// system document fails, yet the operation is reported as failed.
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+		)
+
+		at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+		operations := []BatchOperation{
+			{Operation: "inc", Keys: []Key{{Key: "a", Granularity: "1h", At: &at}}, Values: map[string]any{"count": 1}, Count: 1},
+			{Operation: "inc", Keys: []Key{{Key: "b", Granularity: "1h", At: &at}}, Values: map[string]any{"count": 1}, Count: 1},
+		}
+		err := driver.WriteBatch(context.Background(), operations)
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			mt.Fatalf("expected BatchError, got %v", err)
+		}
+		errs := batchErr.Errs
+		if len(errs) != 2 || errs[0] == nil || errors.Is(errs[0], ErrBatchAborted) || !errors.Is(errs[1], ErrBatchAborted) {
+			mt.Fatalf("unexpected operation errors: %v", errs)
+		}
+
+		// Retrying the failed operation sends its data increment a second time.
+		mt.ClearEvents()
+		mt.AddMockResponses(mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse())
+		if err := driver.WriteBatch(context.Background(), operations[:1]); err != nil {
+			mt.Fatalf("retry failed: %v", err)
+		}
+		events := mt.GetAllStartedEvents()
+		if len(events) != 2 {
+			mt.Fatalf("expected 2 update commands, got %d", len(events))
+		}
+		if command := events[0].Command.String(); !strings.Contains(command, `"key": "a::1h`) {
+			mt.Fatalf("expected the retry to rewrite the data document of a: %s", command)
+		}
+	})
+}
+
 func TestMongoDriver_SetCountUsesSetOperation(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
 	mt.Run("set count", func(mt *mtest.T) {
@@ -241,13 +369,15 @@ func TestMongoDriver_GetReturnsValuesInOrder(t *testing.T) {
 					}},
 				},
 			),
-			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch),
 		)
 
 		values, err := driver.Get([]Key{key1, key2})
 		if err != nil {
 			mt.Fatalf("get failed: %v", err)
 		}
+		if events := mt.GetAllStartedEvents(); len(events) != 1 || events[0].CommandName != "find" {
+			mt.Fatalf("expected a single find, got %d commands", len(events))
+		}
 		if len(values) != 2 {
 			mt.Fatalf("expected two rows, got %d", len(values))
 		}
@@ -264,6 +394,113 @@ func TestMongoDriver_GetReturnsValuesInOrder(t *testing.T) {
 	})
 }
 
+func TestMongoDriver_GetMatchesSeparatedDocumentsByIdentifier(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("get separated", func(mt *mtest.T) {
+		driver := NewMongoDriver(mt.Coll, JoinedSeparated)
+
+		at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+		later := at.Add(time.Hour)
+		keys := []Key{
+			{Key: "events", Granularity: "1h", At: &at},
+			{Key: "events", Granularity: "1d", At: &at},
+			{Key: "events", Granularity: "1h", At: &later},
+		}
+
+		ns := mt.DB.Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch,
+				bson.D{
+					{Key: "key", Value: "events"},
+					{Key: "granularity", Value: "1h"},
+					{Key: "at", Value: later},
+					{Key: "data", Value: bson.D{{Key: "count", Value: int32(3)}}},
+				},
+				bson.D{
+					{Key: "key", Value: "events"},
+					{Key: "granularity", Value: "1d"},
+					{Key: "at", Value: at},
+					{Key: "data", Value: bson.D{{Key: "count", Value: int32(7)}}},
+				},
+			),
+		)
+
+		values, err := driver.Get(keys)
+		if err != nil {
+			mt.Fatalf("get failed: %v", err)
+		}
+		event := mt.GetStartedEvent()
+		if event == nil || event.CommandName != "find" {
+			mt.Fatalf("expected a find command")
+		}
+		if _, err := event.Command.LookupErr("filter", "$or"); err != nil {
+			mt.Fatalf("expected $or filter, got %v", event.Command)
+		}
+		if len(values[0]) != 0 {
+			mt.Fatalf("expected missing document to be empty, got %+v", values[0])
+		}
+		if got, _ := toFloat(values[1]["count"]); got != 7 {
+			mt.Fatalf("expected daily count 7, got %+v", values[1])
+		}
+		if got, _ := toFloat(values[2]["count"]); got != 3 {
+			mt.Fatalf("expected later hourly count 3, got %+v", values[2])
+		}
+	})
+}
+
+func TestMongoDriver_PingAndScan(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("ping scan", func(mt *mtest.T) {
+		driver := NewMongoDriver(mt.Coll, JoinedFull)
+		if driver.PingCollection.Name() != mt.Coll.Name()+"_ping" {
+			mt.Fatalf("unexpected ping collection name: %s", driver.PingCollection.Name())
+		}
+
+		at := time.Date(2025, 2, 1, 11, 15, 0, 0, time.UTC)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		if err := driver.Ping(context.Background(), "workers", at, map[string]any{"busy": 3}); err != nil {
+			mt.Fatalf("ping failed: %v", err)
+		}
+		event := mt.GetStartedEvent()
+		if event == nil || event.CommandName != "update" {
+			mt.Fatalf("expected update command, got %+v", event)
+		}
+		if !strings.Contains(event.Command.String(), "workers") {
+			mt.Fatalf("expected ping key in update command: %s", event.Command.String())
+		}
+
+		ns := mt.DB.Name() + "." + driver.PingCollection.Name()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch,
+				bson.D{
+					{Key: "key", Value: "workers"},
+					{Key: "at", Value: at},
+					{Key: "data", Value: bson.D{{Key: "busy", Value: int32(3)}}},
+				},
+			),
+		)
+		result, err := driver.Scan(context.Background(), "workers")
+		if err != nil {
+			mt.Fatalf("scan failed: %v", err)
+		}
+		if len(result.At) != 1 || !result.At[0].Equal(at) {
+			mt.Fatalf("unexpected scan at: %+v", result.At)
+		}
+		if got, ok := toFloat(result.Values[0]["busy"]); !ok || got != 3 {
+			mt.Fatalf("expected busy 3, got %#v", result.Values[0]["busy"])
+		}
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch))
+		missing, err := driver.Scan(context.Background(), "missing")
+		if err != nil {
+			mt.Fatalf("scan missing failed: %v", err)
+		}
+		if len(missing.At) != 0 {
+			mt.Fatalf("expected empty scan, got %+v", missing)
+		}
+	})
+}
+
 func TestNormalizeMongoValue(t *testing.T) {
 	value := bson.M{
 		"meta": bson.D{{Key: "duration", Value: int32(2)}},
@@ -1,6 +1,7 @@
 package triflestats
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 )
 
 func TestMySQLDriver_SetupCreatesModeSpecificSchema(t *testing.T) {
@@ -44,6 +46,8 @@ func TestMySQLDriver_SetupCreatesModeSpecificSchema(t *testing.T) {
 
 			driver := NewMySQLDriver(db, "test_stats", tt.mode)
 			mock.ExpectExec(tt.pattern).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS `test_stats_ping` .*`key` VARCHAR\\(255\\) PRIMARY KEY, `at` DATETIME\\(6\\)").
+				WillReturnResult(sqlmock.NewResult(0, 0))
 
 			if err := driver.Setup(); err != nil {
 				t.Fatalf("setup failed: %v", err)
@@ -233,6 +237,46 @@ func TestMySQLDriver_GetReturnsEmptyMapWhenMissing(t *testing.T) {
 	}
 }
 
+func TestMySQLDriver_PingAndScan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewMySQLDriver(db, "test_stats", JoinedFull)
+	at := time.Date(2025, 2, 1, 11, 15, 0, 0, time.UTC)
+
+	mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `test_stats_ping` (`key`, `at`, `data`) VALUES (?, ?, CAST(? AS JSON)) ON DUPLICATE KEY UPDATE `at` = ?, `data` = CAST(? AS JSON);",
+	)).
+		WithArgs("workers", formatMySQLAt(at), sqlmock.AnyArg(), formatMySQLAt(at), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := driver.Ping(context.Background(), "workers", at, map[string]any{"busy": 3}); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `at`, CAST(`data` AS CHAR) AS data FROM `test_stats_ping` WHERE `key` = ? LIMIT 1;")).
+		WithArgs("workers").
+		WillReturnRows(sqlmock.NewRows([]string{"at", "data"}).AddRow(formatMySQLAt(at), `{"busy":3}`))
+
+	result, err := driver.Scan(context.Background(), "workers")
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(result.At) != 1 || !result.At[0].Equal(at) {
+		t.Fatalf("unexpected scan at: %+v", result.At)
+	}
+	if got := result.Values[0]["busy"]; got != float64(3) {
+		t.Fatalf("expected busy 3, got %#v", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestMySQLDriver_IntegrationModes(t *testing.T) {
 	dsn := os.Getenv("MYSQL_DSN")
 	if dsn == "" {
@@ -260,7 +304,7 @@ func TestMySQLDriver_IntegrationModes(t *testing.T) {
 				t.Fatalf("setup failed: %v", err)
 			}
 			defer func() {
-				_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+				_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s_ping", table, table))
 			}()
 
 			at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
@@ -297,3 +341,87 @@ func TestMySQLDriver_IntegrationModes(t *testing.T) {
 		})
 	}
 }
+
+func TestMySQLDriver_SetupAddsExpireAtToExistingTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewMySQLDriver(db, "test_stats", JoinedFull)
+	driver.Retention = Retention{"1h": 24 * time.Hour}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS `test_stats`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `test_stats` ADD COLUMN `expire_at` DATETIME(6) NULL;")).
+		WillReturnError(&mysql.MySQLError{Number: 1142, Message: "ALTER command denied"})
+	if err := driver.Setup(); err == nil {
+		t.Fatalf("expected setup to fail when expire_at cannot be added")
+	}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS `test_stats`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `test_stats` ADD COLUMN `expire_at` DATETIME(6) NULL;")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX `test_stats_expire_at_idx` ON `test_stats` (`expire_at`);")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS `test_stats_ping`").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMySQLDriver_RetentionStampsExpireAtAndPurges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewMySQLDriver(db, "test_stats", JoinedFull)
+	driver.SystemTracking = false
+	driver.Retention = Retention{"1h": 24 * time.Hour}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS `test_stats` .*`expire_at` DATETIME\\(6\\) NULL").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `test_stats` ADD COLUMN `expire_at` DATETIME(6) NULL;")).
+		WillReturnError(&mysql.MySQLError{Number: 1060, Message: "Duplicate column name"})
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX `test_stats_expire_at_idx` ON `test_stats` (`expire_at`);")).
+		WillReturnError(&mysql.MySQLError{Number: 1061, Message: "Duplicate key name"})
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS `test_stats_ping`").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup should tolerate an existing expire_at column and index: %v", err)
+	}
+
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	key := Key{Key: "events", Granularity: "1h", At: &at}
+	expireAt := "2025-02-02 11:00:00.000000"
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		"INSERT INTO `test_stats` (`key`, `data`, `expire_at`) VALUES (?, CAST(? AS JSON), ?) ON DUPLICATE KEY UPDATE `data` = JSON_SET(COALESCE(`data`, JSON_OBJECT()), '$.\"status\"', CAST(? AS JSON)), `expire_at` = ?;",
+	)).
+		WithArgs(key.Join("::"), sqlmock.AnyArg(), expireAt, `"ok"`, expireAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := driver.Set([]Key{key}, map[string]any{"status": "ok"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `test_stats` WHERE `expire_at` <= ?;")).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	purged, err := driver.Purge(context.Background())
+	if err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("expected 2 purged rows, got %d", purged)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -17,6 +17,8 @@ const (
 	UnitMonth
 	UnitQuarter
 	UnitYear
+	UnitFiscalQuarter
+	UnitFiscalYear
 )
 
 var unitMap = map[string]Unit{
@@ -28,6 +30,8 @@ var unitMap = map[string]Unit{
 	"mo": UnitMonth,
 	"q":  UnitQuarter,
 	"y":  UnitYear,
+	"fq": UnitFiscalQuarter,
+	"fy": UnitFiscalYear,
 }
 
 // Parser parses granularity strings like "15m".
@@ -37,7 +41,7 @@ type Parser struct {
 	Unit   Unit
 }
 
-// ParseGranularity parses strings like "1m", "15m", "1h".
+// ParseGranularity parses strings like "1m", "15m", "1h" or "1fq".
 func ParseGranularity(s string) (int, Unit, bool) {
 	var offset int
 	var unitStr string
@@ -83,7 +87,26 @@ func (p *Parser) Valid() bool {
 	return p != nil && p.Offset > 0
 }
 
-// Nocturnal handles time bucketing.
+// Nocturnal handles time bucketing in the configured time zone.
+//
+// Buckets of a day or longer follow the wall clock: they start at the first
+// instant of a local date, which is later than midnight in zones where DST
+// begins at midnight, so days may last 23 or 25 hours.
+//
+// Sub-day buckets are measured in time elapsed since the start of the local
+// day. Hours count from the day start, minutes restart every elapsed hour and
+// seconds every elapsed minute. On regular days this matches the wall clock.
+// On DST transition days every bucket keeps its real length, so a repeated
+// hour gets a bucket of its own and a skipped hour gets none. The last bucket
+// of a day ends at the next day start and may be shorter.
+//
+// Config.DayStartOffset moves the day start away from midnight. A day is then
+// named after the local date it starts on and runs until the same wall-clock
+// time on the following date, and every bucket is anchored at day starts.
+//
+// Config.Alignment set to AlignEpoch tiles buckets from a fixed anchor instead
+// of restarting them every minute, hour, day or year. Sub-day buckets then
+// follow absolute time and may start at any wall-clock time on DST days.
 type Nocturnal struct {
 	Time   time.Time
 	Config *Config
@@ -102,12 +125,47 @@ func Timeline(from, to time.Time, offset int, unit Unit, cfg *Config) []time.Tim
 
 	for t := start; !t.After(end); {
 		list = append(list, t)
-		t = NewNocturnal(t, cfg).Add(offset, unit)
+		t = NewNocturnal(t, cfg).Next(offset, unit)
 	}
 	return list
 }
 
-// Add adds an offset of unit to the time.
+// Next returns the start of the bucket after the one containing the time.
+// Longer units step by local date rather than with Add, which can resolve a
+// skipped midnight back into the current bucket.
+func (n *Nocturnal) Next(offset int, unit Unit) time.Time {
+	start := n.Floor(offset, unit)
+	var next time.Time
+	switch unit {
+	case UnitSecond, UnitMinute, UnitHour:
+		next = NewNocturnal(start, n.Config).Add(offset, unit)
+	default:
+		year, month, day := n.dayOf(start)
+		switch unit {
+		case UnitDay:
+			day += offset
+		case UnitWeek:
+			day += offset * 7
+		case UnitMonth:
+			month += time.Month(offset)
+		case UnitQuarter:
+			month += time.Month(offset * 3)
+		case UnitYear:
+			year += offset
+		case UnitFiscalQuarter:
+			fiscalYear, quarter := n.fiscalQuarterOf(year, month, day)
+			year, month, day = n.fiscalQuarterStart(fiscalYear, quarter+offset).Date()
+		case UnitFiscalYear:
+			fiscalYear, _ := n.fiscalQuarterOf(year, month, day)
+			year, month, day = n.fiscalQuarterStart(fiscalYear+offset, 0).Date()
+		}
+		next = startOfDay(year, month, day, n.configDayStartOffset(), start.Location())
+	}
+	return NewNocturnal(next, n.Config).Floor(offset, unit)
+}
+
+// Add adds an offset of unit to the time. Sub-day units add elapsed time and
+// longer units move the wall clock by calendar days, months or years.
 func (n *Nocturnal) Add(offset int, unit Unit) time.Time {
 	t := n.ensureLocation(n.Time)
 	if offset == 0 {
@@ -131,6 +189,8 @@ func (n *Nocturnal) Add(offset int, unit Unit) time.Time {
 		return addMonths(t, offset*3)
 	case UnitYear:
 		return addYears(t, offset)
+	case UnitFiscalQuarter, UnitFiscalYear:
+		return n.addFiscal(t, offset, unit)
 	default:
 		panic(fmt.Sprintf("invalid unit: %v", unit))
 	}
@@ -144,54 +204,121 @@ func (n *Nocturnal) Floor(offset int, unit Unit) time.Time {
 
 	t := n.ensureLocation(n.Time)
 	loc := t.Location()
+	dayOffset := n.configDayStartOffset()
+	year, month, day := n.dayOf(t)
+	if n.Config.alignment() == AlignEpoch {
+		return n.floorEpoch(t, year, month, day, offset, unit)
+	}
 
 	switch unit {
-	case UnitSecond:
-		floored := (t.Second() / offset) * offset
-		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), floored, 0, loc)
-	case UnitMinute:
-		floored := (t.Minute() / offset) * offset
-		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), floored, 0, 0, loc)
-	case UnitHour:
-		floored := (t.Hour() / offset) * offset
-		return time.Date(t.Year(), t.Month(), t.Day(), floored, 0, 0, 0, loc)
+	case UnitSecond, UnitMinute, UnitHour:
+		return floorElapsed(t, startOfDay(year, month, day, dayOffset, loc), offset, unit)
 	case UnitDay:
-		dayOfYear := t.YearDay() - 1
+		dayOfYear := yearDay(year, month, day) - 1
 		flooredDays := (dayOfYear / offset) * offset
-		yearStart := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, loc)
-		return yearStart.AddDate(0, 0, flooredDays)
+		return startOfDay(year, time.January, 1+flooredDays, dayOffset, loc)
 	case UnitWeek:
-		yearStart := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, loc)
+		if n.Config.weekMode() == WeekModeISO {
+			isoYear, isoWeek := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).ISOWeek()
+			y, m, d := isoWeekStart(isoYear, ((isoWeek-1)/offset)*offset+1).Date()
+			return startOfDay(y, m, d, dayOffset, loc)
+		}
+
 		weekStartOffset := daysIntoWeek(n.configBeginningOfWeek())
-		yearStartWday := int(yearStart.Weekday())
+		yearStartWday := int(time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC).Weekday())
 		daysToFirst := mod(weekStartOffset-yearStartWday, 7)
-		firstWeekStart := yearStart.AddDate(0, 0, daysToFirst)
 
-		if t.Before(firstWeekStart) {
-			return yearStart
+		dayOfYear := yearDay(year, month, day) - 1
+		if dayOfYear < daysToFirst {
+			return startOfDay(year, time.January, 1, dayOffset, loc)
 		}
 
-		diff := t.Sub(firstWeekStart)
-		weeksSinceFirst := int(diff.Hours() / (24 * 7))
+		weeksSinceFirst := (dayOfYear - daysToFirst) / 7
 		flooredWeeks := (weeksSinceFirst / offset) * offset
-		return firstWeekStart.AddDate(0, 0, flooredWeeks*7)
+		return startOfDay(year, time.January, 1+daysToFirst+flooredWeeks*7, dayOffset, loc)
 	case UnitMonth:
-		monthsFromJan := int(t.Month()) - 1
+		monthsFromJan := int(month) - 1
 		floored := (monthsFromJan / offset) * offset
-		return time.Date(t.Year(), time.Month(floored+1), 1, 0, 0, 0, 0, loc)
+		return startOfDay(year, time.Month(floored+1), 1, dayOffset, loc)
 	case UnitQuarter:
-		currentQuarter := (int(t.Month()) - 1) / 3
+		currentQuarter := (int(month) - 1) / 3
 		floored := (currentQuarter / offset) * offset
-		month := floored*3 + 1
-		return time.Date(t.Year(), time.Month(month), 1, 0, 0, 0, 0, loc)
+		firstMonth := floored*3 + 1
+		return startOfDay(year, time.Month(firstMonth), 1, dayOffset, loc)
 	case UnitYear:
-		floored := (t.Year() / offset) * offset
-		return time.Date(floored, 1, 1, 0, 0, 0, 0, loc)
+		floored := (year / offset) * offset
+		return startOfDay(floored, time.January, 1, dayOffset, loc)
+	case UnitFiscalQuarter:
+		fiscalYear, quarter := n.fiscalQuarterOf(year, month, day)
+		y, m, d := n.fiscalQuarterStart(fiscalYear, (quarter/offset)*offset).Date()
+		return startOfDay(y, m, d, dayOffset, loc)
+	case UnitFiscalYear:
+		fiscalYear, _ := n.fiscalQuarterOf(year, month, day)
+		y, m, d := n.fiscalQuarterStart((fiscalYear/offset)*offset, 0).Date()
+		return startOfDay(y, m, d, dayOffset, loc)
 	default:
 		panic(fmt.Sprintf("invalid unit: %v", unit))
 	}
 }
 
+// floorElapsed floors t to a sub-day bucket by the time elapsed since the
+// start of its day.
+func floorElapsed(t, dayStart time.Time, offset int, unit Unit) time.Time {
+	elapsed := t.Sub(dayStart)
+
+	var base, size time.Duration
+	switch unit {
+	case UnitSecond:
+		base, size = elapsed.Truncate(time.Minute), time.Duration(offset)*time.Second
+	case UnitMinute:
+		base, size = elapsed.Truncate(time.Hour), time.Duration(offset)*time.Minute
+	default:
+		size = time.Duration(offset) * time.Hour
+	}
+	return dayStart.Add(base + (elapsed - base).Truncate(size))
+}
+
+// dayOf returns the date of the day containing t, which differs from the
+// local date of t before the day start when DayStartOffset is set.
+func (n *Nocturnal) dayOf(t time.Time) (int, time.Month, int) {
+	year, month, day := t.Date()
+	dayOffset := n.configDayStartOffset()
+	if dayOffset == 0 {
+		return year, month, day
+	}
+
+	if t.Before(startOfDay(year, month, day, dayOffset, t.Location())) {
+		day--
+	} else if !t.Before(startOfDay(year, month, day+1, dayOffset, t.Location())) {
+		day++
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Date()
+}
+
+// startOfDay returns the first instant of a local date, dayOffset after its
+// midnight on the wall clock. When DST skips that wall-clock time, time.Date
+// resolves it to either side of the gap, so the day then starts when the new
+// offset takes effect. Out-of-range days are normalized.
+func startOfDay(year int, month time.Month, day int, dayOffset time.Duration, loc *time.Location) time.Time {
+	wall := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Add(dayOffset)
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+
+	resolved := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	switch {
+	case resolved.Before(wall):
+		_, end := t.ZoneBounds()
+		return end
+	case resolved.After(wall):
+		start, _ := t.ZoneBounds()
+		return start
+	}
+	return t
+}
+
+func yearDay(year int, month time.Month, day int) int {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).YearDay()
+}
+
 func (n *Nocturnal) ensureLocation(t time.Time) time.Time {
 	loc := time.UTC
 	if n != nil && n.Config != nil {
@@ -207,6 +334,14 @@ func (n *Nocturnal) configBeginningOfWeek() time.Weekday {
 	return n.Config.BeginningOfWeek
 }
 
+// configDayStartOffset returns DayStartOffset reduced to less than a day.
+func (n *Nocturnal) configDayStartOffset() time.Duration {
+	if n == nil || n.Config == nil {
+		return 0
+	}
+	return n.Config.DayStartOffset % (24 * time.Hour)
+}
+
 func daysIntoWeek(day time.Weekday) int {
 	// Match Ruby: Sunday=0, Monday=1, ..., Saturday=6
 	switch day {
@@ -1,9 +1,11 @@
 package triflestats
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
+	_ "time/tzdata"
 )
 
 func TestParser(t *testing.T) {
@@ -86,3 +88,280 @@ func TestNocturnalAddMonths(t *testing.T) {
 		t.Fatalf("expected %v, got %v", expected, added)
 	}
 }
+
+// dstZones covers northern and southern DST, a half-hour DST shift, DST
+// starting at midnight, and fractional offsets without DST.
+var dstZones = []string{
+	"America/New_York",
+	"Europe/London",
+	"Australia/Sydney",
+	"Australia/Lord_Howe",
+	"America/Santiago",
+	"America/Havana",
+	"Asia/Kolkata",
+	"Asia/Kathmandu",
+}
+
+var dstGranularities = []string{"1s", "15s", "1m", "7m", "15m", "45m", "1h", "2h", "5h", "6h", "1d", "1w", "1mo", "1q", "1y", "1fq", "1fy"}
+
+// zoneTransitions returns the instants in 2024 where loc changes its offset.
+func zoneTransitions(loc *time.Location) []time.Time {
+	transitions := []time.Time{}
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for {
+		_, next := at.In(loc).ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			return transitions
+		}
+		transitions = append(transitions, next)
+		at = next
+	}
+}
+
+func TestNocturnalDSTMatrix(t *testing.T) {
+	for _, zone := range dstZones {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Fatalf("load %s: %v", zone, err)
+		}
+		cfg := DefaultConfig()
+		cfg.TimeZone = zone
+
+		windows := []time.Time{time.Date(2024, 6, 15, 12, 0, 0, 0, loc)}
+		windows = append(windows, zoneTransitions(loc)...)
+		for _, transition := range windows {
+			for _, granularity := range dstGranularities {
+				name := fmt.Sprintf("%s/%s/%s", zone, transition.Format(time.RFC3339), granularity)
+				t.Run(name, func(t *testing.T) {
+					checkBuckets(t, cfg, loc, NewParser(granularity), transition)
+				})
+			}
+		}
+	}
+}
+
+// checkBuckets verifies every bucket boundary of the timeline around center
+// and samples instants between them.
+func checkBuckets(t *testing.T, cfg *Config, loc *time.Location, parser *Parser, center time.Time) {
+	t.Helper()
+	size := time.Duration(parser.Offset)
+	window := 26 * time.Hour
+	switch parser.Unit {
+	case UnitSecond:
+		size *= time.Second
+		window = 10 * time.Minute
+	case UnitMinute:
+		size *= time.Minute
+		window = 3 * time.Hour
+	case UnitHour:
+		size *= time.Hour
+	}
+	from, to := center.Add(-window), center.Add(window)
+	floor := func(at time.Time) time.Time {
+		return NewNocturnal(at, cfg).Floor(parser.Offset, parser.Unit)
+	}
+	dayOf := func(at time.Time) time.Time {
+		year, month, day := NewNocturnal(at, cfg).dayOf(at.In(loc))
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	timeline := Timeline(from, to, parser.Offset, parser.Unit, cfg)
+	index := map[int64]int{}
+	for idx, start := range timeline {
+		index[start.UnixNano()] = idx
+		if !floor(start).Equal(start) {
+			t.Fatalf("bucket start %v floors to %v", start, floor(start))
+		}
+		if idx == 0 {
+			continue
+		}
+		previous := timeline[idx-1]
+		if !start.After(previous) {
+			t.Fatalf("timeline not increasing: %v after %v", start, previous)
+		}
+		last := start.Add(-time.Nanosecond)
+		if got := floor(last); !got.Equal(previous) {
+			t.Fatalf("instant before %v floors to %v, expected %v", start, got, previous)
+		}
+		if parser.Unit >= UnitDay {
+			year, month, day := dayOf(start).Date()
+			if !start.Equal(startOfDay(year, month, day, cfg.DayStartOffset, loc)) {
+				t.Fatalf("bucket %v does not start a local day", start)
+			}
+			continue
+		}
+		if length := start.Sub(previous); length > size {
+			t.Fatalf("bucket %v lasts %v, longer than %v", previous, length, size)
+		}
+		if !dayOf(previous).Equal(dayOf(last)) {
+			t.Fatalf("bucket %v crosses the local day", previous)
+		}
+	}
+
+	step := window / 97
+	for at := from; !at.After(to); at = at.Add(step) {
+		n := NewNocturnal(at, cfg)
+		bucket := n.Floor(parser.Offset, parser.Unit)
+		if bucket.After(at) || !n.Next(parser.Offset, parser.Unit).After(at) {
+			t.Fatalf("%v not within its bucket starting %v", at, bucket)
+		}
+		if _, ok := index[bucket.UnixNano()]; !ok {
+			t.Fatalf("bucket %v of %v missing from timeline", bucket, at)
+		}
+		if parser.Unit == UnitDay && !dayOf(bucket).Equal(dayOf(at)) {
+			t.Fatalf("day bucket %v does not hold %v", bucket, at.In(loc))
+		}
+	}
+}
+
+func TestNocturnalHourlyBucketsAcrossNewYorkTransitions(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TimeZone = "America/New_York"
+	loc := cfg.Location()
+
+	fallBack := Timeline(time.Date(2024, 11, 3, 0, 0, 0, 0, loc), time.Date(2024, 11, 3, 23, 59, 0, 0, loc), 1, UnitHour, cfg)
+	if len(fallBack) != 25 {
+		t.Fatalf("expected 25 hourly buckets on fall-back day, got %d", len(fallBack))
+	}
+	first := time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC)  // 01:30 EDT
+	second := time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC) // 01:30 EST
+	a := NewNocturnal(first, cfg).Floor(1, UnitHour)
+	b := NewNocturnal(second, cfg).Floor(1, UnitHour)
+	if a.Equal(b) || b.Sub(a) != time.Hour {
+		t.Fatalf("expected repeated hour to get its own bucket, got %v and %v", a, b)
+	}
+
+	springForward := Timeline(time.Date(2024, 3, 10, 0, 0, 0, 0, loc), time.Date(2024, 3, 10, 23, 59, 0, 0, loc), 1, UnitHour, cfg)
+	if len(springForward) != 23 {
+		t.Fatalf("expected 23 hourly buckets on spring-forward day, got %d", len(springForward))
+	}
+	if got := springForward[2].In(loc); got.Hour() != 3 {
+		t.Fatalf("expected 03:00 after the skipped hour, got %v", got)
+	}
+
+	sixHours := Timeline(time.Date(2024, 11, 3, 0, 0, 0, 0, loc), time.Date(2024, 11, 3, 23, 59, 0, 0, loc), 6, UnitHour, cfg)
+	if len(sixHours) != 5 || sixHours[4].Sub(sixHours[3]) != 6*time.Hour {
+		t.Fatalf("expected five 6h buckets on a 25 hour day, got %v", sixHours)
+	}
+}
+
+func TestNocturnalDayStartsAfterSkippedMidnight(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TimeZone = "America/Santiago"
+	loc := cfg.Location()
+
+	// Clocks jump from 00:00 to 01:00 on 2024-09-08.
+	at := time.Date(2024, 9, 8, 10, 0, 0, 0, loc)
+	floor := NewNocturnal(at, cfg).Floor(1, UnitDay)
+	if local := floor.In(loc); local.Day() != 8 || local.Hour() != 1 {
+		t.Fatalf("expected day to start at 01:00 on the 8th, got %v", local)
+	}
+	if hour := NewNocturnal(at.Add(-9*time.Hour), cfg).Floor(1, UnitHour); !hour.Equal(floor) {
+		t.Fatalf("expected first hour bucket at day start, got %v", hour)
+	}
+}
+
+func TestNocturnalDayStartOffsetMatrix(t *testing.T) {
+	for _, zone := range []string{"America/New_York", "America/Santiago", "Australia/Lord_Howe"} {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Fatalf("load %s: %v", zone, err)
+		}
+		for _, dayOffset := range []time.Duration{6 * time.Hour, 2*time.Hour + 30*time.Minute, -2 * time.Hour} {
+			cfg := DefaultConfig()
+			cfg.TimeZone = zone
+			cfg.DayStartOffset = dayOffset
+
+			for _, transition := range zoneTransitions(loc) {
+				for _, granularity := range []string{"15m", "1h", "8h", "1d", "1w", "1mo", "1y"} {
+					name := fmt.Sprintf("%s/%v/%s/%s", zone, dayOffset, transition.Format(time.RFC3339), granularity)
+					t.Run(name, func(t *testing.T) {
+						checkBuckets(t, cfg, loc, NewParser(granularity), transition)
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestNocturnalDayStartOffset(t *testing.T) {
+	loc := time.UTC
+	cfg := DefaultConfig()
+	cfg.TimeZone = "UTC"
+	cfg.DayStartOffset = 6 * time.Hour
+
+	cases := []struct {
+		at       time.Time
+		offset   int
+		unit     Unit
+		expected time.Time
+	}{
+		{time.Date(2025, 3, 1, 5, 59, 0, 0, loc), 1, UnitDay, time.Date(2025, 2, 28, 6, 0, 0, 0, loc)},
+		{time.Date(2025, 3, 1, 6, 0, 0, 0, loc), 1, UnitDay, time.Date(2025, 3, 1, 6, 0, 0, 0, loc)},
+		{time.Date(2025, 3, 1, 5, 59, 0, 0, loc), 1, UnitMonth, time.Date(2025, 2, 1, 6, 0, 0, 0, loc)},
+		{time.Date(2025, 3, 3, 5, 0, 0, 0, loc), 1, UnitWeek, time.Date(2025, 2, 24, 6, 0, 0, 0, loc)},
+		{time.Date(2025, 1, 1, 3, 0, 0, 0, loc), 1, UnitYear, time.Date(2024, 1, 1, 6, 0, 0, 0, loc)},
+		{time.Date(2025, 3, 1, 5, 59, 0, 0, loc), 1, UnitHour, time.Date(2025, 3, 1, 5, 0, 0, 0, loc)},
+		{time.Date(2025, 3, 1, 5, 59, 0, 0, loc), 8, UnitHour, time.Date(2025, 2, 28, 22, 0, 0, 0, loc)},
+	}
+	for _, tc := range cases {
+		if got := NewNocturnal(tc.at, cfg).Floor(tc.offset, tc.unit); !got.Equal(tc.expected) {
+			t.Fatalf("floor %v to %d/%v: expected %v, got %v", tc.at, tc.offset, tc.unit, tc.expected, got)
+		}
+	}
+
+	added := NewNocturnal(time.Date(2025, 1, 31, 6, 0, 0, 0, loc), cfg).Add(1, UnitMonth)
+	if expected := time.Date(2025, 2, 28, 6, 0, 0, 0, loc); !added.Equal(expected) {
+		t.Fatalf("expected %v, got %v", expected, added)
+	}
+
+	timeline := Timeline(time.Date(2025, 3, 1, 0, 0, 0, 0, loc), time.Date(2025, 3, 2, 12, 0, 0, 0, loc), 1, UnitDay, cfg)
+	expected := []time.Time{
+		time.Date(2025, 2, 28, 6, 0, 0, 0, loc),
+		time.Date(2025, 3, 1, 6, 0, 0, 0, loc),
+		time.Date(2025, 3, 2, 6, 0, 0, 0, loc),
+	}
+	if !reflect.DeepEqual(timeline, expected) {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+}
+
+func TestNocturnalNegativeDayStartOffset(t *testing.T) {
+	loc := time.UTC
+	cfg := DefaultConfig()
+	cfg.TimeZone = "UTC"
+	cfg.DayStartOffset = -2 * time.Hour
+
+	// March starts at 22:00 on the last day of February.
+	at := time.Date(2025, 2, 28, 22, 30, 0, 0, loc)
+	if got := NewNocturnal(at, cfg).Floor(1, UnitMonth); !got.Equal(time.Date(2025, 2, 28, 22, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected month start: %v", got)
+	}
+	if got := NewNocturnal(at.Add(-time.Hour), cfg).Floor(1, UnitMonth); !got.Equal(time.Date(2025, 1, 31, 22, 0, 0, 0, loc)) {
+		t.Fatalf("unexpected month start: %v", got)
+	}
+}
+
+func TestNocturnalDayStartOffsetAcrossDST(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TimeZone = "America/New_York"
+	cfg.DayStartOffset = 6 * time.Hour
+	loc := cfg.Location()
+
+	start := NewNocturnal(time.Date(2024, 3, 10, 12, 0, 0, 0, loc), cfg).Floor(1, UnitDay)
+	next := NewNocturnal(start, cfg).Next(1, UnitDay)
+	if local := start.In(loc); local.Day() != 10 || local.Hour() != 6 {
+		t.Fatalf("expected day to start at 06:00, got %v", local)
+	}
+	if next.In(loc).Hour() != 6 || next.Sub(start) != 24*time.Hour {
+		t.Fatalf("expected next 06:00 a full day later, got %v", next.In(loc))
+	}
+
+	// 02:30 does not exist on 2024-03-10, so that day starts at 03:00.
+	cfg.DayStartOffset = 2*time.Hour + 30*time.Minute
+	skipped := NewNocturnal(time.Date(2024, 3, 10, 12, 0, 0, 0, loc), cfg).Floor(1, UnitDay)
+	if local := skipped.In(loc); local.Hour() != 3 || local.Minute() != 0 {
+		t.Fatalf("expected day to start at 03:00, got %v", local)
+	}
+}
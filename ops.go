@@ -1,6 +1,7 @@
 package triflestats
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -29,15 +30,29 @@ func Untracked() TrackOption {
 
 // Track increments values across configured granularities.
 func Track(cfg *Config, key string, at time.Time, values map[string]any, opts ...TrackOption) error {
-	return trackOrAssert(cfg, key, at, values, "inc", opts...)
+	return TrackContext(context.Background(), cfg, key, at, values, opts...)
+}
+
+// TrackContext increments values across configured granularities using ctx for driver calls.
+func TrackContext(ctx context.Context, cfg *Config, key string, at time.Time, values map[string]any, opts ...TrackOption) error {
+	return trackOrAssert(ctx, cfg, key, at, values, "inc", opts...)
 }
 
 // Assert sets values across configured granularities.
 func Assert(cfg *Config, key string, at time.Time, values map[string]any, opts ...TrackOption) error {
-	return trackOrAssert(cfg, key, at, values, "set", opts...)
+	return AssertContext(context.Background(), cfg, key, at, values, opts...)
+}
+
+// AssertContext sets values across configured granularities using ctx for driver calls.
+func AssertContext(ctx context.Context, cfg *Config, key string, at time.Time, values map[string]any, opts ...TrackOption) error {
+	return trackOrAssert(ctx, cfg, key, at, values, "set", opts...)
 }
 
-func trackOrAssert(cfg *Config, key string, at time.Time, values map[string]any, op string, opts ...TrackOption) error {
+func trackOrAssert(ctx context.Context, cfg *Config, key string, at time.Time, values map[string]any, op string, opts ...TrackOption) error {
+	ctx = ensureContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if cfg == nil {
 		return fmt.Errorf("config required")
 	}
@@ -70,6 +85,24 @@ func trackOrAssert(cfg *Config, key string, at time.Time, values map[string]any,
 		})
 	}
 
+	return writeWithContext(ctx, storage, op, keys, values)
+}
+
+// writeWithContext routes a write through the context-aware driver contract when
+// the storage supports it. Buffered storage decouples writes from the caller, so
+// the context only gates enqueueing there.
+func writeWithContext(ctx context.Context, storage WriteStorage, op string, keys []Key, values map[string]any) error {
+	if contextual, ok := storage.(ContextDriver); ok {
+		switch op {
+		case "inc":
+			return contextual.IncContext(ctx, keys, values)
+		case "set":
+			return contextual.SetContext(ctx, keys, values)
+		default:
+			return fmt.Errorf("invalid op")
+		}
+	}
+
 	switch op {
 	case "inc":
 		return storage.Inc(keys, values)
@@ -80,18 +113,103 @@ func trackOrAssert(cfg *Config, key string, at time.Time, values map[string]any,
 	}
 }
 
+func getWithContext(ctx context.Context, driver Driver, keys []Key) ([]map[string]any, error) {
+	if contextual, ok := driver.(ContextDriver); ok {
+		return contextual.GetContext(ctx, keys)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return driver.Get(keys)
+}
+
 // Values retrieves time series values for a granularity.
-func Values(cfg *Config, key string, from, to time.Time, granularity string, skipBlanks bool) (ValuesResult, error) {
+func Values(cfg *Config, key string, from, to time.Time, granularity string, skipBlanks bool, opts ...ValuesOption) (ValuesResult, error) {
+	return ValuesContext(context.Background(), cfg, key, from, to, granularity, skipBlanks, opts...)
+}
+
+// ValuesContext retrieves time series values for a granularity using ctx for driver calls.
+func ValuesContext(ctx context.Context, cfg *Config, key string, from, to time.Time, granularity string, skipBlanks bool, opts ...ValuesOption) (ValuesResult, error) {
+	results, err := ValuesManyContext(ctx, cfg, []string{key}, from, to, granularity, skipBlanks, opts...)
+	if err != nil {
+		return ValuesResult{}, err
+	}
+	return results[key], nil
+}
+
+// ValuesMany retrieves time series values of several keys for a granularity
+// with a single driver lookup. Results are keyed by metric key.
+func ValuesMany(cfg *Config, keys []string, from, to time.Time, granularity string, skipBlanks bool, opts ...ValuesOption) (map[string]ValuesResult, error) {
+	return ValuesManyContext(context.Background(), cfg, keys, from, to, granularity, skipBlanks, opts...)
+}
+
+// ValuesManyContext retrieves time series values of several keys using ctx for driver calls.
+func ValuesManyContext(ctx context.Context, cfg *Config, keys []string, from, to time.Time, granularity string, skipBlanks bool, opts ...ValuesOption) (map[string]ValuesResult, error) {
+	ctx = ensureContext(ctx)
 	if cfg == nil || cfg.Driver == nil {
-		return ValuesResult{}, fmt.Errorf("config and driver required")
+		return nil, fmt.Errorf("config and driver required")
 	}
 
 	parser := NewParser(granularity)
 	if !parser.Valid() {
-		return ValuesResult{}, fmt.Errorf("invalid granularity: %s", granularity)
+		return nil, fmt.Errorf("invalid granularity: %s", granularity)
+	}
+
+	optState := valuesOptions{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&optState)
+		}
+	}
+	source, err := rollupSourceFor(cfg, parser, optState)
+	if err != nil {
+		return nil, err
 	}
 
+	metricKeys := uniqueStrings(keys)
 	timeline := Timeline(from, to, parser.Offset, parser.Unit, cfg)
+	var valuesByKey [][]map[string]any
+	if source != nil {
+		valuesByKey, err = rollupValues(ctx, cfg, metricKeys, timeline, parser, source, optState.rollupMode)
+	} else {
+		valuesByKey, err = fetchTimelines(ctx, cfg, metricKeys, granularity, timeline)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]ValuesResult, len(metricKeys))
+	for idx, key := range metricKeys {
+		results[key] = buildValuesResult(timeline, valuesByKey[idx], skipBlanks)
+	}
+	return results, nil
+}
+
+// fetchTimelines reads the timeline buckets of every metric key with a single
+// driver lookup and splits the values per key.
+func fetchTimelines(ctx context.Context, cfg *Config, metricKeys []string, granularity string, timeline []time.Time) ([][]map[string]any, error) {
+	lookup := make([]Key, 0, len(metricKeys)*len(timeline))
+	for _, key := range metricKeys {
+		lookup = append(lookup, timelineKeys(key, granularity, timeline)...)
+	}
+
+	valuesList, err := getWithContext(ctx, cfg.Driver, lookup)
+	if err != nil {
+		return nil, err
+	}
+	if len(valuesList) != len(lookup) {
+		return nil, fmt.Errorf("driver returned %d values for %d keys", len(valuesList), len(lookup))
+	}
+
+	out := make([][]map[string]any, len(metricKeys))
+	for idx := range metricKeys {
+		start, end := idx*len(timeline), (idx+1)*len(timeline)
+		out[idx] = valuesList[start:end:end]
+	}
+	return out, nil
+}
+
+func timelineKeys(key, granularity string, timeline []time.Time) []Key {
 	keys := make([]Key, 0, len(timeline))
 	for _, at := range timeline {
 		atCopy := at
@@ -101,28 +219,96 @@ func Values(cfg *Config, key string, from, to time.Time, granularity string, ski
 			At:          &atCopy,
 		})
 	}
+	return keys
+}
 
-	valuesList, err := cfg.Driver.Get(keys)
-	if err != nil {
-		return ValuesResult{}, err
+func buildValuesResult(timeline []time.Time, valuesList []map[string]any, skipBlanks bool) ValuesResult {
+	if !skipBlanks {
+		return ValuesResult{
+			At:     append([]time.Time{}, timeline...),
+			Values: valuesList,
+		}
 	}
 
-	result := ValuesResult{
-		At:     timeline,
-		Values: valuesList,
+	clean := ValuesResult{At: []time.Time{}, Values: []map[string]any{}}
+	for i, v := range valuesList {
+		if len(v) == 0 {
+			continue
+		}
+		clean.At = append(clean.At, timeline[i])
+		clean.Values = append(clean.Values, v)
 	}
+	return clean
+}
 
-	if skipBlanks {
-		clean := ValuesResult{At: []time.Time{}, Values: []map[string]any{}}
-		for i, v := range result.Values {
-			if len(v) == 0 {
-				continue
-			}
-			clean.At = append(clean.At, result.At[i])
-			clean.Values = append(clean.Values, v)
+func uniqueStrings(values []string) []string {
+	out := make([]string, 0, len(values))
+	seen := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		if _, ok := seen[value]; ok {
+			continue
 		}
-		return clean, nil
+		seen[value] = struct{}{}
+		out = append(out, value)
+	}
+	return out
+}
+
+// Beam records the latest status snapshot of a key.
+func Beam(cfg *Config, key string, at time.Time, values map[string]any) error {
+	return BeamContext(context.Background(), cfg, key, at, values)
+}
+
+// BeamContext records the latest status snapshot of a key using ctx for driver calls.
+func BeamContext(ctx context.Context, cfg *Config, key string, at time.Time, values map[string]any) error {
+	ctx = ensureContext(ctx)
+	driver, err := pingDriverFor(cfg)
+	if err != nil {
+		return err
+	}
+	return driver.Ping(ctx, key, at, values)
+}
+
+// Scan reads the last status snapshot of a key. The result is empty when the
+// key was never beamed.
+func Scan(cfg *Config, key string) (ValuesResult, error) {
+	return ScanContext(context.Background(), cfg, key)
+}
+
+// ScanContext reads the last status snapshot of a key using ctx for driver calls.
+func ScanContext(ctx context.Context, cfg *Config, key string) (ValuesResult, error) {
+	ctx = ensureContext(ctx)
+	driver, err := pingDriverFor(cfg)
+	if err != nil {
+		return ValuesResult{}, err
+	}
+	result, err := driver.Scan(ctx, key)
+	if err != nil {
+		return ValuesResult{}, err
 	}
 
+	loc := cfg.Location()
+	for i, at := range result.At {
+		result.At[i] = at.In(loc)
+	}
 	return result, nil
 }
+
+func pingDriverFor(cfg *Config) (PingDriver, error) {
+	if cfg == nil || cfg.Driver == nil {
+		return nil, fmt.Errorf("config and driver required")
+	}
+	driver, ok := cfg.Driver.(PingDriver)
+	if !ok {
+		return nil, fmt.Errorf("driver %s does not support beam/scan", cfg.Driver.Description())
+	}
+	return driver, nil
+}
+
+func emptyScanResult() ValuesResult {
+	return ValuesResult{At: []time.Time{}, Values: []map[string]any{}}
+}
+
+func scanResultFor(at time.Time, values map[string]any) ValuesResult {
+	return ValuesResult{At: []time.Time{at}, Values: []map[string]any{values}}
+}
@@ -24,6 +24,7 @@ func TestOpsWithMongo_BufferEnabledAndDisabled(t *testing.T) {
 		}
 		t.Cleanup(func() {
 			_ = collection.Drop(context.Background())
+			_ = driver.PingCollection.Drop(context.Background())
 		})
 
 		cfg := DefaultConfig()
@@ -77,6 +78,7 @@ func TestOpsWithMongo_BufferEnabledAndDisabled(t *testing.T) {
 		}
 		t.Cleanup(func() {
 			_ = collection.Drop(context.Background())
+			_ = driver.PingCollection.Drop(context.Background())
 		})
 
 		cfg := DefaultConfig()
@@ -117,6 +119,7 @@ func TestOpsWithMongo_IdentifierModesAndGranularityFiltering(t *testing.T) {
 			}
 			t.Cleanup(func() {
 				_ = collection.Drop(context.Background())
+				_ = driver.PingCollection.Drop(context.Background())
 			})
 
 			cfg := DefaultConfig()
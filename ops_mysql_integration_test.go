@@ -32,7 +32,7 @@ func TestOpsWithMySQL_BufferEnabledAndDisabled(t *testing.T) {
 		t.Fatalf("setup failed: %v", err)
 	}
 	defer func() {
-		_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+		_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s_ping", table, table))
 	}()
 
 	t.Run("buffer enabled", func(t *testing.T) {
@@ -126,7 +126,7 @@ func TestOpsWithMySQL_IdentifierModesAndGranularityFiltering(t *testing.T) {
 				t.Fatalf("setup failed: %v", err)
 			}
 			defer func() {
-				_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+				_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s_ping", table, table))
 			}()
 
 			cfg := DefaultConfig()
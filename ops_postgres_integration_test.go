@@ -31,7 +31,7 @@ func TestOpsWithPostgres_BufferEnabledAndDisabled(t *testing.T) {
 		t.Fatalf("setup failed: %v", err)
 	}
 	defer func() {
-		_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+		_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s_ping", table, table))
 	}()
 
 	t.Run("buffer enabled", func(t *testing.T) {
@@ -125,7 +125,7 @@ func TestOpsWithPostgres_IdentifierModesAndGranularityFiltering(t *testing.T) {
 				t.Fatalf("setup failed: %v", err)
 			}
 			defer func() {
-				_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+				_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s_ping", table, table))
 			}()
 
 			cfg := DefaultConfig()
@@ -166,3 +166,46 @@ func TestOpsWithPostgres_IdentifierModesAndGranularityFiltering(t *testing.T) {
 		})
 	}
 }
+
+func TestOpsWithPostgres_IncReplacesNonNumericValue(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("open postgres failed: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping postgres failed: %v", err)
+	}
+
+	at := time.Date(2025, 2, 1, 11, 35, 0, 0, time.UTC)
+	table := fmt.Sprintf("test_stats_go_pg_typed_%d", time.Now().UnixNano())
+	driver := NewPostgresDriver(db, table, JoinedFull)
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	defer func() {
+		_, _ = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s, %s_ping", table, table))
+	}()
+
+	key := Key{Key: "events", Granularity: "1h", At: &at}
+	if err := driver.Set([]Key{key}, map[string]any{"count": "n/a", "flag": true}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if err := driver.Inc([]Key{key}, map[string]any{"count": 2, "flag": 3}); err != nil {
+		t.Fatalf("inc over non-numeric values failed: %v", err)
+	}
+
+	got, err := driver.Get([]Key{key})
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if got[0]["count"] != float64(2) || got[0]["flag"] != float64(3) {
+		t.Fatalf("expected non-numeric values replaced by the increment, got %#v", got[0])
+	}
+}
@@ -1,6 +1,8 @@
 package triflestats
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -42,3 +44,198 @@ func TestOpsTrackAssertValues(t *testing.T) {
 		t.Fatalf("expected count 5, got %+v", result.Values[0])
 	}
 }
+
+func TestOpsContextVariants(t *testing.T) {
+	db := newTestDB(t)
+	driver := NewSQLiteDriver(db, "trifle_stats", JoinedSeparated)
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Driver = driver
+	cfg.TimeZone = "UTC"
+	cfg.Granularities = []string{"1h"}
+	cfg.BufferEnabled = false
+
+	at := time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	if err := TrackContext(ctx, cfg, "events", at, map[string]any{"count": 2}); err != nil {
+		t.Fatalf("track context failed: %v", err)
+	}
+	if err := AssertContext(ctx, cfg, "events", at, map[string]any{"state": "ok"}); err != nil {
+		t.Fatalf("assert context failed: %v", err)
+	}
+
+	result, err := ValuesContext(ctx, cfg, "events", at, at, "1h", false)
+	if err != nil {
+		t.Fatalf("values context failed: %v", err)
+	}
+	if got := result.Values[0]["count"]; got != float64(2) {
+		t.Fatalf("expected count 2, got %#v", got)
+	}
+	if got := result.Values[0]["state"]; got != "ok" {
+		t.Fatalf("expected state ok, got %#v", got)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := TrackContext(canceled, cfg, "events", at, map[string]any{"count": 1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled track, got %v", err)
+	}
+	if _, err := ValuesContext(canceled, cfg, "events", at, at, "1h", false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled values, got %v", err)
+	}
+
+	result, err = Values(cfg, "events", at, at, "1h", false)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if got := result.Values[0]["count"]; got != float64(2) {
+		t.Fatalf("expected canceled track to leave count 2, got %#v", got)
+	}
+}
+
+func TestOpsBeamScan(t *testing.T) {
+	db := newTestDB(t)
+	driver := NewSQLiteDriver(db, "trifle_stats", JoinedFull)
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Driver = driver
+	cfg.TimeZone = "Europe/Bratislava"
+	cfg.BufferEnabled = false
+
+	empty, err := Scan(cfg, "workers")
+	if err != nil {
+		t.Fatalf("scan before beam failed: %v", err)
+	}
+	if len(empty.At) != 0 || len(empty.Values) != 0 {
+		t.Fatalf("expected empty scan before beam, got %+v", empty)
+	}
+
+	first := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+	if err := Beam(cfg, "workers", first, map[string]any{"busy": 3, "queues": map[string]any{"default": 7}}); err != nil {
+		t.Fatalf("first beam failed: %v", err)
+	}
+	if err := Beam(cfg, "workers", second, map[string]any{"busy": 1}); err != nil {
+		t.Fatalf("second beam failed: %v", err)
+	}
+
+	result, err := Scan(cfg, "workers")
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(result.At) != 1 || !result.At[0].Equal(second) {
+		t.Fatalf("expected latest snapshot at %v, got %+v", second, result.At)
+	}
+	if got := result.At[0].Location().String(); got != "Europe/Bratislava" {
+		t.Fatalf("expected scan time in configured zone, got %s", got)
+	}
+	if got := result.Values[0]["busy"]; got != float64(1) {
+		t.Fatalf("expected busy 1, got %#v", got)
+	}
+	if _, ok := result.Values[0]["queues"]; ok {
+		t.Fatalf("expected beam to replace previous snapshot, got %+v", result.Values[0])
+	}
+
+	series, err := Values(cfg, "workers", first, second, "1m", true)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if len(series.Values) != 0 {
+		t.Fatalf("expected beam to leave time series untouched, got %+v", series.Values)
+	}
+}
+
+func TestOpsBeamRequiresPingDriver(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Driver = newBufferTestDriver()
+	cfg.BufferEnabled = false
+
+	if err := Beam(cfg, "workers", time.Now(), map[string]any{"busy": 1}); err == nil {
+		t.Fatalf("expected beam error for driver without ping support")
+	}
+	if _, err := Scan(cfg, "workers"); err == nil {
+		t.Fatalf("expected scan error for driver without ping support")
+	}
+}
+
+type countingGetDriver struct {
+	Driver
+	gets int
+}
+
+func (d *countingGetDriver) Get(keys []Key) ([]map[string]any, error) {
+	d.gets++
+	return d.Driver.Get(keys)
+}
+
+func TestOpsValuesManyUsesSingleLookup(t *testing.T) {
+	db := newTestDB(t)
+	sqlite := NewSQLiteDriver(db, "trifle_stats", JoinedSeparated)
+	if err := sqlite.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	driver := &countingGetDriver{Driver: sqlite}
+
+	cfg := DefaultConfig()
+	cfg.Driver = driver
+	cfg.TimeZone = "UTC"
+	cfg.Granularities = []string{"1h"}
+	cfg.BufferEnabled = false
+
+	at := time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC)
+	if err := Track(cfg, "orders", at, map[string]any{"count": 2}); err != nil {
+		t.Fatalf("track orders failed: %v", err)
+	}
+	if err := Track(cfg, "signups", at.Add(time.Hour), map[string]any{"count": 5}); err != nil {
+		t.Fatalf("track signups failed: %v", err)
+	}
+
+	from := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 15, 11, 59, 0, 0, time.UTC)
+	results, err := ValuesMany(cfg, []string{"orders", "signups", "missing", "orders"}, from, to, "1h", false)
+	if err != nil {
+		t.Fatalf("values many failed: %v", err)
+	}
+	if driver.gets != 1 {
+		t.Fatalf("expected a single driver lookup, got %d", driver.gets)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	orders := results["orders"]
+	if len(orders.At) != 2 || orders.Values[0]["count"] != float64(2) || len(orders.Values[1]) != 0 {
+		t.Fatalf("unexpected orders result: %+v", orders)
+	}
+	signups := results["signups"]
+	if len(signups.Values) != 2 || len(signups.Values[0]) != 0 || signups.Values[1]["count"] != float64(5) {
+		t.Fatalf("unexpected signups result: %+v", signups)
+	}
+	if missing := results["missing"]; len(missing.At) != 2 || len(missing.Values[0]) != 0 {
+		t.Fatalf("unexpected missing result: %+v", missing)
+	}
+
+	orders.Values = append(orders.Values, map[string]any{"count": 99})
+	if len(signups.Values[0]) != 0 {
+		t.Fatalf("expected results not to share storage, got %+v", signups)
+	}
+
+	sparse, err := ValuesMany(cfg, []string{"orders", "signups"}, from, to, "1h", true)
+	if err != nil {
+		t.Fatalf("values many with skip blanks failed: %v", err)
+	}
+	if len(sparse["orders"].At) != 1 || !sparse["orders"].At[0].Equal(from) {
+		t.Fatalf("unexpected sparse orders result: %+v", sparse["orders"])
+	}
+	if len(sparse["signups"].At) != 1 || !sparse["signups"].At[0].Equal(from.Add(time.Hour)) {
+		t.Fatalf("unexpected sparse signups result: %+v", sparse["signups"])
+	}
+}
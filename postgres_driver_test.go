@@ -1,10 +1,12 @@
 package triflestats
 
 import (
-	"database/sql"
+	"context"
 	sqldriver "database/sql/driver"
 	"encoding/json"
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -66,6 +68,8 @@ func TestPostgresDriver_SetupCreatesModeSpecificSchema(t *testing.T) {
 
 			driver := NewPostgresDriver(db, "test_stats", tt.mode)
 			mock.ExpectExec(tt.pattern).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS test_stats_ping .*key VARCHAR\\(255\\) PRIMARY KEY, at TIMESTAMPTZ").
+				WillReturnResult(sqlmock.NewResult(0, 0))
 
 			if err := driver.Setup(); err != nil {
 				t.Fatalf("setup failed: %v", err)
@@ -151,10 +155,7 @@ func TestPostgresDriver_SetIncGet_WithMockedDB(t *testing.T) {
 	joinedKey := key.Join("::")
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM test_stats WHERE key = $1 LIMIT 1;")).
-		WithArgs(joinedKey).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}))
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats (key, data) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data;")).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats (key, data) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET data = stats.data || EXCLUDED.data;")).
 		WithArgs(joinedKey, jsonArgMatcher{validate: func(data map[string]any) bool {
 			return data["count"] == float64(1) && data["meta.duration"] == float64(2)
 		}}).
@@ -166,13 +167,10 @@ func TestPostgresDriver_SetIncGet_WithMockedDB(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM test_stats WHERE key = $1 LIMIT 1;")).
-		WithArgs(joinedKey).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"count":1,"meta.duration":2}`))
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats (key, data) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data;")).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats (key, data) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET data = stats.data || jsonb_build_object($3::text, CASE WHEN jsonb_typeof(stats.data->$3::text) = 'number' THEN (stats.data->>$3::text)::numeric ELSE 0 END + $4::numeric);")).
 		WithArgs(joinedKey, jsonArgMatcher{validate: func(data map[string]any) bool {
-			return data["count"] == float64(3) && data["meta.duration"] == float64(2)
-		}}).
+			return data["count"] == float64(2)
+		}}, "count", float64(2)).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
@@ -180,9 +178,9 @@ func TestPostgresDriver_SetIncGet_WithMockedDB(t *testing.T) {
 		t.Fatalf("inc failed: %v", err)
 	}
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM test_stats WHERE key = $1 LIMIT 1;")).
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT key, data FROM test_stats WHERE key IN ($1);")).
 		WithArgs(joinedKey).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"count":3,"meta.duration":2}`))
+		WillReturnRows(sqlmock.NewRows([]string{"key", "data"}).AddRow(joinedKey, `{"count":3,"meta.duration":2}`))
 
 	values, err := driver.Get([]Key{key})
 	if err != nil {
@@ -223,25 +221,16 @@ func TestPostgresDriver_IncCountPropagatesSystemTrackingCount(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM test_stats WHERE key = $1 AND granularity = $2 AND at = $3 LIMIT 1;")).
-		WithArgs("events", "1h", at).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}))
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats (key, granularity, at, data) VALUES ($1, $2, $3, $4::jsonb) ON CONFLICT (key, granularity, at) DO UPDATE SET data = EXCLUDED.data;")).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats (key, granularity, at, data) VALUES ($1, $2, $3, $4::jsonb) ON CONFLICT (key, granularity, at) DO UPDATE SET data = stats.data || jsonb_build_object($5::text, CASE WHEN jsonb_typeof(stats.data->$5::text) = 'number' THEN (stats.data->>$5::text)::numeric ELSE 0 END + $6::numeric);")).
 		WithArgs("events", "1h", at, jsonArgMatcher{validate: func(data map[string]any) bool {
 			return data["count"] == float64(2)
-		}}).
+		}}, "count", float64(2)).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM test_stats WHERE key = $1 AND granularity = $2 AND at = $3 LIMIT 1;")).
-		WithArgs(systemKeyName, "1h", at).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"count":2,"keys.__untracked__":2}`))
-	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats (key, granularity, at, data) VALUES ($1, $2, $3, $4::jsonb) ON CONFLICT (key, granularity, at) DO UPDATE SET data = EXCLUDED.data;")).
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats (key, granularity, at, data) VALUES ($1, $2, $3, $4::jsonb) ON CONFLICT (key, granularity, at) DO UPDATE SET data = stats.data || jsonb_build_object($5::text, CASE WHEN jsonb_typeof(stats.data->$5::text) = 'number' THEN (stats.data->>$5::text)::numeric ELSE 0 END + $6::numeric, $7::text, CASE WHEN jsonb_typeof(stats.data->$7::text) = 'number' THEN (stats.data->>$7::text)::numeric ELSE 0 END + $8::numeric);")).
 		WithArgs(systemKeyName, "1h", at, jsonArgMatcher{validate: func(data map[string]any) bool {
-			return data["count"] == float64(5) && data["keys.__untracked__"] == float64(5)
-		}}).
+			return data["count"] == float64(3) && data["keys.__untracked__"] == float64(3)
+		}}, "count", float64(3), "keys.__untracked__", float64(3)).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-
 	mock.ExpectCommit()
 
 	if err := driver.IncCount([]Key{key}, map[string]any{"count": 2}, 3); err != nil {
@@ -253,6 +242,96 @@ func TestPostgresDriver_IncCountPropagatesSystemTrackingCount(t *testing.T) {
 	}
 }
 
+func TestPostgresDriver_WriteBatchUsesSingleTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewPostgresDriver(db, "test_stats", JoinedSeparated)
+	driver.SystemTracking = false
+
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	key := Key{Key: "events", Granularity: "1h", At: &at}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WithArgs("events", "1h", at, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WithArgs("events", "1h", at, sqlmock.AnyArg(), "count", float64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = driver.WriteBatch(context.Background(), []BatchOperation{
+		{Operation: "set", Keys: []Key{key}, Values: map[string]any{"status": "ok"}, Count: 1},
+		{Operation: "inc", Keys: []Key{key}, Values: map[string]any{}, Count: 1},
+		{Operation: "inc", Keys: []Key{key}, Values: map[string]any{"count": 2}, Count: 2},
+	})
+	if err != nil {
+		t.Fatalf("write batch failed: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WillReturnError(fmt.Errorf("deadlock detected"))
+	mock.ExpectRollback()
+
+	err = driver.WriteBatch(context.Background(), []BatchOperation{
+		{Operation: "inc", Keys: []Key{key}, Values: map[string]any{"count": 1}, Count: 1},
+		{Operation: "inc", Keys: []Key{key}, Values: map[string]any{"count": 1}, Count: 1},
+	})
+	if err == nil {
+		t.Fatalf("expected write batch error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestPostgresDriver_WriteBatchOrdersRowsAndFoldsSystemTracking(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewPostgresDriver(db, "test_stats", JoinedSeparated)
+	driver.SystemTracking = true
+
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	orders := Key{Key: "orders", Granularity: "1h", At: &at}
+	events := Key{Key: "events", Granularity: "1h", At: &at}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WithArgs("events", "1h", at, sqlmock.AnyArg(), "count", float64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WithArgs("orders", "1h", at, sqlmock.AnyArg(), "count", float64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WithArgs("orders", "1h", at, sqlmock.AnyArg(), "count", float64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats")).
+		WithArgs(systemKeyName, "1h", at, sqlmock.AnyArg(), "count", float64(4), "keys.events", float64(1), "keys.orders", float64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = driver.WriteBatch(context.Background(), []BatchOperation{
+		{Operation: "inc", Keys: []Key{orders}, Values: map[string]any{"count": 1}, Count: 1},
+		{Operation: "inc", Keys: []Key{events}, Values: map[string]any{"count": 1}, Count: 1},
+		{Operation: "inc", Keys: []Key{orders}, Values: map[string]any{"count": 2}, Count: 2},
+	})
+	if err != nil {
+		t.Fatalf("write batch failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestPostgresDriver_GetReturnsEmptyMapWhenMissing(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -267,9 +346,9 @@ func TestPostgresDriver_GetReturnsEmptyMapWhenMissing(t *testing.T) {
 	key := Key{Key: "events", Granularity: "1h", At: &at}
 	joinedKey := key.Join("::")
 
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM test_stats WHERE key = $1 LIMIT 1;")).
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT key, data FROM test_stats WHERE key IN ($1);")).
 		WithArgs(joinedKey).
-		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+		WillReturnRows(sqlmock.NewRows([]string{"key", "data"}))
 
 	values, err := driver.Get([]Key{key})
 	if err != nil {
@@ -287,29 +366,176 @@ func TestPostgresDriver_GetReturnsEmptyMapWhenMissing(t *testing.T) {
 	}
 }
 
-func TestMergePackedValues(t *testing.T) {
-	current := map[string]any{"count": float64(2), "meta.duration": float64(1)}
-	incoming := map[string]any{"count": 3, "meta.duration": 2}
+func TestPostgresDriver_GetBatchesIdentifiersInSingleQuery(t *testing.T) {
+	first := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	third := second.Add(time.Hour)
+	keys := []Key{
+		{Key: "events", Granularity: "1h", At: &first},
+		{Key: "events", Granularity: "1h", At: &second},
+		{Key: "events", Granularity: "1h", At: &third},
+	}
 
-	inc, err := mergePackedValues(current, incoming, "inc")
-	if err != nil {
-		t.Fatalf("inc merge failed: %v", err)
+	tests := []struct {
+		name    string
+		mode    JoinedIdentifier
+		query   string
+		args    []sqldriver.Value
+		columns []string
+		rows    [][]sqldriver.Value
+	}{
+		{
+			name:    "full",
+			mode:    JoinedFull,
+			query:   "SELECT key, data FROM test_stats WHERE key IN ($1, $2, $3);",
+			args:    []sqldriver.Value{keys[0].Join("::"), keys[1].Join("::"), keys[2].Join("::")},
+			columns: []string{"key", "data"},
+			rows: [][]sqldriver.Value{
+				{keys[2].Join("::"), `{"count":3}`},
+				{keys[0].Join("::"), `{"count":1}`},
+			},
+		},
+		{
+			name:    "partial",
+			mode:    JoinedPartial,
+			query:   "SELECT key, at, data FROM test_stats WHERE (key, at) IN (($1, $2), ($3, $4), ($5, $6));",
+			args:    []sqldriver.Value{"events::1h", first, "events::1h", second, "events::1h", third},
+			columns: []string{"key", "at", "data"},
+			rows: [][]sqldriver.Value{
+				{"events::1h", third, `{"count":3}`},
+				{"events::1h", first, `{"count":1}`},
+			},
+		},
+		{
+			name:    "separated",
+			mode:    JoinedSeparated,
+			query:   "SELECT key, granularity, at, data FROM test_stats WHERE (key, granularity, at) IN (($1, $2, $3), ($4, $5, $6), ($7, $8, $9));",
+			args:    []sqldriver.Value{"events", "1h", first, "events", "1h", second, "events", "1h", third},
+			columns: []string{"key", "granularity", "at", "data"},
+			rows: [][]sqldriver.Value{
+				{"events", "1h", third, `{"count":3}`},
+				{"events", "1h", first, `{"count":1}`},
+			},
+		},
 	}
-	if inc["count"] != float64(5) || inc["meta.duration"] != float64(3) {
-		t.Fatalf("unexpected inc merge result: %+v", inc)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock setup failed: %v", err)
+			}
+			defer db.Close()
+
+			driver := NewPostgresDriver(db, "test_stats", tt.mode)
+			rows := sqlmock.NewRows(tt.columns)
+			for _, row := range tt.rows {
+				rows.AddRow(row...)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(tt.query)).WithArgs(tt.args...).WillReturnRows(rows)
+
+			values, err := driver.Get(keys)
+			if err != nil {
+				t.Fatalf("get failed: %v", err)
+			}
+			if len(values) != 3 {
+				t.Fatalf("expected three rows, got %d", len(values))
+			}
+			if got := values[0]["count"]; got != float64(1) {
+				t.Fatalf("expected first count 1, got %#v", got)
+			}
+			if len(values[1]) != 0 {
+				t.Fatalf("expected second row empty, got %+v", values[1])
+			}
+			if got := values[2]["count"]; got != float64(3) {
+				t.Fatalf("expected third count 3, got %#v", got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
 	}
+}
 
-	set, err := mergePackedValues(current, map[string]any{"status": "ok"}, "set")
+func TestBuildPostgresWriteQuery(t *testing.T) {
+	ident := identifier{columns: []string{"key"}, values: []any{"events"}, lookupKey: "events"}
+
+	packed := map[string]any{}
+	for i := 0; i < postgresJSONBBuildPairs+1; i++ {
+		packed[fmt.Sprintf("k%03d", i)] = i
+	}
+	query, args, err := buildPostgresWriteQuery("stats_table", ident, packed, "inc", nil)
 	if err != nil {
-		t.Fatalf("set merge failed: %v", err)
+		t.Fatalf("build inc query failed: %v", err)
 	}
-	if set["status"] != "ok" || set["count"] != float64(2) {
-		t.Fatalf("unexpected set merge result: %+v", set)
+	if got := strings.Count(query, "jsonb_build_object("); got != 2 {
+		t.Fatalf("expected increments split across 2 jsonb_build_object calls, got %d: %s", got, query)
+	}
+	if len(args) != 2+2*len(packed) {
+		t.Fatalf("unexpected arg count %d", len(args))
+	}
+	if got := strings.Count(query, "jsonb_typeof(stats.data->"); got != len(packed) {
+		t.Fatalf("expected every increment guarded against non-numeric values, got %d: %s", got, query)
 	}
 
-	if _, err := mergePackedValues(current, map[string]any{"count": "invalid"}, "inc"); err == nil {
+	if _, _, err := buildPostgresWriteQuery("stats_table", ident, map[string]any{"status": "ok"}, "inc", nil); err == nil {
 		t.Fatalf("expected error for non-numeric increment")
 	}
+	if _, _, err := buildPostgresWriteQuery("stats_table", ident, map[string]any{"count": 1}, "noop", nil); err == nil {
+		t.Fatalf("expected error for invalid operation")
+	}
+}
+
+func TestPostgresDriver_RetentionStampsExpireAtAndPurges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewPostgresDriver(db, "test_stats", JoinedFull)
+	driver.SystemTracking = false
+	driver.Retention = Retention{"1h": 24 * time.Hour}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS test_stats .*expire_at TIMESTAMPTZ").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE test_stats ADD COLUMN IF NOT EXISTS expire_at TIMESTAMPTZ;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS test_stats_expire_at_idx ON test_stats (expire_at);")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS test_stats_ping").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	hourKey := Key{Key: "events", Granularity: "1h", At: &at}
+	dayKey := Key{Key: "events", Granularity: "1d", At: &at}
+
+	mock.ExpectBegin()
+	// Rows are written in identifier order.
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats (key, data) VALUES ($1, $2::jsonb) ON CONFLICT (key) DO UPDATE SET data = stats.data || EXCLUDED.data;")).
+		WithArgs(dayKey.Join("::"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats AS stats (key, data, expire_at) VALUES ($1, $2::jsonb, $3) ON CONFLICT (key) DO UPDATE SET data = stats.data || EXCLUDED.data, expire_at = EXCLUDED.expire_at;")).
+		WithArgs(hourKey.Join("::"), sqlmock.AnyArg(), at.Add(24*time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := driver.Set([]Key{hourKey, dayKey}, map[string]any{"status": "ok"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM test_stats WHERE expire_at <= $1;")).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	purged, err := driver.Purge(context.Background())
+	if err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if purged != 3 {
+		t.Fatalf("expected 3 purged rows, got %d", purged)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
 }
 
 func TestPostgresDriver_RequiresAtForPartialAndSeparated(t *testing.T) {
@@ -330,7 +556,7 @@ func TestPostgresDriver_RequiresAtForPartialAndSeparated(t *testing.T) {
 	}
 }
 
-func TestPostgresDriver_ReadPackedNoRows(t *testing.T) {
+func TestPostgresDriver_PingAndScan(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("sqlmock setup failed: %v", err)
@@ -338,25 +564,48 @@ func TestPostgresDriver_ReadPackedNoRows(t *testing.T) {
 	defer db.Close()
 
 	driver := NewPostgresDriver(db, "test_stats", JoinedFull)
-	key := Key{Key: "events", Granularity: "1h", At: ptrTime(time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC))}
-	ident, err := driver.identifierForKey(key)
-	if err != nil {
-		t.Fatalf("identifier failed: %v", err)
+	at := time.Date(2025, 2, 1, 11, 15, 0, 0, time.UTC)
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats_ping (key, at, data) VALUES ($1, $2, $3::jsonb) ON CONFLICT (key) DO UPDATE SET at = EXCLUDED.at, data = EXCLUDED.data;")).
+		WithArgs("workers", at, jsonArgMatcher{validate: func(data map[string]any) bool {
+			return data["busy"] == float64(3) && data["queues.default"] == float64(7)
+		}}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := driver.Ping(context.Background(), "workers", at, map[string]any{"busy": 3, "queues": map[string]any{"default": 7}}); err != nil {
+		t.Fatalf("ping failed: %v", err)
 	}
 
-	query, args := driver.selectQuery(ident)
-	sqlArgs := make([]sqldriver.Value, 0, len(args))
-	for _, arg := range args {
-		sqlArgs = append(sqlArgs, arg)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT at, data FROM test_stats_ping WHERE key = $1 LIMIT 1;")).
+		WithArgs("workers").
+		WillReturnRows(sqlmock.NewRows([]string{"at", "data"}).AddRow(at, `{"busy":3,"queues.default":7}`))
+
+	result, err := driver.Scan(context.Background(), "workers")
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(result.At) != 1 || !result.At[0].Equal(at) {
+		t.Fatalf("unexpected scan at: %+v", result.At)
 	}
-	mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(sqlArgs...).WillReturnError(sql.ErrNoRows)
+	queues := result.Values[0]["queues"].(map[string]any)
+	if got := queues["default"]; got != float64(7) {
+		t.Fatalf("expected queues.default 7, got %#v", got)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT at, data FROM test_stats_ping WHERE key = $1 LIMIT 1;")).
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows([]string{"at", "data"}))
 
-	packed, err := driver.readPacked(nil, ident)
+	missing, err := driver.Scan(context.Background(), "missing")
 	if err != nil {
-		t.Fatalf("read packed failed: %v", err)
+		t.Fatalf("scan missing failed: %v", err)
 	}
-	if len(packed) != 0 {
-		t.Fatalf("expected empty packed map, got %+v", packed)
+	if len(missing.At) != 0 || len(missing.Values) != 0 {
+		t.Fatalf("expected empty scan result, got %+v", missing)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
 	}
 }
 
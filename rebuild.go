@@ -0,0 +1,182 @@
+package triflestats
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const defaultRebuildBatchSize = 1000
+
+// RebuildProgress describes a target bucket finished by Rebuild.
+type RebuildProgress struct {
+	Granularity string
+	At          time.Time
+	Written     bool
+	Done        int
+	Total       int
+	// Resume is a safe from value for restarting an interrupted rebuild: every
+	// target bucket starting before it has been written.
+	Resume time.Time
+}
+
+type rebuildOptions struct {
+	mode      RollupMode
+	batchSize int
+	progress  func(RebuildProgress)
+}
+
+// RebuildOption configures Rebuild.
+type RebuildOption func(*rebuildOptions)
+
+// RebuildUsing selects how source buckets fold into targets. Defaults to RollupSum.
+func RebuildUsing(mode RollupMode) RebuildOption {
+	return func(opts *rebuildOptions) {
+		opts.mode = mode
+	}
+}
+
+// RebuildBatchSize caps source buckets fetched per driver lookup.
+func RebuildBatchSize(size int) RebuildOption {
+	return func(opts *rebuildOptions) {
+		opts.batchSize = size
+	}
+}
+
+// OnRebuildProgress registers a callback invoked after every target bucket.
+func OnRebuildProgress(fn func(RebuildProgress)) RebuildOption {
+	return func(opts *rebuildOptions) {
+		opts.progress = fn
+	}
+}
+
+// Rebuild materialises target granularities of a key from stored source
+// buckets between from and to. Each target bucket is recomputed from its whole
+// source span and written with Set, so rebuilding is idempotent and can resume
+// from RebuildProgress.Resume. Buckets without source data are skipped, and
+// drivers with system tracking count each written bucket as one operation.
+func Rebuild(cfg *Config, key string, from, to time.Time, sourceGranularity string, targetGranularities []string, opts ...RebuildOption) error {
+	return RebuildContext(context.Background(), cfg, key, from, to, sourceGranularity, targetGranularities, opts...)
+}
+
+// RebuildContext rebuilds target granularities using ctx for driver calls. A
+// cancelled ctx stops the rebuild between buckets.
+func RebuildContext(ctx context.Context, cfg *Config, key string, from, to time.Time, sourceGranularity string, targetGranularities []string, opts ...RebuildOption) error {
+	ctx = ensureContext(ctx)
+	if cfg == nil || cfg.Driver == nil {
+		return fmt.Errorf("config and driver required")
+	}
+
+	optState := rebuildOptions{mode: RollupSum, batchSize: defaultRebuildBatchSize}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&optState)
+		}
+	}
+	if optState.batchSize <= 0 {
+		optState.batchSize = defaultRebuildBatchSize
+	}
+
+	source := NewParser(sourceGranularity)
+	if !source.Valid() {
+		return fmt.Errorf("invalid granularity: %s", sourceGranularity)
+	}
+
+	type targetState struct {
+		parser   *Parser
+		timeline []time.Time
+		next     int
+	}
+	targets := make([]*targetState, 0, len(targetGranularities))
+	for _, g := range uniqueStrings(targetGranularities) {
+		parser := NewParser(g)
+		if !parser.Valid() {
+			return fmt.Errorf("invalid granularity: %s", g)
+		}
+		if !granularityNests(cfg, source, parser) {
+			return fmt.Errorf("granularity %s does not roll up into %s", source.String, g)
+		}
+		targets = append(targets, &targetState{
+			parser:   parser,
+			timeline: Timeline(from, to, parser.Offset, parser.Unit, cfg),
+		})
+	}
+
+	for {
+		// Advance the target whose next bucket starts first so Resume only
+		// moves forward once every earlier bucket of every target is written.
+		var current *targetState
+		for _, target := range targets {
+			if target.next >= len(target.timeline) {
+				continue
+			}
+			if current == nil || target.timeline[target.next].Before(current.timeline[current.next]) {
+				current = target
+			}
+		}
+		if current == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		at := current.timeline[current.next]
+		written, err := rebuildBucket(ctx, cfg, key, at, source, current.parser, optState)
+		if err != nil {
+			return err
+		}
+		current.next++
+
+		if optState.progress == nil {
+			continue
+		}
+		resume := to
+		for _, target := range targets {
+			if target.next < len(target.timeline) && target.timeline[target.next].Before(resume) {
+				resume = target.timeline[target.next]
+			}
+		}
+		optState.progress(RebuildProgress{
+			Granularity: current.parser.String,
+			At:          at,
+			Written:     written,
+			Done:        current.next,
+			Total:       len(current.timeline),
+			Resume:      resume,
+		})
+	}
+}
+
+func rebuildBucket(ctx context.Context, cfg *Config, key string, at time.Time, source, target *Parser, opts rebuildOptions) (bool, error) {
+	end := NewNocturnal(at, cfg).Next(target.Offset, target.Unit)
+	sourceTimeline := Timeline(at, end.Add(-time.Nanosecond), source.Offset, source.Unit, cfg)
+
+	acc := map[string]any{}
+	for start := 0; start < len(sourceTimeline); start += opts.batchSize {
+		batch := sourceTimeline[start:min(start+opts.batchSize, len(sourceTimeline))]
+		lookup := timelineKeys(key, source.String, batch)
+		valuesList, err := getWithContext(ctx, cfg.Driver, lookup)
+		if err != nil {
+			return false, err
+		}
+		if len(valuesList) != len(lookup) {
+			return false, fmt.Errorf("driver returned %d values for %d keys", len(valuesList), len(lookup))
+		}
+		for _, values := range valuesList {
+			if len(values) > 0 {
+				foldRollup(acc, Pack(values), opts.mode)
+			}
+		}
+	}
+	if len(acc) == 0 {
+		return false, nil
+	}
+
+	bucket := at
+	targetKey := Key{Key: key, Granularity: target.String, At: &bucket}
+	if err := writeWithContext(ctx, cfg.Driver, "set", []Key{targetKey}, Unpack(acc)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
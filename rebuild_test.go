@@ -0,0 +1,165 @@
+package triflestats
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func seedHourlyOrders(t *testing.T, cfg *Config, start time.Time, hours int) {
+	t.Helper()
+	for hour := 0; hour < hours; hour++ {
+		at := start.Add(time.Duration(hour) * time.Hour)
+		if err := Track(cfg, "orders", at, map[string]any{"count": 1, "revenue": map[string]any{"usd": 2}}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+	}
+}
+
+func TestRebuildMaterialisesTargets(t *testing.T) {
+	cfg := newRollupConfig("1h")
+	start := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	seedHourlyOrders(t, cfg, start, 30)
+
+	var progress []RebuildProgress
+	err := Rebuild(cfg, "orders", start, start.Add(47*time.Hour), "1h", []string{"6h", "1d"},
+		RebuildBatchSize(4),
+		OnRebuildProgress(func(p RebuildProgress) { progress = append(progress, p) }),
+	)
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+
+	days, err := Values(cfg, "orders", start, start.Add(47*time.Hour), "1d", false)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	expectedDays := []map[string]any{
+		{"count": float64(24), "revenue": map[string]any{"usd": float64(48)}},
+		{"count": float64(6), "revenue": map[string]any{"usd": float64(12)}},
+	}
+	if !reflect.DeepEqual(days.Values, expectedDays) {
+		t.Fatalf("unexpected rebuilt days: %+v", days.Values)
+	}
+
+	quarters, err := Values(cfg, "orders", start, start.Add(47*time.Hour), "6h", true)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if len(quarters.Values) != 5 || quarters.Values[4]["count"] != float64(6) {
+		t.Fatalf("unexpected rebuilt 6h buckets: %+v", quarters.Values)
+	}
+
+	// 8 six-hour buckets and 2 days, reported in time order.
+	if len(progress) != 10 {
+		t.Fatalf("expected 10 progress reports, got %d", len(progress))
+	}
+	last := progress[len(progress)-1]
+	if last.Done != last.Total {
+		t.Fatalf("expected final report to be complete, got %+v", last)
+	}
+	for idx := 1; idx < len(progress); idx++ {
+		if progress[idx].Resume.Before(progress[idx-1].Resume) {
+			t.Fatalf("resume cursor moved backwards: %+v then %+v", progress[idx-1], progress[idx])
+		}
+	}
+	if progress[len(progress)-2].Written {
+		t.Fatalf("expected empty trailing 6h bucket to be skipped, got %+v", progress[len(progress)-2])
+	}
+}
+
+func TestRebuildResumesAfterInterruption(t *testing.T) {
+	cfg := newRollupConfig("1h")
+	start := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	end := start.Add(47 * time.Hour)
+	seedHourlyOrders(t, cfg, start, 48)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var resume time.Time
+	reports := 0
+	err := RebuildContext(ctx, cfg, "orders", start, end, "1h", []string{"6h", "1d"},
+		OnRebuildProgress(func(p RebuildProgress) {
+			reports++
+			resume = p.Resume
+			if reports == 3 {
+				cancel()
+			}
+		}),
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	// Resuming twice over the same buckets must not double count.
+	for i := 0; i < 2; i++ {
+		if err := Rebuild(cfg, "orders", resume, end, "1h", []string{"6h", "1d"}); err != nil {
+			t.Fatalf("resume failed: %v", err)
+		}
+	}
+
+	days, err := Values(cfg, "orders", start, end, "1d", false)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	for idx, values := range days.Values {
+		if values["count"] != float64(24) {
+			t.Fatalf("unexpected day %d after resume: %+v", idx, values)
+		}
+	}
+	quarters, err := Values(cfg, "orders", start, end, "6h", false)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	for idx, values := range quarters.Values {
+		if values["count"] != float64(6) {
+			t.Fatalf("unexpected 6h bucket %d after resume: %+v", idx, values)
+		}
+	}
+}
+
+func TestRebuildUsingLastValue(t *testing.T) {
+	cfg := newRollupConfig("1d")
+	for day, workers := range map[int]int{13: 4, 15: 7} {
+		at := time.Date(2025, 1, day, 12, 0, 0, 0, time.UTC)
+		if err := Assert(cfg, "pool", at, map[string]any{"workers": workers}); err != nil {
+			t.Fatalf("assert failed: %v", err)
+		}
+	}
+
+	from := time.Date(2025, 1, 13, 0, 0, 0, 0, time.UTC)
+	if err := Rebuild(cfg, "pool", from, from, "1d", []string{"1w"}, RebuildUsing(RollupLast)); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+
+	result, err := Values(cfg, "pool", from, from, "1w", false)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if result.Values[0]["workers"] != float64(7) {
+		t.Fatalf("expected last asserted value, got %+v", result.Values)
+	}
+}
+
+func TestRebuildRejectsInvalidTargetsBeforeWriting(t *testing.T) {
+	cfg := newRollupConfig("1w")
+	at := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	if err := Track(cfg, "orders", at, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("track failed: %v", err)
+	}
+
+	if err := Rebuild(cfg, "orders", at, at, "1w", []string{"1y", "1mo"}); err == nil {
+		t.Fatalf("expected error for non-nesting target")
+	}
+	result, err := Values(cfg, "orders", at, at, "1y", true)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if len(result.Values) != 0 {
+		t.Fatalf("expected no writes after validation error, got %+v", result.Values)
+	}
+	if err := Rebuild(cfg, "orders", at, at, "bogus", []string{"1y"}); err == nil {
+		t.Fatalf("expected error for invalid source granularity")
+	}
+}
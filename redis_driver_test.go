@@ -1,6 +1,10 @@
 package triflestats
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -134,3 +138,256 @@ func TestRedisDriver_Description(t *testing.T) {
 		t.Fatalf("unexpected description: %s", got)
 	}
 }
+
+func TestRedisDriver_PingAndScan(t *testing.T) {
+	driver, server, _ := newMiniRedisDriver(t, "test")
+	at := time.Date(2025, 2, 1, 11, 15, 0, 0, time.UTC)
+
+	if err := driver.Ping(context.Background(), "workers", at, map[string]any{"busy": 3, "queues": map[string]any{"default": 7}}); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if err := driver.Ping(context.Background(), "workers", at.Add(time.Minute), map[string]any{"busy": 1}); err != nil {
+		t.Fatalf("second ping failed: %v", err)
+	}
+	if !server.Exists("test::ping::workers") {
+		t.Fatalf("expected ping hash test::ping::workers to exist")
+	}
+
+	result, err := driver.Scan(context.Background(), "workers")
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(result.At) != 1 || !result.At[0].Equal(at.Add(time.Minute)) {
+		t.Fatalf("unexpected scan at: %+v", result.At)
+	}
+	if got := result.Values[0]["busy"]; got != 1.0 {
+		t.Fatalf("expected busy 1, got %#v", got)
+	}
+	if _, ok := result.Values[0]["queues"]; ok {
+		t.Fatalf("expected ping to replace previous snapshot, got %+v", result.Values[0])
+	}
+
+	missing, err := driver.Scan(context.Background(), "missing")
+	if err != nil {
+		t.Fatalf("scan missing failed: %v", err)
+	}
+	if len(missing.At) != 0 {
+		t.Fatalf("expected empty scan, got %+v", missing)
+	}
+}
+
+func TestRedisDriver_RetentionExpiresBucketsPerGranularity(t *testing.T) {
+	driver, server, _ := newMiniRedisDriver(t, "test")
+	driver.Retention = Retention{"1h": 2 * time.Hour}
+	server.SetTime(time.Now())
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	day := time.Date(hour.Year(), hour.Month(), hour.Day(), 0, 0, 0, 0, time.UTC)
+	hourKey := Key{Key: "events", Granularity: "1h", At: &hour}
+	dayKey := Key{Key: "events", Granularity: "1d", At: &day}
+
+	if err := driver.Inc([]Key{hourKey, dayKey}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	if err := driver.Set([]Key{hourKey}, map[string]any{"status": "ok"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	hourSystemKey := Key{Key: systemKeyName, Granularity: "1h", At: &hour}
+	for _, key := range []Key{hourKey, hourSystemKey} {
+		redisKey := driver.joinedKey(key)
+		if ttl := server.TTL(redisKey); ttl <= 0 || ttl > 2*time.Hour {
+			t.Fatalf("expected %s to expire within 2h, got ttl %v", redisKey, ttl)
+		}
+	}
+	if ttl := server.TTL(driver.joinedKey(dayKey)); ttl != 0 {
+		t.Fatalf("expected 1d bucket to be kept forever, got ttl %v", ttl)
+	}
+}
+
+type roundTripHook struct {
+	mu        sync.Mutex
+	single    int
+	pipelines int
+	commands  int
+}
+
+func (h *roundTripHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (h *roundTripHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.mu.Lock()
+		h.single++
+		h.mu.Unlock()
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTripHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.mu.Lock()
+		h.pipelines++
+		h.commands += len(cmds)
+		h.mu.Unlock()
+		return next(ctx, cmds)
+	}
+}
+
+func (h *roundTripHook) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.single, h.pipelines, h.commands = 0, 0, 0
+}
+
+func TestRedisDriver_BatchesCommandsInSinglePipeline(t *testing.T) {
+	driver, _, client := newMiniRedisDriver(t, "test")
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	hook := &roundTripHook{}
+	client.AddHook(hook)
+
+	first := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	keys := []Key{
+		{Key: "events", Granularity: "1h", At: &first},
+		{Key: "events", Granularity: "1h", At: &second},
+	}
+
+	if err := driver.IncCount(keys, map[string]any{"count": 2, "duration": 1.5}, 3); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	if hook.single != 0 || hook.pipelines != 1 {
+		t.Fatalf("expected one pipeline for inc, got single=%d pipelines=%d", hook.single, hook.pipelines)
+	}
+	// Two fields per key plus count and keys.events on the system key.
+	if hook.commands != 8 {
+		t.Fatalf("expected 8 pipelined commands, got %d", hook.commands)
+	}
+
+	hook.reset()
+	if err := driver.Set(keys, map[string]any{"status": "ok"}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if hook.single != 0 || hook.pipelines != 1 {
+		t.Fatalf("expected one pipeline for set, got single=%d pipelines=%d", hook.single, hook.pipelines)
+	}
+
+	hook.reset()
+	values, err := driver.Get(append(keys, Key{Key: systemKeyName, Granularity: "1h", At: &first}))
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if hook.single != 0 || hook.pipelines != 1 || hook.commands != 3 {
+		t.Fatalf("expected one pipeline of 3 reads, got single=%d pipelines=%d commands=%d", hook.single, hook.pipelines, hook.commands)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if got := values[idx]["count"]; got != 2.0 {
+			t.Fatalf("expected count 2 at %d, got %#v", idx, got)
+		}
+		if got := values[idx]["duration"]; got != 1.5 {
+			t.Fatalf("expected duration 1.5 at %d, got %#v", idx, got)
+		}
+		if got := values[idx]["status"]; got != "ok" {
+			t.Fatalf("expected status ok at %d, got %#v", idx, got)
+		}
+	}
+	if got := values[2]["count"]; got != 4.0 {
+		t.Fatalf("expected system count 4, got %#v", got)
+	}
+}
+
+func TestRedisDriver_RejectedIncrementWritesNothing(t *testing.T) {
+	driver, server, _ := newMiniRedisDriver(t, "test")
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	key := Key{Key: "events", Granularity: "1h", At: &at}
+
+	if err := driver.Inc([]Key{key}, map[string]any{"count": 1, "status": "running"}); err == nil {
+		t.Fatalf("expected error for non-numeric increment")
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Fatalf("expected no keys written, got %v", keys)
+	}
+}
+
+func TestRedisDriver_WriteBatchReportsWrittenOperations(t *testing.T) {
+	driver, server, _ := newMiniRedisDriver(t, "test")
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	good := Key{Key: "a", Granularity: "1h", At: &at}
+	bad := Key{Key: "b", Granularity: "1h", At: &at}
+	server.HSet(driver.joinedKey(bad), "count", "not-a-number")
+
+	err := driver.WriteBatch(context.Background(), []BatchOperation{
+		{Operation: "inc", Keys: []Key{good}, Values: map[string]any{"count": 1}, Count: 1},
+		{Operation: "inc", Keys: []Key{bad}, Values: map[string]any{"count": 1}, Count: 1},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected BatchError, got %v", err)
+	}
+	if len(batchErr.Errs) != 2 || batchErr.Errs[0] != nil || batchErr.Errs[1] == nil {
+		t.Fatalf("expected only the second operation to fail, got %v", batchErr.Errs)
+	}
+}
+
+func TestRedisDriver_BufferRetriesOnlyUnwrittenOperations(t *testing.T) {
+	driver, server, _ := newMiniRedisDriver(t, "test")
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	good := Key{Key: "a", Granularity: "1h", At: &at}
+	bad := Key{Key: "b", Granularity: "1h", At: &at}
+	server.HSet(driver.joinedKey(bad), "count", "not-a-number")
+
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+	if err := buffer.Inc([]Key{good}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc a failed: %v", err)
+	}
+	if err := buffer.Inc([]Key{bad}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc b failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := buffer.Flush(); err == nil {
+			t.Fatalf("expected flush %d to fail", i)
+		}
+	}
+
+	if got := server.HGet(driver.joinedKey(good), "count"); got != "1" {
+		t.Fatalf("expected a.count written once, got %q", got)
+	}
+}
+
+func TestRedisDriver_BufferDiscardsRejectedOperationWhenNotRetryable(t *testing.T) {
+	driver, server, _ := newMiniRedisDriver(t, "test")
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	good := Key{Key: "a", Granularity: "1h", At: &at}
+	bad := Key{Key: "b", Granularity: "1h", At: &at}
+	server.HSet(driver.joinedKey(bad), "count", "not-a-number")
+
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true, Retryable: IsRetryable})
+	defer func() {
+		_ = buffer.Shutdown()
+	}()
+	if err := buffer.Inc([]Key{good}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc a failed: %v", err)
+	}
+	if err := buffer.Inc([]Key{bad}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc b failed: %v", err)
+	}
+
+	var discarded *DiscardedError
+	if err := buffer.Flush(); !errors.As(err, &discarded) || discarded.Keys[0].Key != "b" {
+		t.Fatalf("expected rejected increment of b to be discarded, got %v", err)
+	}
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("expected nothing left to flush, got %v", err)
+	}
+	if got := server.HGet(driver.joinedKey(good), "count"); got != "1" {
+		t.Fatalf("expected a.count written once, got %q", got)
+	}
+}
@@ -0,0 +1,34 @@
+package triflestats
+
+import "time"
+
+// Retention maps granularities to how long their buckets are kept, counted
+// from the bucket start. Granularities without an entry, or with a
+// non-positive duration, are kept forever.
+//
+//	Retention{"1m": 48 * time.Hour, "1h": 90 * 24 * time.Hour}
+type Retention map[string]time.Duration
+
+// ExpireAt returns when the bucket of granularity starting at at expires, or
+// nil when it is kept forever.
+func (r Retention) ExpireAt(granularity string, at *time.Time) *time.Time {
+	if at == nil {
+		return nil
+	}
+	ttl, ok := r[granularity]
+	if !ok || ttl <= 0 {
+		return nil
+	}
+	expires := at.Add(ttl)
+	return &expires
+}
+
+// Enabled reports whether any granularity expires.
+func (r Retention) Enabled() bool {
+	for _, ttl := range r {
+		if ttl > 0 {
+			return true
+		}
+	}
+	return false
+}
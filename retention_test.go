@@ -0,0 +1,44 @@
+package triflestats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionExpireAt(t *testing.T) {
+	retention := Retention{
+		"1m": 48 * time.Hour,
+		"1h": 90 * 24 * time.Hour,
+		"1d": 0,
+	}
+	at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	expireAt := retention.ExpireAt("1m", &at)
+	if expireAt == nil || !expireAt.Equal(at.Add(48*time.Hour)) {
+		t.Fatalf("unexpected 1m expiry: %v", expireAt)
+	}
+	if got := retention.ExpireAt("1d", &at); got != nil {
+		t.Fatalf("expected 1d to be kept forever, got %v", got)
+	}
+	if got := retention.ExpireAt("1w", &at); got != nil {
+		t.Fatalf("expected unconfigured granularity to be kept forever, got %v", got)
+	}
+	if got := retention.ExpireAt("1m", nil); got != nil {
+		t.Fatalf("expected nil expiry without At, got %v", got)
+	}
+	if got := Retention(nil).ExpireAt("1m", &at); got != nil {
+		t.Fatalf("expected nil retention to keep everything, got %v", got)
+	}
+}
+
+func TestRetentionEnabled(t *testing.T) {
+	if Retention(nil).Enabled() {
+		t.Fatalf("expected nil retention to be disabled")
+	}
+	if (Retention{"1d": 0}).Enabled() {
+		t.Fatalf("expected non-positive durations to be disabled")
+	}
+	if !(Retention{"1d": 0, "1m": time.Hour}).Enabled() {
+		t.Fatalf("expected positive duration to enable retention")
+	}
+}
@@ -0,0 +1,457 @@
+package triflestats
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryBaseDelay   = 50 * time.Millisecond
+	defaultRetryMaxDelay    = 2 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling the driver while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a RetryingDriver circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails calls fast until the cooldown elapses.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through to test the backend.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// RetryOptions configures RetryingDriver. Zero values use the defaults.
+type RetryOptions struct {
+	// Attempts is the total number of tries per call. Defaults to 3.
+	Attempts int
+	// BaseDelay is the wait before the first retry, doubled on every further
+	// retry up to MaxDelay. Each wait is jittered down by up to half.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retryable classifies errors worth retrying. Defaults to IsRetryable.
+	Retryable func(error) bool
+	// BreakerThreshold is the number of consecutive failed calls that opens
+	// the breaker. Defaults to 5; negative disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before probing.
+	BreakerCooldown time.Duration
+	// OnStateChange is called after every breaker transition.
+	OnStateChange func(from, to BreakerState)
+}
+
+// RetryingDriver retries transient driver errors with jittered exponential
+// backoff and stops calling a failing backend through a circuit breaker.
+// Retried increments are at-least-once: a write that committed before its
+// error was reported is applied again.
+type RetryingDriver struct {
+	Driver Driver
+
+	attempts      int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	retryable     func(error) bool
+	threshold     int
+	cooldown      time.Duration
+	onStateChange func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	now   func() time.Time
+	sleep func(ctx context.Context, delay time.Duration) error
+}
+
+// NewRetryingDriver wraps driver with retries and a circuit breaker.
+func NewRetryingDriver(driver Driver, opts RetryOptions) *RetryingDriver {
+	d := &RetryingDriver{
+		Driver:        driver,
+		attempts:      opts.Attempts,
+		baseDelay:     opts.BaseDelay,
+		maxDelay:      opts.MaxDelay,
+		retryable:     opts.Retryable,
+		threshold:     opts.BreakerThreshold,
+		cooldown:      opts.BreakerCooldown,
+		onStateChange: opts.OnStateChange,
+		now:           time.Now,
+		sleep:         sleepContext,
+	}
+	if d.attempts <= 0 {
+		d.attempts = defaultRetryAttempts
+	}
+	if d.baseDelay <= 0 {
+		d.baseDelay = defaultRetryBaseDelay
+	}
+	if d.maxDelay <= 0 {
+		d.maxDelay = defaultRetryMaxDelay
+	}
+	if d.retryable == nil {
+		d.retryable = IsRetryable
+	}
+	if d.threshold == 0 {
+		d.threshold = defaultBreakerThreshold
+	}
+	if d.cooldown <= 0 {
+		d.cooldown = defaultBreakerCooldown
+	}
+	return d
+}
+
+func (d *RetryingDriver) Description() string {
+	return fmt.Sprintf("RetryingDriver(%s)", d.Driver.Description())
+}
+
+// State reports the circuit breaker state.
+func (d *RetryingDriver) State() BreakerState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == BreakerOpen && !d.now().Before(d.openedAt.Add(d.cooldown)) {
+		return BreakerHalfOpen
+	}
+	return d.state
+}
+
+// Inc increments values with retries.
+func (d *RetryingDriver) Inc(keys []Key, values map[string]any) error {
+	return d.IncContext(context.Background(), keys, values)
+}
+
+// IncContext increments values with retries using ctx.
+func (d *RetryingDriver) IncContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.do(ctx, func(ctx context.Context) error {
+		return writeWithContext(ctx, d.Driver, "inc", keys, values)
+	})
+}
+
+// IncCount increments values and records count operations with retries.
+// Drivers without CountDriver receive a single Inc.
+func (d *RetryingDriver) IncCount(keys []Key, values map[string]any, count int64) error {
+	return d.IncCountContext(context.Background(), keys, values, count)
+}
+
+// IncCountContext increments values and records count operations using ctx.
+func (d *RetryingDriver) IncCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	return d.do(ctx, func(ctx context.Context) error {
+		return writeCountWithContext(ctx, d.Driver, "inc", keys, values, count)
+	})
+}
+
+// Set sets values with retries.
+func (d *RetryingDriver) Set(keys []Key, values map[string]any) error {
+	return d.SetContext(context.Background(), keys, values)
+}
+
+// SetContext sets values with retries using ctx.
+func (d *RetryingDriver) SetContext(ctx context.Context, keys []Key, values map[string]any) error {
+	return d.do(ctx, func(ctx context.Context) error {
+		return writeWithContext(ctx, d.Driver, "set", keys, values)
+	})
+}
+
+// SetCount sets values and records count operations with retries. Drivers
+// without CountDriver receive a single Set.
+func (d *RetryingDriver) SetCount(keys []Key, values map[string]any, count int64) error {
+	return d.SetCountContext(context.Background(), keys, values, count)
+}
+
+// SetCountContext sets values and records count operations using ctx.
+func (d *RetryingDriver) SetCountContext(ctx context.Context, keys []Key, values map[string]any, count int64) error {
+	return d.do(ctx, func(ctx context.Context) error {
+		return writeCountWithContext(ctx, d.Driver, "set", keys, values, count)
+	})
+}
+
+// Get fetches values with retries.
+func (d *RetryingDriver) Get(keys []Key) ([]map[string]any, error) {
+	return d.GetContext(context.Background(), keys)
+}
+
+// GetContext fetches values with retries using ctx.
+func (d *RetryingDriver) GetContext(ctx context.Context, keys []Key) ([]map[string]any, error) {
+	var results []map[string]any
+	err := d.do(ctx, func(ctx context.Context) error {
+		var err error
+		results, err = getWithContext(ctx, d.Driver, keys)
+		return err
+	})
+	return results, err
+}
+
+// Ping stores a status snapshot with retries when the wrapped driver supports it.
+func (d *RetryingDriver) Ping(ctx context.Context, key string, at time.Time, values map[string]any) error {
+	pinger, ok := d.Driver.(PingDriver)
+	if !ok {
+		return fmt.Errorf("driver %s does not support beam/scan", d.Driver.Description())
+	}
+	return d.do(ctx, func(ctx context.Context) error {
+		return pinger.Ping(ctx, key, at, values)
+	})
+}
+
+// Scan reads the latest status snapshot with retries when the wrapped driver supports it.
+func (d *RetryingDriver) Scan(ctx context.Context, key string) (ValuesResult, error) {
+	pinger, ok := d.Driver.(PingDriver)
+	if !ok {
+		return ValuesResult{}, fmt.Errorf("driver %s does not support beam/scan", d.Driver.Description())
+	}
+	var result ValuesResult
+	err := d.do(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = pinger.Scan(ctx, key)
+		return err
+	})
+	return result, err
+}
+
+func (d *RetryingDriver) do(ctx context.Context, call func(context.Context) error) error {
+	ctx = ensureContext(ctx)
+	if err := d.acquire(); err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			d.release(breakerNeutral)
+			return err
+		}
+		err := call(ctx)
+		if err == nil {
+			d.release(breakerSuccess)
+			return nil
+		}
+		if !d.retryable(err) {
+			d.release(breakerNeutral)
+			return err
+		}
+		if attempt >= d.attempts {
+			d.release(breakerFailure)
+			return fmt.Errorf("retries exhausted after %d attempts: %w", attempt, err)
+		}
+		if err := d.sleep(ctx, d.backoff(attempt)); err != nil {
+			d.release(breakerNeutral)
+			return err
+		}
+	}
+}
+
+func (d *RetryingDriver) backoff(attempt int) time.Duration {
+	delay := d.baseDelay
+	for i := 1; i < attempt && delay < d.maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, d.maxDelay)
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+type breakerOutcome int
+
+const (
+	breakerNeutral breakerOutcome = iota
+	breakerSuccess
+	breakerFailure
+)
+
+func (d *RetryingDriver) acquire() error {
+	if d.threshold < 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	from := d.state
+	switch d.state {
+	case BreakerOpen:
+		if d.now().Before(d.openedAt.Add(d.cooldown)) {
+			d.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		d.state = BreakerHalfOpen
+		d.probing = true
+	case BreakerHalfOpen:
+		if d.probing {
+			d.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		d.probing = true
+	}
+	to := d.state
+	d.mu.Unlock()
+
+	d.notify(from, to)
+	return nil
+}
+
+func (d *RetryingDriver) release(outcome breakerOutcome) {
+	if d.threshold < 0 {
+		return
+	}
+
+	d.mu.Lock()
+	from := d.state
+	probe := d.state == BreakerHalfOpen
+	if probe {
+		d.probing = false
+	}
+	switch outcome {
+	case breakerSuccess:
+		d.failures = 0
+		d.state = BreakerClosed
+	case breakerFailure:
+		d.failures++
+		if probe || d.failures >= d.threshold {
+			d.state = BreakerOpen
+			d.openedAt = d.now()
+		}
+	}
+	to := d.state
+	d.mu.Unlock()
+
+	d.notify(from, to)
+}
+
+func (d *RetryingDriver) notify(from, to BreakerState) {
+	if from != to && d.onStateChange != nil {
+		d.onStateChange(from, to)
+	}
+}
+
+func writeCountWithContext(ctx context.Context, storage Driver, op string, keys []Key, values map[string]any, count int64) error {
+	if counter, ok := storage.(ContextCountDriver); ok {
+		switch op {
+		case "inc":
+			return counter.IncCountContext(ctx, keys, values, count)
+		case "set":
+			return counter.SetCountContext(ctx, keys, values, count)
+		default:
+			return fmt.Errorf("invalid op")
+		}
+	}
+	if counter, ok := storage.(CountDriver); ok {
+		switch op {
+		case "inc":
+			return counter.IncCount(keys, values, count)
+		case "set":
+			return counter.SetCount(keys, values, count)
+		default:
+			return fmt.Errorf("invalid op")
+		}
+	}
+	return writeWithContext(ctx, storage, op, keys, values)
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsRetryable reports whether err is a transient failure of a connection or
+// of one of the bundled backends: dropped or refused connections, timeouts,
+// PostgreSQL and MySQL failovers, deadlocks and connection limits, SQLite
+// busy locks, Redis loading or failover replies, and MongoDB network errors.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01", "53300", "57P01", "57P02", "57P03":
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) {
+		return true
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1040, 1053, 1205, 1213:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code() & 0xff
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+
+	for _, prefix := range []string{"LOADING", "READONLY", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN"} {
+		if redis.HasErrorPrefix(err, prefix) {
+			return true
+		}
+	}
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var labeled mongo.LabeledError
+	if errors.As(err, &labeled) {
+		return labeled.HasErrorLabel("RetryableWriteError") || labeled.HasErrorLabel("TransientTransactionError")
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package triflestats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type flakyDriver struct {
+	Driver
+	mu       sync.Mutex
+	failures int
+	err      error
+	calls    int
+}
+
+func (d *flakyDriver) attempt() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls++
+	if d.failures > 0 {
+		d.failures--
+		return d.err
+	}
+	return nil
+}
+
+func (d *flakyDriver) Inc(keys []Key, values map[string]any) error {
+	if err := d.attempt(); err != nil {
+		return err
+	}
+	return d.Driver.Inc(keys, values)
+}
+
+func (d *flakyDriver) Get(keys []Key) ([]map[string]any, error) {
+	if err := d.attempt(); err != nil {
+		return nil, err
+	}
+	return d.Driver.Get(keys)
+}
+
+type redisReply string
+
+func (e redisReply) Error() string { return string(e) }
+func (e redisReply) RedisError()   {}
+
+func newTestRetryingDriver(inner Driver, opts RetryOptions) (*RetryingDriver, *[]time.Duration, *time.Time) {
+	driver := NewRetryingDriver(inner, opts)
+	delays := []time.Duration{}
+	clock := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	driver.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return ctx.Err()
+	}
+	driver.now = func() time.Time { return clock }
+	return driver, &delays, &clock
+}
+
+func TestRetryingDriver_RetriesTransientErrorsWithBackoff(t *testing.T) {
+	inner := &flakyDriver{Driver: NewMemoryDriver(JoinedFull), failures: 2, err: io.EOF}
+	driver, delays, _ := newTestRetryingDriver(inner, RetryOptions{Attempts: 3, BaseDelay: 100 * time.Millisecond})
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []Key{{Key: "metric", Granularity: "1h", At: &now}}
+	if err := driver.Inc(keys, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	if inner.calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", inner.calls)
+	}
+	if len(*delays) != 2 {
+		t.Fatalf("expected 2 backoff waits, got %v", *delays)
+	}
+	bounds := [][2]time.Duration{{50 * time.Millisecond, 100 * time.Millisecond}, {100 * time.Millisecond, 200 * time.Millisecond}}
+	for idx, delay := range *delays {
+		if delay < bounds[idx][0] || delay > bounds[idx][1] {
+			t.Fatalf("backoff %d out of range: %v", idx, delay)
+		}
+	}
+
+	values, err := driver.Get(keys)
+	if err != nil || values[0]["count"] != float64(1) {
+		t.Fatalf("unexpected get result: %+v, %v", values, err)
+	}
+}
+
+func TestRetryingDriver_GivesUpAfterAttempts(t *testing.T) {
+	inner := &flakyDriver{Driver: NewMemoryDriver(JoinedFull), failures: 10, err: syscall.ECONNREFUSED}
+	driver, _, _ := newTestRetryingDriver(inner, RetryOptions{Attempts: 2})
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := driver.Inc([]Key{{Key: "metric", Granularity: "1h", At: &now}}, map[string]any{"count": 1})
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected wrapped connection error, got %v", err)
+	}
+	if inner.calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", inner.calls)
+	}
+}
+
+func TestRetryingDriver_DoesNotRetryPermanentErrors(t *testing.T) {
+	inner := &flakyDriver{Driver: NewMemoryDriver(JoinedFull), failures: 1, err: errors.New("invalid value")}
+	driver, delays, _ := newTestRetryingDriver(inner, RetryOptions{BreakerThreshold: 1})
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := driver.Inc([]Key{{Key: "metric", Granularity: "1h", At: &now}}, map[string]any{"count": 1}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if inner.calls != 1 || len(*delays) != 0 {
+		t.Fatalf("expected a single attempt, got %d calls and %v waits", inner.calls, *delays)
+	}
+	if driver.State() != BreakerClosed {
+		t.Fatalf("expected permanent error to leave breaker closed, got %s", driver.State())
+	}
+}
+
+func TestRetryingDriver_CircuitBreakerOpensAndRecovers(t *testing.T) {
+	inner := &flakyDriver{Driver: NewMemoryDriver(JoinedFull), failures: 4, err: io.ErrUnexpectedEOF}
+	transitions := []string{}
+	driver, _, clock := newTestRetryingDriver(inner, RetryOptions{
+		Attempts:         1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+		OnStateChange: func(from, to BreakerState) {
+			transitions = append(transitions, fmt.Sprintf("%s->%s", from, to))
+		},
+	})
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []Key{{Key: "metric", Granularity: "1h", At: &now}}
+	for i := 0; i < 2; i++ {
+		if err := driver.Inc(keys, map[string]any{"count": 1}); err == nil {
+			t.Fatalf("expected failure %d", i)
+		}
+	}
+	if driver.State() != BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", driver.State())
+	}
+	if err := driver.Inc(keys, map[string]any{"count": 1}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected fast failure, got %v", err)
+	}
+	if inner.calls != 2 {
+		t.Fatalf("expected open breaker to skip the driver, got %d calls", inner.calls)
+	}
+
+	*clock = clock.Add(time.Minute)
+	if driver.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open breaker after cooldown, got %s", driver.State())
+	}
+	if err := driver.Inc(keys, map[string]any{"count": 1}); err == nil {
+		t.Fatalf("expected failed probe")
+	}
+	if driver.State() != BreakerOpen {
+		t.Fatalf("expected failed probe to reopen breaker, got %s", driver.State())
+	}
+
+	*clock = clock.Add(time.Minute)
+	inner.failures = 0
+	if err := driver.Inc(keys, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("expected successful probe, got %v", err)
+	}
+	if driver.State() != BreakerClosed {
+		t.Fatalf("expected closed breaker, got %s", driver.State())
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if fmt.Sprint(transitions) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected transitions: %v", transitions)
+	}
+}
+
+func TestRetryingDriver_UnderBuffer(t *testing.T) {
+	memory := NewMemoryDriver(JoinedFull)
+	inner := &flakyDriver{Driver: memory, failures: 1, err: io.EOF}
+	driver, _, _ := newTestRetryingDriver(inner, RetryOptions{})
+
+	buffer := NewBuffer(driver, BufferOptions{Size: 100, Aggregate: true})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []Key{{Key: "metric", Granularity: "1h", At: &now}}
+	for i := 0; i < 3; i++ {
+		if err := buffer.Inc(keys, map[string]any{"count": 2}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	if err := buffer.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	values, err := memory.Get(keys)
+	if err != nil || values[0]["count"] != float64(6) {
+		t.Fatalf("unexpected stored values: %+v, %v", values, err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("boom"), false},
+		{"canceled", context.Canceled, false},
+		{"circuit open", ErrCircuitOpen, false},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), true},
+		{"refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{"net", &net.OpError{Op: "read", Err: errors.New("reset")}, true},
+		{"postgres deadlock", &pgconn.PgError{Code: "40P01"}, true},
+		{"postgres connection", &pgconn.PgError{Code: "08006"}, true},
+		{"postgres unique", &pgconn.PgError{Code: "23505"}, false},
+		{"mysql deadlock", &mysql.MySQLError{Number: 1213}, true},
+		{"mysql syntax", &mysql.MySQLError{Number: 1064}, false},
+		{"mysql invalid conn", mysql.ErrInvalidConn, true},
+		{"redis loading", redisReply("LOADING Redis is loading the dataset in memory"), true},
+		{"redis wrongtype", redisReply("WRONGTYPE Operation against a key"), false},
+		{"mongo retryable", mongo.CommandError{Labels: []string{"RetryableWriteError"}}, true},
+		{"mongo command", mongo.CommandError{Code: 2}, false},
+	}
+	for _, tc := range cases {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Fatalf("%s: IsRetryable(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
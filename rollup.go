@@ -0,0 +1,248 @@
+package triflestats
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RollupMode selects how source buckets fold into a coarser bucket.
+type RollupMode int
+
+const (
+	// RollupSum adds numeric values, matching data written with Track.
+	RollupSum RollupMode = iota
+	// RollupLast keeps the latest value of each field, matching data written
+	// with Assert.
+	RollupLast
+)
+
+type valuesOptions struct {
+	rollup       bool
+	rollupMode   RollupMode
+	rollupSource string
+}
+
+// ValuesOption configures Values queries.
+type ValuesOption func(*valuesOptions)
+
+// Rollup computes granularities missing from Config.Granularities on the fly
+// from the finest configured granularity whose buckets nest inside them.
+// Configured granularities are still read directly.
+func Rollup(mode RollupMode) ValuesOption {
+	return func(opts *valuesOptions) {
+		opts.rollup = true
+		opts.rollupMode = mode
+	}
+}
+
+// RollupFrom computes the requested granularity from source buckets, even when
+// the requested granularity is configured.
+func RollupFrom(source string, mode RollupMode) ValuesOption {
+	return func(opts *valuesOptions) {
+		opts.rollup = true
+		opts.rollupMode = mode
+		opts.rollupSource = source
+	}
+}
+
+// rollupSourceFor returns the granularity to roll up from, or nil when the
+// target should be read directly.
+func rollupSourceFor(cfg *Config, target *Parser, opts valuesOptions) (*Parser, error) {
+	if !opts.rollup {
+		return nil, nil
+	}
+
+	if opts.rollupSource != "" {
+		source := NewParser(opts.rollupSource)
+		if !source.Valid() {
+			return nil, fmt.Errorf("invalid rollup granularity: %s", opts.rollupSource)
+		}
+		if !granularityNests(cfg, source, target) {
+			return nil, fmt.Errorf("granularity %s does not roll up into %s", source.String, target.String)
+		}
+		return source, nil
+	}
+
+	var finest *Parser
+	for _, g := range cfg.EffectiveGranularities() {
+		if g == target.String {
+			return nil, nil
+		}
+		candidate := NewParser(g)
+		if !candidate.Valid() || !granularityNests(cfg, candidate, target) {
+			continue
+		}
+		if finest == nil || finerGranularity(candidate, finest) {
+			finest = candidate
+		}
+	}
+	if finest == nil {
+		return nil, fmt.Errorf("no configured granularity rolls up into %s", target.String)
+	}
+	return finest, nil
+}
+
+// granularityNests reports whether every source bucket lies inside a single
+// target bucket. Floor restarts sub-day buckets every minute, hour or day and
+// all others every year, so a source never straddles those boundaries.
+// Fiscal quarters restart every fiscal year instead, and ISO weeks every ISO
+// year, which does not nest in calendar years. Epoch-aligned buckets never
+// restart, see epochNests.
+func granularityNests(cfg *Config, source, target *Parser) bool {
+	if source.Unit == target.Unit {
+		return source.Offset != target.Offset && target.Offset%source.Offset == 0
+	}
+	if source.Unit > target.Unit {
+		return false
+	}
+	if cfg.alignment() == AlignEpoch {
+		return epochNests(cfg, source, target)
+	}
+
+	switch source.Unit {
+	case UnitSecond, UnitMinute, UnitHour:
+		return true
+	}
+	if target.Unit >= UnitFiscalQuarter {
+		return fiscalNests(cfg, source, target)
+	}
+	if target.Unit == UnitYear {
+		return source.Unit != UnitWeek || cfg.weekMode() != WeekModeISO
+	}
+	switch source.Unit {
+	case UnitDay:
+		return source.Offset == 1
+	case UnitMonth:
+		return target.Unit == UnitQuarter && (target.Offset*3)%source.Offset == 0
+	default:
+		return false
+	}
+}
+
+// fiscalNests reports whether calendar or fiscal quarter buckets nest inside
+// fiscal ones. Calendar months and quarters only do in the month-based fiscal
+// calendar, when fiscal quarters start on their boundaries.
+func fiscalNests(cfg *Config, source, target *Parser) bool {
+	switch source.Unit {
+	case UnitDay:
+		return source.Offset == 1
+	case UnitFiscalQuarter:
+		return target.Unit == UnitFiscalYear
+	}
+	if cfg.fiscalCalendar() != FiscalMonths || source.Offset != 1 {
+		return false
+	}
+	switch source.Unit {
+	case UnitMonth:
+		return true
+	case UnitQuarter:
+		return (cfg.fiscalYearStartMonth()-time.January)%3 == 0
+	default:
+		return false
+	}
+}
+
+// epochNests reports whether epoch-aligned source buckets nest inside longer
+// target units. Sub-day sources nest in sub-day targets whose length they
+// divide, and in days or longer when every day start falls on their grid.
+// Longer sources only nest as single days, months or fiscal quarters.
+func epochNests(cfg *Config, source, target *Parser) bool {
+	if source.Unit <= UnitHour {
+		size := unitDuration(source.Offset, source.Unit)
+		if target.Unit <= UnitHour {
+			return unitDuration(target.Offset, target.Unit)%size == 0
+		}
+		return cfg.dayStartsOnGrid(size)
+	}
+	if source.Offset != 1 {
+		return false
+	}
+	switch source.Unit {
+	case UnitDay:
+		return true
+	case UnitMonth:
+		if target.Unit >= UnitFiscalQuarter {
+			return fiscalNests(cfg, source, target)
+		}
+		return true
+	case UnitFiscalQuarter:
+		return target.Unit == UnitFiscalYear
+	default:
+		return false
+	}
+}
+
+func finerGranularity(a, b *Parser) bool {
+	if a.Unit != b.Unit {
+		return a.Unit < b.Unit
+	}
+	return a.Offset < b.Offset
+}
+
+// rollupValues reads source buckets covering timeline and folds them into the
+// target buckets.
+func rollupValues(ctx context.Context, cfg *Config, metricKeys []string, timeline []time.Time, target, source *Parser, mode RollupMode) ([][]map[string]any, error) {
+	results := make([][]map[string]any, len(metricKeys))
+	if len(timeline) == 0 {
+		for idx := range results {
+			results[idx] = []map[string]any{}
+		}
+		return results, nil
+	}
+
+	lastEnd := NewNocturnal(timeline[len(timeline)-1], cfg).Next(target.Offset, target.Unit)
+	sourceTimeline := Timeline(timeline[0], lastEnd.Add(-time.Nanosecond), source.Offset, source.Unit, cfg)
+	sourceValues, err := fetchTimelines(ctx, cfg, metricKeys, source.String, sourceTimeline)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[int64]int, len(timeline))
+	for idx, at := range timeline {
+		index[at.Unix()] = idx
+	}
+	targets := make([]int, len(sourceTimeline))
+	for idx, at := range sourceTimeline {
+		bucket, ok := index[NewNocturnal(at, cfg).Floor(target.Offset, target.Unit).Unix()]
+		if !ok {
+			bucket = -1
+		}
+		targets[idx] = bucket
+	}
+
+	for keyIdx := range metricKeys {
+		folded := make([]map[string]any, len(timeline))
+		for idx := range folded {
+			folded[idx] = map[string]any{}
+		}
+		for idx, values := range sourceValues[keyIdx] {
+			if targets[idx] < 0 || len(values) == 0 {
+				continue
+			}
+			foldRollup(folded[targets[idx]], Pack(values), mode)
+		}
+		for idx, packed := range folded {
+			folded[idx] = Unpack(packed)
+		}
+		results[keyIdx] = folded
+	}
+	return results, nil
+}
+
+func foldRollup(acc, packed map[string]any, mode RollupMode) {
+	for field, value := range packed {
+		if mode == RollupSum {
+			delta, ok := toFloat(value)
+			current, currentOK := toFloat(acc[field])
+			if _, exists := acc[field]; !exists {
+				currentOK = true
+			}
+			if ok && currentOK {
+				acc[field] = current + delta
+				continue
+			}
+		}
+		acc[field] = value
+	}
+}
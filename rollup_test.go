@@ -0,0 +1,161 @@
+package triflestats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newRollupConfig(granularities ...string) *Config {
+	cfg := DefaultConfig()
+	cfg.Driver = NewMemoryDriver(JoinedFull)
+	cfg.TimeZone = "UTC"
+	cfg.Granularities = granularities
+	cfg.BufferEnabled = false
+	return cfg
+}
+
+func TestGranularityNests(t *testing.T) {
+	cases := []struct {
+		source, target string
+		nests          bool
+	}{
+		{"1m", "6h", true},
+		{"15m", "1h", true},
+		{"20m", "30m", false},
+		{"1h", "6h", true},
+		{"6h", "1h", false},
+		{"1h", "1h", false},
+		{"1d", "1w", true},
+		{"2d", "1w", false},
+		{"1d", "1mo", true},
+		{"7d", "1y", true},
+		{"1w", "1mo", false},
+		{"1w", "1y", true},
+		{"1mo", "1q", true},
+		{"2mo", "1q", false},
+		{"2mo", "2q", true},
+		{"1q", "1y", true},
+		{"1y", "2y", true},
+	}
+	for _, tc := range cases {
+		if got := granularityNests(nil, NewParser(tc.source), NewParser(tc.target)); got != tc.nests {
+			t.Fatalf("granularityNests(%s, %s) = %v, want %v", tc.source, tc.target, got, tc.nests)
+		}
+	}
+}
+
+func TestValuesRollupSumsFinestGranularity(t *testing.T) {
+	cfg := newRollupConfig("1h", "1d")
+	start := time.Date(2025, 1, 15, 0, 30, 0, 0, time.UTC)
+	for hour := 0; hour < 12; hour++ {
+		at := start.Add(time.Duration(hour) * time.Hour)
+		if err := Track(cfg, "orders", at, map[string]any{"count": 1, "revenue": map[string]any{"usd": 2.5}}); err != nil {
+			t.Fatalf("track failed: %v", err)
+		}
+	}
+
+	from := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 15, 23, 0, 0, 0, time.UTC)
+	plain, err := Values(cfg, "orders", from, to, "6h", true)
+	if err != nil {
+		t.Fatalf("values failed: %v", err)
+	}
+	if len(plain.Values) != 0 {
+		t.Fatalf("expected untracked granularity to be empty without rollup, got %+v", plain)
+	}
+
+	result, err := Values(cfg, "orders", from, to, "6h", false, Rollup(RollupSum))
+	if err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	expectedAt := []time.Time{
+		from,
+		from.Add(6 * time.Hour),
+		from.Add(12 * time.Hour),
+		from.Add(18 * time.Hour),
+	}
+	if !reflect.DeepEqual(result.At, expectedAt) {
+		t.Fatalf("unexpected rollup timeline: %+v", result.At)
+	}
+	expected := []map[string]any{
+		{"count": float64(6), "revenue": map[string]any{"usd": 15.0}},
+		{"count": float64(6), "revenue": map[string]any{"usd": 15.0}},
+		{},
+		{},
+	}
+	if !reflect.DeepEqual(result.Values, expected) {
+		t.Fatalf("unexpected rollup values: %+v", result.Values)
+	}
+
+	direct, err := Values(cfg, "orders", from, to, "1d", false, Rollup(RollupSum))
+	if err != nil {
+		t.Fatalf("direct values failed: %v", err)
+	}
+	if direct.Values[0]["count"] != float64(12) {
+		t.Fatalf("expected configured granularity to be read directly, got %+v", direct)
+	}
+}
+
+func TestValuesRollupLastForAssertedKeys(t *testing.T) {
+	cfg := newRollupConfig("1d")
+	days := []struct {
+		day    int
+		values map[string]any
+	}{
+		{13, map[string]any{"workers": 4, "status": "ok"}},
+		{14, map[string]any{"workers": 6}},
+		{20, map[string]any{"workers": 2, "status": "degraded"}},
+	}
+	for _, d := range days {
+		at := time.Date(2025, 1, d.day, 12, 0, 0, 0, time.UTC)
+		if err := Assert(cfg, "pool", at, d.values); err != nil {
+			t.Fatalf("assert failed: %v", err)
+		}
+	}
+
+	from := time.Date(2025, 1, 13, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 20, 0, 0, 0, 0, time.UTC)
+	result, err := Values(cfg, "pool", from, to, "1w", true, Rollup(RollupLast))
+	if err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	expected := []map[string]any{
+		{"workers": float64(6), "status": "ok"},
+		{"workers": float64(2), "status": "degraded"},
+	}
+	if !reflect.DeepEqual(result.Values, expected) {
+		t.Fatalf("unexpected rollup values: %+v", result.Values)
+	}
+}
+
+func TestValuesRollupFromExplicitSource(t *testing.T) {
+	cfg := newRollupConfig("1h", "1d")
+	at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	if err := Track(cfg, "orders", at, map[string]any{"count": 3}); err != nil {
+		t.Fatalf("track failed: %v", err)
+	}
+
+	result, err := ValuesMany(cfg, []string{"orders", "missing"}, at, at, "1d", false, RollupFrom("1h", RollupSum))
+	if err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	if result["orders"].Values[0]["count"] != float64(3) {
+		t.Fatalf("unexpected rollup values: %+v", result["orders"])
+	}
+	if len(result["missing"].Values) != 1 || len(result["missing"].Values[0]) != 0 {
+		t.Fatalf("expected empty bucket for missing key, got %+v", result["missing"])
+	}
+
+	if _, err := Values(cfg, "orders", at, at, "1h", false, RollupFrom("1d", RollupSum)); err == nil {
+		t.Fatalf("expected error rolling a coarser granularity into a finer one")
+	}
+}
+
+func TestValuesRollupRequiresNestingSource(t *testing.T) {
+	cfg := newRollupConfig("1w")
+	at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	if _, err := Values(cfg, "orders", at, at, "1mo", false, Rollup(RollupSum)); err == nil {
+		t.Fatalf("expected error when no configured granularity nests into 1mo")
+	}
+}
@@ -0,0 +1,72 @@
+package triflestats
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// rowWrite is one upsert of a batch written by a SQL driver.
+type rowWrite struct {
+	ident    identifier
+	packed   map[string]any
+	op       string
+	expireAt *time.Time
+}
+
+// orderedRowWrites lays out the upserts of a batch so concurrent transactions
+// lock rows in the same order: data rows sorted by identifier, keeping the
+// order of writes to the same row, then system tracking rows sorted the same
+// way. Every metric of a bucket shares its system row, so each one gets a
+// single increment folding the counts of the whole batch.
+func orderedRowWrites(operations []BatchOperation, retention Retention, systemTracking bool, identify func(Key) (identifier, error)) ([]rowWrite, error) {
+	writes := []rowWrite{}
+	system := map[string]*rowWrite{}
+	for _, operation := range operations {
+		if len(operation.Keys) == 0 {
+			continue
+		}
+		packed := Pack(operation.Values)
+		if len(packed) == 0 {
+			continue
+		}
+		for _, key := range operation.Keys {
+			ident, err := identify(key)
+			if err != nil {
+				return nil, err
+			}
+			expireAt := retention.ExpireAt(key.Granularity, key.At)
+			writes = append(writes, rowWrite{ident: ident, packed: packed, op: operation.Operation, expireAt: expireAt})
+			if !systemTracking {
+				continue
+			}
+
+			systemIdent, err := identify(Key{
+				Key:         systemKeyName,
+				Granularity: key.Granularity,
+				At:          key.At,
+				TrackingKey: key.TrackingKey,
+			})
+			if err != nil {
+				return nil, err
+			}
+			data := systemDataFor(key.SystemTrackingKey(), max(operation.Count, 1))
+			if folded, ok := system[systemIdent.lookupKey]; ok {
+				folded.packed = mergeIncrement(folded.packed, data)
+				continue
+			}
+			system[systemIdent.lookupKey] = &rowWrite{ident: systemIdent, packed: data, op: "inc", expireAt: expireAt}
+		}
+	}
+
+	byIdentifier := func(a, b rowWrite) int {
+		return strings.Compare(a.ident.lookupKey, b.ident.lookupKey)
+	}
+	slices.SortStableFunc(writes, byIdentifier)
+	systemWrites := make([]rowWrite, 0, len(system))
+	for _, write := range system {
+		systemWrites = append(systemWrites, *write)
+	}
+	slices.SortFunc(systemWrites, byIdentifier)
+	return append(writes, systemWrites...), nil
+}
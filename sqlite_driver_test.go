@@ -1,12 +1,15 @@
 package triflestats
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"reflect"
+	"regexp"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	_ "modernc.org/sqlite"
 )
 
@@ -151,6 +154,86 @@ func TestSQLiteDriver_SystemTracking(t *testing.T) {
 	}
 }
 
+func TestSQLiteDriver_WriteBatchOrdersRowsAndFoldsSystemTracking(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock setup failed: %v", err)
+	}
+	defer db.Close()
+
+	driver := NewSQLiteDriver(db, "test_stats", JoinedSeparated)
+	driver.SystemTracking = true
+
+	at := time.Date(2025, 2, 1, 11, 0, 0, 0, time.UTC)
+	orders := Key{Key: "orders", Granularity: "1h", At: &at}
+	events := Key{Key: "events", Granularity: "1h", At: &at}
+	stamp := formatAt(at)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats")).
+		WithArgs("events", "1h", stamp, `{"count":1}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats")).
+		WithArgs("orders", "1h", stamp, `{"count":1}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats")).
+		WithArgs("orders", "1h", stamp, `{"count":2}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO test_stats")).
+		WithArgs(systemKeyName, "1h", stamp, `{"count":4,"keys.events":1,"keys.orders":3}`, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = driver.WriteBatch(context.Background(), []BatchOperation{
+		{Operation: "inc", Keys: []Key{orders}, Values: map[string]any{"count": 1}, Count: 1},
+		{Operation: "inc", Keys: []Key{events}, Values: map[string]any{"count": 1}, Count: 1},
+		{Operation: "inc", Keys: []Key{orders}, Values: map[string]any{"count": 2}, Count: 2},
+	})
+	if err != nil {
+		t.Fatalf("write batch failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestSQLiteDriver_AddressesKeysWithQuotesAndBackslashes(t *testing.T) {
+	db := newTestDB(t)
+	driver := NewSQLiteDriver(db, "trifle_stats", JoinedFull)
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	at := time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+	key := Key{Key: "event", Granularity: "1h", At: &at}
+	values := map[string]any{
+		`back\slash`: 1,
+		`say "hi"`:   2,
+		"path":       map[string]any{`c:\tmp`: 3},
+		"nested":     map[string]any{`say "hi"`: 5},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := driver.Inc([]Key{key}, values); err != nil {
+			t.Fatalf("inc failed: %v", err)
+		}
+	}
+
+	got, err := driver.Get([]Key{key})
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	expect := map[string]any{
+		`back\slash`: float64(2),
+		`say "hi"`:   float64(4),
+		"path":       map[string]any{`c:\tmp`: float64(6)},
+		"nested":     map[string]any{`say "hi"`: float64(10)},
+	}
+	if !reflect.DeepEqual(got[0], expect) {
+		t.Fatalf("unexpected data: %+v", got[0])
+	}
+}
+
 func TestSQLiteDriver_StoresRFC3339Timestamp(t *testing.T) {
 	db := newTestDB(t)
 	driver := NewSQLiteDriver(db, "trifle_stats", JoinedSeparated)
@@ -212,6 +295,116 @@ func TestSQLiteDriver_GetMatchesZeroMicrosecondRFC3339Variants(t *testing.T) {
 	}
 }
 
+func TestSQLiteDriver_GetSpansMultipleBatches(t *testing.T) {
+	db := newTestDB(t)
+	driver := NewSQLiteDriver(db, "trifle_stats", JoinedSeparated)
+	driver.SystemTracking = false
+	if err := driver.Setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	start := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	total := getBatchSize*2 + 7
+	keys := make([]Key, 0, total)
+	for i := 0; i < total; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		keys = append(keys, Key{Key: "event", Granularity: "1m", At: &at})
+	}
+	last := keys[total-1]
+	if err := driver.Inc([]Key{keys[0], keys[getBatchSize], last}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+
+	values, err := driver.Get(keys)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if len(values) != total {
+		t.Fatalf("expected %d rows, got %d", total, len(values))
+	}
+	for idx, row := range values {
+		written := idx == 0 || idx == getBatchSize || idx == total-1
+		if written && row["count"] != float64(1) {
+			t.Fatalf("expected count at index %d, got %+v", idx, row)
+		}
+		if !written && len(row) != 0 {
+			t.Fatalf("expected empty row at index %d, got %+v", idx, row)
+		}
+	}
+}
+
+func TestSQLiteDriver_RetentionPurge(t *testing.T) {
+	for _, mode := range []JoinedIdentifier{JoinedFull, JoinedPartial, JoinedSeparated} {
+		t.Run(modeName(mode), func(t *testing.T) {
+			db := newTestDB(t)
+			driver := NewSQLiteDriver(db, "trifle_stats", mode)
+			driver.Retention = Retention{"1m": 48 * time.Hour}
+			if err := driver.Setup(); err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+
+			old := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+			recent := time.Now().UTC().Truncate(time.Minute)
+			keys := []Key{
+				{Key: "event", Granularity: "1m", At: &old},
+				{Key: "event", Granularity: "1m", At: &recent},
+				{Key: "event", Granularity: "1d", At: &old},
+			}
+			if err := driver.Inc(keys, map[string]any{"count": 1}); err != nil {
+				t.Fatalf("inc failed: %v", err)
+			}
+
+			purged, err := driver.Purge(context.Background())
+			if err != nil {
+				t.Fatalf("purge failed: %v", err)
+			}
+			// The expired 1m bucket and its system tracking row.
+			if purged != 2 {
+				t.Fatalf("expected 2 purged rows, got %d", purged)
+			}
+
+			got, err := driver.Get(keys)
+			if err != nil {
+				t.Fatalf("get failed: %v", err)
+			}
+			if len(got[0]) != 0 {
+				t.Fatalf("expected expired bucket to be purged, got %+v", got[0])
+			}
+			if got[1]["count"] != float64(1) || got[2]["count"] != float64(1) {
+				t.Fatalf("expected retained buckets to survive, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestSQLiteDriver_SetupAddsExpireAtToExistingTable(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec(`CREATE TABLE trifle_stats (key TEXT PRIMARY KEY, data TEXT NOT NULL DEFAULT '{}');`); err != nil {
+		t.Fatalf("create legacy table failed: %v", err)
+	}
+
+	driver := NewSQLiteDriver(db, "trifle_stats", JoinedFull)
+	driver.SystemTracking = false
+	driver.Retention = Retention{"1m": 48 * time.Hour}
+	for i := 0; i < 2; i++ {
+		if err := driver.Setup(); err != nil {
+			t.Fatalf("setup %d failed: %v", i+1, err)
+		}
+	}
+
+	old := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	if err := driver.Inc([]Key{{Key: "event", Granularity: "1m", At: &old}}, map[string]any{"count": 1}); err != nil {
+		t.Fatalf("inc failed: %v", err)
+	}
+	purged, err := driver.Purge(context.Background())
+	if err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected 1 purged row, got %d", purged)
+	}
+}
+
 func newTestDB(t *testing.T) *sql.DB {
 	t.Helper()
 	dsn := fmt.Sprintf("file:memdb_%d?mode=memory&cache=shared", time.Now().UnixNano())
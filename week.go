@@ -0,0 +1,48 @@
+package triflestats
+
+import (
+	"fmt"
+	"time"
+)
+
+// WeekMode selects how week buckets are laid out.
+type WeekMode int
+
+const (
+	// WeekModeYear starts weeks on BeginningOfWeek and restarts them every
+	// calendar year, so the days before the first full week form a short week
+	// starting on January 1st.
+	WeekModeYear WeekMode = iota
+	// WeekModeISO follows ISO-8601: weeks start on Monday, always last seven
+	// days and belong to the ISO year holding their Thursday, so they may
+	// cross New Year. Multi-week buckets restart every ISO year.
+	WeekModeISO
+)
+
+func (c *Config) weekMode() WeekMode {
+	if c == nil {
+		return WeekModeYear
+	}
+	return c.WeekMode
+}
+
+// ISOWeek returns the ISO-8601 year and week of the day holding the time in
+// the configured time zone.
+func (n *Nocturnal) ISOWeek() (year, week int) {
+	y, m, d := n.dayOf(n.ensureLocation(n.Time))
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).ISOWeek()
+}
+
+// ISOWeekLabel returns the ISO-8601 week label of the time, like "2025-W03".
+func (n *Nocturnal) ISOWeekLabel() string {
+	year, week := n.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", year, week)
+}
+
+// isoWeekStart returns the Monday starting an ISO week, counting weeks past
+// the last one of the year into the following years.
+func isoWeekStart(year, week int) time.Time {
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+	firstMonday := jan4.AddDate(0, 0, -mod(int(jan4.Weekday())-1, 7))
+	return firstMonday.AddDate(0, 0, (week-1)*7)
+}
@@ -0,0 +1,93 @@
+package triflestats
+
+import (
+	"testing"
+	"time"
+)
+
+func newISOWeekConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.TimeZone = "UTC"
+	cfg.WeekMode = WeekModeISO
+	return cfg
+}
+
+func TestNocturnalISOWeekFloor(t *testing.T) {
+	loc := time.UTC
+	cfg := newISOWeekConfig()
+	cfg.BeginningOfWeek = time.Sunday
+
+	cases := []struct {
+		at       time.Time
+		offset   int
+		expected time.Time
+	}{
+		{time.Date(2025, 1, 1, 12, 0, 0, 0, loc), 1, time.Date(2024, 12, 30, 0, 0, 0, 0, loc)},
+		{time.Date(2021, 1, 3, 12, 0, 0, 0, loc), 1, time.Date(2020, 12, 28, 0, 0, 0, 0, loc)},
+		{time.Date(2021, 1, 4, 0, 0, 0, 0, loc), 1, time.Date(2021, 1, 4, 0, 0, 0, 0, loc)},
+		{time.Date(2021, 1, 3, 12, 0, 0, 0, loc), 2, time.Date(2020, 12, 28, 0, 0, 0, 0, loc)},
+		{time.Date(2021, 1, 12, 12, 0, 0, 0, loc), 2, time.Date(2021, 1, 4, 0, 0, 0, 0, loc)},
+	}
+	for _, tc := range cases {
+		if got := NewNocturnal(tc.at, cfg).Floor(tc.offset, UnitWeek); !got.Equal(tc.expected) {
+			t.Fatalf("floor %v to %dw: expected %v, got %v", tc.at, tc.offset, tc.expected, got)
+		}
+	}
+
+	cfg.WeekMode = WeekModeYear
+	if got := NewNocturnal(time.Date(2025, 1, 1, 12, 0, 0, 0, loc), cfg).Floor(1, UnitWeek); !got.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, loc)) {
+		t.Fatalf("expected default mode to keep the partial first week, got %v", got)
+	}
+}
+
+func TestNocturnalISOWeekTimeline(t *testing.T) {
+	cfg := newISOWeekConfig()
+	from := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	weeks := Timeline(from, to, 1, UnitWeek, cfg)
+	for idx, start := range weeks {
+		if start.Weekday() != time.Monday {
+			t.Fatalf("week %v does not start on Monday", start)
+		}
+		if idx > 0 && start.Sub(weeks[idx-1]) != 7*24*time.Hour {
+			t.Fatalf("week %v does not last seven days", weeks[idx-1])
+		}
+	}
+
+	pairs := Timeline(from, to, 2, UnitWeek, cfg)
+	for idx := 1; idx < len(pairs); idx++ {
+		previous, start := pairs[idx-1], pairs[idx]
+		length := start.Sub(previous)
+		_, week := start.ISOWeek()
+		if length != 14*24*time.Hour && !(length == 7*24*time.Hour && week == 1) {
+			t.Fatalf("two week bucket %v lasts %v", previous, length)
+		}
+	}
+}
+
+func TestNocturnalISOWeekLabel(t *testing.T) {
+	cfg := newISOWeekConfig()
+	if label := NewNocturnal(time.Date(2021, 1, 3, 12, 0, 0, 0, time.UTC), cfg).ISOWeekLabel(); label != "2020-W53" {
+		t.Fatalf("unexpected label: %s", label)
+	}
+
+	cfg.TimeZone = "Asia/Tokyo"
+	n := NewNocturnal(time.Date(2024, 12, 29, 23, 30, 0, 0, time.UTC), cfg)
+	if year, week := n.ISOWeek(); year != 2025 || week != 1 {
+		t.Fatalf("expected 2025-W01 in Tokyo, got %d-W%02d", year, week)
+	}
+	if label := NewNocturnal(n.Floor(1, UnitWeek), cfg).ISOWeekLabel(); label != "2025-W01" {
+		t.Fatalf("expected bucket label 2025-W01, got %s", label)
+	}
+}
+
+func TestGranularityNestsISOWeeks(t *testing.T) {
+	cfg := newISOWeekConfig()
+	if granularityNests(cfg, NewParser("1w"), NewParser("1y")) {
+		t.Fatalf("expected ISO weeks not to nest in calendar years")
+	}
+	if !granularityNests(cfg, NewParser("1d"), NewParser("1w")) || !granularityNests(cfg, NewParser("1w"), NewParser("2w")) {
+		t.Fatalf("expected days and single weeks to nest in ISO weeks")
+	}
+}